@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+type adapter struct {
+	Name  string
+	Flags net.Flags
+	Addrs []net.Addr
+}
+
+func listAdapters() ([]adapter, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	adapters := []adapter{}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		adapters = append(adapters, adapter{Name: i.Name, Flags: i.Flags, Addrs: addrs})
+	}
+	return adapters, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.IPNet:
+		return v.IP
+	case *net.IPAddr:
+		return v.IP
+	}
+	return nil
+}
+
+func matchesFamily(ip net.IP, family string) bool {
+	if family == "ipv6" {
+		return ip.To4() == nil && ip.To16() != nil && !ip.IsLinkLocalUnicast()
+	}
+	return ip.To4() != nil
+}
+
+func printAdapters() error {
+	adapters, err := listAdapters()
+	if err != nil {
+		return err
+	}
+	for _, a := range adapters {
+		for _, addr := range a.Addrs {
+			if ip := addrIP(addr); ip != nil && ip.To4() != nil {
+				fmt.Printf("%s: %s\n", a.Name, addr.String())
+			}
+		}
+	}
+	return nil
+}
+
+// selectAddress picks the first address of the wanted family. Interfaces
+// that are down are always skipped and loopback interfaces are only used
+// when they are the configured adapter.
+func selectAddress(adapters []adapter, name, family string) (*net.IP, error) {
+	if family == "" {
+		family = "ipv4"
+	}
+	for _, a := range adapters {
+		if name != "" && name != a.Name {
+			continue
+		}
+		if a.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if a.Flags&net.FlagLoopback != 0 && name == "" {
+			continue
+		}
+		for _, addr := range a.Addrs {
+			ip := addrIP(addr)
+			if ip == nil || !matchesFamily(ip, family) {
+				continue
+			}
+			found := make(net.IP, len(ip))
+			copy(found, ip)
+			return &found, nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("No %s address found on adapter %s", family, name)
+	}
+	return nil, errors.New("No " + family + " address found on any adapter")
+}
+
+func getIPAddress(config Config) (*net.IP, error) {
+	adapters, err := listAdapters()
+	if err != nil {
+		return nil, err
+	}
+	return selectAddress(adapters, config.DefaultAdapter, config.AdapterFamily)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func ipNet(cidr string) net.Addr {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ipnet.IP = ip
+	return ipnet
+}
+
+func TestSelectAddress(t *testing.T) {
+	adapters := []adapter{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []net.Addr{ipNet("127.0.0.1/8"), ipNet("::1/128")}},
+		{Name: "eth0", Flags: 0, Addrs: []net.Addr{ipNet("192.0.2.10/24")}},
+		{Name: "eth1", Flags: net.FlagUp, Addrs: []net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::1/64"), ipNet("198.51.100.7/24")}},
+		{Name: "wlan0", Flags: net.FlagUp, Addrs: []net.Addr{ipNet("203.0.113.5/24")}},
+	}
+	tests := []struct {
+		name    string
+		adapter string
+		family  string
+		want    string
+		wantErr bool
+	}{
+		{name: "first up non-loopback IPv4", want: "198.51.100.7"},
+		{name: "explicit ipv4", family: "ipv4", want: "198.51.100.7"},
+		{name: "ipv6 skips link-local", family: "ipv6", want: "2001:db8::1"},
+		{name: "named adapter", adapter: "wlan0", want: "203.0.113.5"},
+		{name: "loopback when named", adapter: "lo", want: "127.0.0.1"},
+		{name: "loopback ipv6 when named", adapter: "lo", family: "ipv6", want: "::1"},
+		{name: "down adapter", adapter: "eth0", wantErr: true},
+		{name: "family missing on adapter", adapter: "wlan0", family: "ipv6", wantErr: true},
+		{name: "unknown adapter", adapter: "eth9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := selectAddress(adapters, tt.adapter, tt.family)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != tt.want {
+				t.Errorf("got %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectAddressOnlyLoopback(t *testing.T) {
+	adapters := []adapter{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []net.Addr{ipNet("127.0.0.1/8")}},
+	}
+	if ip, err := selectAddress(adapters, "", ""); err == nil {
+		t.Fatalf("got %s, want an error when only loopback is up", ip)
+	}
+}
+
+func TestIPv6OnlyAdapter(t *testing.T) {
+	adapters := []adapter{
+		{Name: "eth0", Flags: net.FlagUp, Addrs: []net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::1/64")}},
+	}
+	ip, err := selectAddress(adapters, "eth0", "")
+	if err == nil {
+		t.Fatalf("got %s from an adapter without IPv4", ip)
+	}
+	if want := "No ipv4 address found on adapter eth0"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+
+	// Queries then match on the client address instead of failing.
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+adapter: eth0
+matchBy: server
+recursion: false
+`)
+	// buildConfig leaves ServerIP unset when the lookup above fails.
+	c.ServerIP = nil
+	m := ask(t, c, "10.0.0.1", "nas.home", dns.TypeA)
+	if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("answer = %v, want the rule for the client network", got)
+	}
+}
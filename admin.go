@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+)
+
+type RawAdmin struct {
+	Addr  string `yaml:"addr,omitempty"`
+	Token string `yaml:"token,omitempty"`
+}
+
+// adminRule is the JSON form of a single rule. On POST, Value takes the
+// same short form as the config file: an IP address or a CNAME target.
+type adminRule struct {
+	Network string   `json:"network"`
+	Name    string   `json:"name"`
+	Value   string   `json:"value,omitempty"`
+	IPs     []string `json:"ip,omitempty"`
+	// Weights runs parallel to IPs, as in Rule.
+	Weights []int    `json:"weight,omitempty"`
+	CNAME   string   `json:"cname,omitempty"`
+	TXT     []string `json:"txt,omitempty"`
+	MX      []string `json:"mx,omitempty"`
+	TTL     uint32   `json:"ttl,omitempty"`
+}
+
+// adminAPI applies rule changes to the running config and, unless persist
+// is off, writes them back to configPath so they survive a restart.
+type adminAPI struct {
+	configPath string
+	persist    bool
+}
+
+// newAdminServer serves GET/POST /rules, DELETE /rules/{name} and GET
+// /stats.
+func newAdminServer(raw RawAdmin, configPath string, persist bool) *http.Server {
+	api := &adminAPI{configPath: configPath, persist: persist}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", api.handleRules)
+	mux.HandleFunc("/rules/", api.handleRule)
+	mux.HandleFunc("/stats", handleStats)
+	return &http.Server{Addr: raw.Addr, Handler: requireToken(raw.Token, mux)}
+}
+
+func serveAdmin(server *http.Server, listener net.Listener) {
+	log.Printf("Admin API listening at %s\n", server.Addr)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("Admin listener failed: %v\n", err)
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (api *adminAPI) handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, listRules(currentConfig()))
+	case http.MethodPost:
+		var req adminRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		configChangeMu.Lock()
+		defer configChangeMu.Unlock()
+		rule, raw, err := addRule(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := api.save(func(rawConfig *RawConfig) {
+			rawConfig.setRule(req.Network, rule.Name, raw)
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *adminAPI) handleRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/rules/"))
+	if name == "" {
+		http.Error(w, "Missing rule name", http.StatusBadRequest)
+		return
+	}
+	cidr := r.URL.Query().Get("network")
+	if cidr != "" {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid CIDR %q: %v", cidr, err), http.StatusBadRequest)
+			return
+		}
+		cidr = network.String()
+	}
+	configChangeMu.Lock()
+	defer configChangeMu.Unlock()
+	if !deleteRule(dns.Fqdn(name), cidr) {
+		http.Error(w, fmt.Sprintf("No rule for %s", name), http.StatusNotFound)
+		return
+	}
+	if err := api.save(func(rawConfig *RawConfig) {
+		rawConfig.deleteRule(cidr, dns.Fqdn(name))
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// save applies the same change to the config file. A failure leaves the
+// change active in memory only.
+func (api *adminAPI) save(update func(rawConfig *RawConfig)) error {
+	if !api.persist {
+		return nil
+	}
+	if err := saveConfig(api.configPath, update); err != nil {
+		log.Printf("[WARN] Failed to save %s: %v\n", api.configPath, err)
+		return fmt.Errorf("Rule is active but was not saved to %s: %v", api.configPath, err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[WARN] Failed to write admin response: %v\n", err)
+	}
+}
+
+func toAdminRule(network, name string, rule Rule) adminRule {
+	out := adminRule{Network: network, Name: name, IPs: rule.IPs, Weights: rule.Weights, CNAME: rule.CNAME, TXT: rule.TXT, TTL: rule.TTL}
+	for _, mx := range rule.MX {
+		out.MX = append(out.MX, fmt.Sprintf("%d %s", mx.Preference, mx.Host))
+	}
+	return out
+}
+
+func listRules(config Config) []adminRule {
+	rules := []adminRule{}
+	for _, network := range config.Networks {
+		names := make([]string, 0, len(network.Rules))
+		for name := range network.Rules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rules = append(rules, toAdminRule(network.Name, name, network.Rules[name]))
+		}
+	}
+	return rules
+}
+
+// hasCIDR reports whether cidr is one of the ranges the network was
+// configured with, compared by parsed network as RawNetwork.hasCIDR does.
+func (network Network) hasCIDR(cidr string) bool {
+	_, want, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	for _, c := range strings.Split(network.Name, ",") {
+		if _, have, err := net.ParseCIDR(c); err == nil && have.String() == want.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// addRule stores a rule in the network configured with req.Network, creating
+// that network when no such one exists yet. Networks are copied before they
+// are changed because queries in flight still read the old config.
+func addRule(req adminRule) (adminRule, RawRule, error) {
+	_, cidr, err := net.ParseCIDR(req.Network)
+	if err != nil {
+		return adminRule{}, RawRule{}, fmt.Errorf("Invalid CIDR %q: %v", req.Network, err)
+	}
+	if _, ok := dns.IsDomainName(req.Name); !ok || req.Name == "" {
+		return adminRule{}, RawRule{}, fmt.Errorf("Invalid domain name %q", req.Name)
+	}
+	if req.Weights != nil && len(req.Weights) != len(req.IPs) {
+		return adminRule{}, RawRule{}, fmt.Errorf("Rule for %s has %d weights for %d addresses", req.Name, len(req.Weights), len(req.IPs))
+	}
+	raw := RawRule{IP: addresses(req.IPs...), CNAME: req.CNAME, TXT: req.TXT, MX: req.MX, TTL: req.TTL}
+	for i, weight := range req.Weights {
+		raw.IP[i].Weight = weight
+	}
+	if req.Value != "" {
+		if net.ParseIP(req.Value) != nil {
+			raw.IP = append(raw.IP, RawAddress{IP: req.Value})
+		} else {
+			raw.CNAME = req.Value
+		}
+	}
+	if len(raw.IP) == 0 && raw.CNAME == "" && len(raw.TXT) == 0 && len(raw.MX) == 0 {
+		return adminRule{}, RawRule{}, fmt.Errorf("Rule for %s has no value", req.Name)
+	}
+	if problems := validateRule(raw); len(problems) > 0 {
+		return adminRule{}, RawRule{}, fmt.Errorf("Rule for %s %s", req.Name, strings.Join(problems, ", "))
+	}
+	rule, err := buildRule(raw, currentConfig().DefaultTTL)
+	if err != nil {
+		return adminRule{}, RawRule{}, err
+	}
+	name := dns.Fqdn(strings.ToLower(req.Name))
+	var networkName string
+	updateConfig(func(c *Config) {
+		networks := append([]Network(nil), c.Networks...)
+		idx := -1
+		for i, network := range networks {
+			if network.source == nil && !network.fromEtcd && network.hasCIDR(cidr.String()) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			ranger := cidranger.NewPCTrieRanger()
+			ranger.Insert(cidranger.NewBasicRangerEntry(*cidr))
+			networks = append(networks, Network{Name: cidr.String(), Ranger: ranger})
+			idx = len(networks) - 1
+		}
+		rules := make(map[string]Rule, len(networks[idx].Rules)+1)
+		for k, v := range networks[idx].Rules {
+			rules[k] = v
+		}
+		rules[name] = rule
+		networks[idx].Rules = rules
+		networks[idx].index()
+		networkName = networks[idx].Name
+		c.Networks = networks
+	})
+	dnsCache.invalidate()
+	return toAdminRule(networkName, name, rule), raw, nil
+}
+
+// deleteRule removes the rule for name from the network configured with
+// cidr, or from every network when cidr is empty. Like addRule, it leaves
+// the networks of a rule source or etcd alone.
+func deleteRule(name, cidr string) bool {
+	deleted := false
+	updateConfig(func(c *Config) {
+		networks := append([]Network(nil), c.Networks...)
+		for i, network := range networks {
+			if network.source != nil || network.fromEtcd {
+				continue
+			}
+			if cidr != "" && !network.hasCIDR(cidr) {
+				continue
+			}
+			if _, ok := network.Rules[name]; !ok {
+				continue
+			}
+			rules := make(map[string]Rule, len(network.Rules))
+			for k, v := range network.Rules {
+				if k != name {
+					rules[k] = v
+				}
+			}
+			networks[i].Rules = rules
+			networks[i].index()
+			deleted = true
+		}
+		c.Networks = networks
+	})
+	if deleted {
+		dnsCache.invalidate()
+	}
+	return deleted
+}
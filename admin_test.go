@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const adminTestConfig = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    a.test: 10.1.1.1
+matchBy: client
+`
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	useConfig(t, loadTestConfig(t, adminTestConfig))
+	handler := newAdminServer(RawAdmin{Token: "secret"}, "", false).Handler
+	for _, token := range []string{"", "wrong"} {
+		if rec := adminRequest(t, handler, http.MethodGet, "/rules", token, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: got HTTP %d, want 401", token, rec.Code)
+		}
+	}
+}
+
+func TestAdminRules(t *testing.T) {
+	useConfig(t, loadTestConfig(t, adminTestConfig))
+	handler := newAdminServer(RawAdmin{Token: "secret"}, "", false).Handler
+
+	rec := adminRequest(t, handler, http.MethodGet, "/rules", "secret", "")
+	var rules []adminRule
+	if err := json.Unmarshal(rec.Body.Bytes(), &rules); err != nil {
+		t.Fatalf("GET /rules: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Name != "a.test." || rules[0].IPs[0] != "10.1.1.1" {
+		t.Fatalf("GET /rules = %+v", rules)
+	}
+
+	rec = adminRequest(t, handler, http.MethodPost, "/rules", "secret", `{"network":"10.0.0.0/8","name":"B.test","ip":["10.2.2.2","10.2.2.3"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /rules: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	rule, ok := currentConfig().Networks[0].Rules["b.test."]
+	if !ok || len(rule.IPs) != 2 {
+		t.Fatalf("rule after POST = %+v, %v", rule, ok)
+	}
+
+	rec = adminRequest(t, handler, http.MethodDelete, "/rules/b.test", "secret", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /rules/b.test: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := currentConfig().Networks[0].Rules["b.test."]; ok {
+		t.Error("rule still present after DELETE")
+	}
+	if rec := adminRequest(t, handler, http.MethodDelete, "/rules/b.test", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE: HTTP %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminRejects(t *testing.T) {
+	useConfig(t, loadTestConfig(t, adminTestConfig))
+	handler := newAdminServer(RawAdmin{Token: "secret"}, "", false).Handler
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/rules", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/rules", `{"network":"10.0.0.0/33","name":"c.test","value":"10.3.3.3"}`, http.StatusBadRequest},
+		{http.MethodPost, "/rules", `{"network":"10.0.0.0/8","name":"c.test"}`, http.StatusBadRequest},
+		{http.MethodPut, "/rules", ``, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/rules/a.test", ``, http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/rules/a.test?network=10.0.0.0/33", ``, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(t, handler, tt.method, tt.path, "secret", tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s %s: HTTP %d, want %d", tt.method, tt.path, tt.body, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminDeleteLeavesBackendsAlone(t *testing.T) {
+	c := loadTestConfig(t, adminTestConfig)
+	etcdNetwork := c.Networks[0]
+	etcdNetwork.fromEtcd = true
+	c.Networks = append(c.Networks, etcdNetwork)
+	useConfig(t, c)
+	handler := newAdminServer(RawAdmin{Token: "secret"}, "", false).Handler
+
+	// The network is matched by its parsed range, not its spelling.
+	rec := adminRequest(t, handler, http.MethodDelete, "/rules/a.test?network=10.0.0.1/8", "secret", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /rules/a.test: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	networks := currentConfig().Networks
+	if _, ok := networks[0].Rules["a.test."]; ok {
+		t.Error("rule still present after DELETE")
+	}
+	if _, ok := networks[1].Rules["a.test."]; !ok {
+		t.Error("DELETE removed the rule of the etcd network")
+	}
+	if rec := adminRequest(t, handler, http.MethodDelete, "/rules/a.test", "secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of an etcd rule: HTTP %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminPersistsRules(t *testing.T) {
+	path := writeTestFile(t, "config.yml", adminTestConfig)
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+	handler := newAdminServer(RawAdmin{Token: "secret"}, path, true).Handler
+
+	rec := adminRequest(t, handler, http.MethodPost, "/rules", "secret", `{"network":"10.0.0.0/8","name":"b.test","value":"10.2.2.2"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /rules: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	rec = adminRequest(t, handler, http.MethodPost, "/rules", "secret", `{"network":"172.16.0.0/12","name":"c.test","value":"172.16.1.1"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /rules: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	rec = adminRequest(t, handler, http.MethodDelete, "/rules/a.test", "secret", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /rules/a.test: HTTP %d: %s", rec.Code, rec.Body)
+	}
+
+	reloaded, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatalf("reloading the saved file: %v", err)
+	}
+	rules := map[string]string{}
+	for _, network := range reloaded.Networks {
+		for name, rule := range network.Rules {
+			rules[network.Name+" "+name] = strings.Join(rule.IPs, ",")
+		}
+	}
+	want := map[string]string{"10.0.0.0/8 b.test.": "10.2.2.2", "172.16.0.0/12 c.test.": "172.16.1.1"}
+	if len(rules) != len(want) {
+		t.Fatalf("rules after reload = %v, want %v", rules, want)
+	}
+	for key, ip := range want {
+		if rules[key] != ip {
+			t.Errorf("rules after reload = %v, want %v", rules, want)
+		}
+	}
+}
+
+func TestAdminSaveChecksIncludes(t *testing.T) {
+	path := writeTestFile(t, "config.yml", "include: extra.yml\n"+adminTestConfig)
+	extra := filepath.Join(filepath.Dir(path), "extra.yml")
+	if err := os.WriteFile(extra, []byte("defaultTtl: 120\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+	handler := newAdminServer(RawAdmin{Token: "secret"}, path, true).Handler
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The included file broke after startup, so the saved config would
+	// not load again.
+	if err := os.WriteFile(extra, []byte("port: 70000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := adminRequest(t, handler, http.MethodPost, "/rules", "secret", `{"network":"10.0.0.0/8","name":"b.test","value":"10.2.2.2"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("POST /rules: HTTP %d, want 500", rec.Code)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("config was rewritten to:\n%s", after)
+	}
+}
+
+func TestAdminConcurrentPosts(t *testing.T) {
+	path := writeTestFile(t, "config.yml", adminTestConfig)
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+	handler := newAdminServer(RawAdmin{Token: "secret"}, path, true).Handler
+
+	const posts = 20
+	done := make(chan int, posts)
+	for i := 0; i < posts; i++ {
+		go func(i int) {
+			body := fmt.Sprintf(`{"network":"10.0.0.0/8","name":"host%d.test","value":"10.9.0.%d"}`, i, i+1)
+			done <- adminRequest(t, handler, http.MethodPost, "/rules", "secret", body).Code
+		}(i)
+	}
+	for i := 0; i < posts; i++ {
+		if code := <-done; code != http.StatusCreated {
+			t.Errorf("POST /rules: HTTP %d", code)
+		}
+	}
+	reloaded, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reloaded.Networks[0].Rules); got != posts+1 {
+		t.Errorf("saved file has %d rules, want %d", got, posts+1)
+	}
+}
+
+func TestAdminWeights(t *testing.T) {
+	useConfig(t, loadTestConfig(t, adminTestConfig))
+	handler := newAdminServer(RawAdmin{Token: "secret"}, "", false).Handler
+
+	rec := adminRequest(t, handler, http.MethodPost, "/rules", "secret", `{"network":"10.0.0.0/8","name":"lb.test","ip":["10.2.2.2","10.2.2.3"],"weight":[3,1]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /rules: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	rec = adminRequest(t, handler, http.MethodGet, "/rules", "secret", "")
+	var rules []adminRule
+	if err := json.Unmarshal(rec.Body.Bytes(), &rules); err != nil {
+		t.Fatalf("GET /rules: %v", err)
+	}
+	found := false
+	for _, rule := range rules {
+		if rule.Name == "lb.test." {
+			found = true
+			if len(rule.Weights) != 2 || rule.Weights[0] != 3 || rule.Weights[1] != 1 {
+				t.Errorf("weights of lb.test. = %v, want [3 1]", rule.Weights)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("lb.test. missing from GET /rules: %+v", rules)
+	}
+
+	rec = adminRequest(t, handler, http.MethodPost, "/rules", "secret", `{"network":"10.0.0.0/8","name":"lb2.test","ip":["10.2.2.2","10.2.2.3"],"weight":[3]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with fewer weights than addresses: HTTP %d, want 400", rec.Code)
+	}
+	if _, ok := currentConfig().Networks[0].Rules["lb2.test."]; ok {
+		t.Error("rule with mismatched weights was added")
+	}
+}
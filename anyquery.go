@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// anyAnswer keeps ANY queries from being used for amplification. With
+// anyMode hinfo, the default, the reply is the single synthesized HINFO
+// record of RFC 8482; with refuse it is REFUSED.
+func anyAnswer(q dns.Question, config Config) ([]dns.RR, int) {
+	if config.AnyMode == "refuse" {
+		return nil, dns.RcodeRefused
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: config.DefaultTTL}
+	return []dns.RR{&dns.HINFO{Hdr: hdr, Cpu: "RFC8482"}}, dns.RcodeSuccess
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnyQuery(t *testing.T) {
+	var forwarded int32
+	upstream := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&forwarded, 1)
+		stubAnswering("203.0.113.1")(w, r)
+	})
+	const config = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+upstream: [%s]
+`
+	tests := []struct {
+		mode  string
+		rcode int
+		want  []string
+	}{
+		{"", dns.RcodeSuccess, []string{`"RFC8482" ""`}},
+		{"hinfo", dns.RcodeSuccess, []string{`"RFC8482" ""`}},
+		{"refuse", dns.RcodeRefused, []string{}},
+	}
+	for _, tt := range tests {
+		text := fmt.Sprintf(config, upstream)
+		if tt.mode != "" {
+			text += "anyMode: " + tt.mode + "\n"
+		}
+		c := loadTestConfig(t, text)
+		for _, name := range []string{"nas.home.", "example.com."} {
+			m := ask(t, c, "10.0.0.1", name, dns.TypeANY)
+			if m.Rcode != tt.rcode || !reflect.DeepEqual(answerValues(m), tt.want) {
+				t.Errorf("anyMode %q: ANY %s = %s %v, want %s %v", tt.mode, name, dns.RcodeToString[m.Rcode], answerValues(m), dns.RcodeToString[tt.rcode], tt.want)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 0 {
+		t.Errorf("%d ANY queries forwarded", n)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultBlocklistRefresh = 24 * time.Hour
+	blocklistFetchTimeout   = 30 * time.Second
+)
+
+type RawBlocklist struct {
+	Domains []string      `yaml:"domains,omitempty"`
+	Files   []string      `yaml:"files,omitempty"`
+	URLs    []string      `yaml:"urls,omitempty"`
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+}
+
+func (raw RawBlocklist) empty() bool {
+	return len(raw.Domains) == 0 && len(raw.Files) == 0 && len(raw.URLs) == 0
+}
+
+func (raw RawBlocklist) refreshInterval() time.Duration {
+	if raw.Refresh > 0 {
+		return raw.Refresh
+	}
+	return defaultBlocklistRefresh
+}
+
+// Blocklist holds blocked names. A "*." entry blocks every subdomain of
+// its parent but not the parent itself, the same way wildcard rules match.
+type Blocklist struct {
+	exact    map[string]bool
+	wildcard map[string]bool
+}
+
+func NewBlocklist() *Blocklist {
+	return &Blocklist{exact: map[string]bool{}, wildcard: map[string]bool{}}
+}
+
+func (b *Blocklist) add(domain string) {
+	domain = dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+	if strings.HasPrefix(domain, "*.") {
+		b.wildcard[strings.TrimPrefix(domain, "*.")] = true
+	} else {
+		b.exact[domain] = true
+	}
+}
+
+var hostsPlaceholders = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// parseDomainList reads either a plain list with one domain per line or a
+// hosts file such as "0.0.0.0 ads.example.com", skipping comments and the
+// loopback names hosts files usually start with.
+func parseDomainList(r io.Reader) ([]string, error) {
+	domains := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			if hostsPlaceholders[strings.ToLower(field)] {
+				continue
+			}
+			if _, ok := dns.IsDomainName(field); ok {
+				domains = append(domains, field)
+			}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+func readDomainFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDomainList(f)
+}
+
+type remoteList struct {
+	domains []string
+	fetched time.Time
+}
+
+var (
+	remoteListsMu sync.Mutex
+	remoteLists   = map[string]remoteList{}
+)
+
+// fetchRemoteList returns the domains served at url, downloading them again
+// only once the cached copy is older than maxAge. A failed download falls
+// back to the previous copy when there is one.
+func fetchRemoteList(url string, maxAge time.Duration) ([]string, bool, error) {
+	remoteListsMu.Lock()
+	cached, ok := remoteLists[url]
+	remoteListsMu.Unlock()
+	if ok && time.Since(cached.fetched) < maxAge {
+		return cached.domains, false, nil
+	}
+
+	domains, err := downloadDomainList(url)
+	if err != nil {
+		if ok {
+			log.Printf("[WARN] Failed to refresh blocklist %s, keeping previous copy: %v\n", url, err)
+			return cached.domains, false, nil
+		}
+		return nil, false, err
+	}
+	remoteListsMu.Lock()
+	remoteLists[url] = remoteList{domains: domains, fetched: time.Now()}
+	remoteListsMu.Unlock()
+	return domains, true, nil
+}
+
+// cachedRemoteList returns the last downloaded copy of url, however old.
+func cachedRemoteList(url string) ([]string, bool) {
+	remoteListsMu.Lock()
+	defer remoteListsMu.Unlock()
+	cached, ok := remoteLists[url]
+	return cached.domains, ok
+}
+
+func downloadDomainList(url string) ([]string, error) {
+	client := &http.Client{Timeout: blocklistFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP %d", url, resp.StatusCode)
+	}
+	return parseDomainList(resp.Body)
+}
+
+// buildBlocklist assembles every configured source into one Blocklist and
+// reports whether any remote list was downloaded in the process. Without
+// download, remote lists come from earlier downloads only and lists never
+// downloaded are left out until refreshBlocklists fetches them.
+func buildBlocklist(raw RawBlocklist, download bool) (*Blocklist, bool, error) {
+	b := NewBlocklist()
+	for _, domain := range raw.Domains {
+		b.add(domain)
+	}
+	for _, path := range raw.Files {
+		domains, err := readDomainFile(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to read blocklist %s: %v", path, err)
+		}
+		for _, domain := range domains {
+			b.add(domain)
+		}
+	}
+	refreshed := false
+	for _, url := range raw.URLs {
+		if !download {
+			domains, _ := cachedRemoteList(url)
+			for _, domain := range domains {
+				b.add(domain)
+			}
+			continue
+		}
+		domains, fetched, err := fetchRemoteList(url, raw.refreshInterval())
+		if err != nil {
+			log.Printf("[WARN] Failed to fetch blocklist %s: %v\n", url, err)
+			continue
+		}
+		refreshed = refreshed || fetched
+		for _, domain := range domains {
+			b.add(domain)
+		}
+	}
+	return b, refreshed, nil
+}
+
+// refreshBlocklists periodically re-fetches remote lists of the current
+// config and swaps in the rebuilt Blocklist when any of them changed.
+func refreshBlocklists(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		source := currentConfig().BlocklistSource
+		if len(source.URLs) == 0 {
+			continue
+		}
+		blocklist, refreshed, err := buildBlocklist(source, true)
+		if err != nil {
+			log.Printf("[WARN] %v\n", err)
+			continue
+		}
+		if refreshed {
+			updateConfig(func(c *Config) {
+				// A reload during the download may have changed the lists.
+				if reflect.DeepEqual(c.BlocklistSource, source) {
+					c.Blocklist = blocklist
+				}
+			})
+			log.Printf("Refreshed blocklist, %d entries\n", blocklist.len())
+		}
+	}
+}
+
+func (b *Blocklist) len() int {
+	return len(b.exact) + len(b.wildcard)
+}
+
+func (b *Blocklist) blocked(name string) bool {
+	if b == nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	if b.exact[name] {
+		return true
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if b.wildcard[dns.Fqdn(strings.Join(labels[i:], "."))] {
+			return true
+		}
+	}
+	return false
+}
+
+func blockedAnswer(q dns.Question, mode string) ([]dns.RR, int) {
+	if mode != "zero" {
+		return nil, dns.RcodeNameError
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch q.Qtype {
+	case dns.TypeA:
+		return []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}, dns.RcodeSuccess
+	case dns.TypeAAAA:
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}, dns.RcodeSuccess
+	}
+	return nil, dns.RcodeSuccess
+}
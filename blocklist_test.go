@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockModes(t *testing.T) {
+	file := writeTestFile(t, "blocked.txt", "# ad servers\nads.example.com\n*.tracker.example.net # and their subdomains\n")
+	for _, tc := range []struct {
+		mode  string
+		rcode int
+		a     []string
+		aaaa  []string
+	}{
+		{"nxdomain", dns.RcodeNameError, []string{}, []string{}},
+		{"zero", dns.RcodeSuccess, []string{"0.0.0.0"}, []string{"::"}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    tracker.example.net: 10.0.0.7
+blocklist:
+  domains: [BLOCKED.example.org]
+  files: [`+file+`]
+blockMode: `+tc.mode+`
+matchBy: client
+`))
+			for _, name := range []string{"blocked.example.org.", "ads.example.com.", "x.tracker.example.net."} {
+				m := query(t, "10.0.0.1", name, dns.TypeA)
+				if m.Rcode != tc.rcode || !reflect.DeepEqual(answerValues(m), tc.a) {
+					t.Errorf("A %s got %s %v, want %s %v", name, dns.RcodeToString[m.Rcode], answerValues(m), dns.RcodeToString[tc.rcode], tc.a)
+				}
+				m = query(t, "10.0.0.1", name, dns.TypeAAAA)
+				if m.Rcode != tc.rcode || !reflect.DeepEqual(answerValues(m), tc.aaaa) {
+					t.Errorf("AAAA %s got %s %v, want %s %v", name, dns.RcodeToString[m.Rcode], answerValues(m), dns.RcodeToString[tc.rcode], tc.aaaa)
+				}
+			}
+			if got := answerValues(query(t, "10.0.0.1", "tracker.example.net.", dns.TypeA)); len(got) != 1 || got[0] != "10.0.0.7" {
+				t.Errorf("tracker.example.net. got %v, want its rule", got)
+			}
+		})
+	}
+}
+
+func TestBlocklistDownload(t *testing.T) {
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "127.0.0.1 localhost\n0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.net # tracking\n")
+	}))
+	path := writeTestFile(t, "config.yml", `
+blocklist:
+  urls: [`+lists.URL+`/hosts]
+matchBy: client
+`)
+	c, _, err := loadConfig(path, true, loadServe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"ads.example.com.":     true,
+		"tracker.example.net.": true,
+		"localhost.":           false,
+		"example.com.":         false,
+	} {
+		if got := c.Blocklist.blocked(name); got != want {
+			t.Errorf("%s blocked = %v, want %v", name, got, want)
+		}
+	}
+
+	// A reload does not download again and keeps the earlier copy.
+	lists.Close()
+	c, _, err = loadConfig(path, true, loadReload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Blocklist.blocked("ads.example.com.") {
+		t.Error("ads.example.com. is not blocked after a reload")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Stale answers are handed out with a short TTL so that clients come back
+// soon and pick up a fresh answer once the upstream recovers.
+const staleTTL = 30
+
+const defaultCacheMaxEntries = 100000
+
+// cacheShards splits the cache so that queries for different names rarely
+// wait on the same lock.
+const cacheShards = 32
+
+type cacheEntry struct {
+	key     cacheKey
+	rrs     []dns.RR
+	rcode   int
+	expires time.Time
+	// lifetime is the TTL the entry was stored with.
+	lifetime time.Duration
+}
+
+type cacheKey struct {
+	ipStr string
+	name  string
+	qtype uint16
+}
+
+// Cache holds answers per matching address, spread over shards by key. Each
+// shard evicts its least recently used entry once it holds its share of
+// maxEntries.
+type Cache struct {
+	shards [cacheShards]*cacheShard
+	// epoch counts invalidations. Answers worked out before the latest one
+	// are not stored.
+	epoch uint64
+}
+
+type cacheShard struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[cacheKey]*list.Element
+	order      *list.List
+}
+
+func NewCache() *Cache {
+	c := &Cache{}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{entries: map[cacheKey]*list.Element{}, order: list.New()}
+	}
+	c.setMaxEntries(defaultCacheMaxEntries)
+	return c
+}
+
+// shard hashes the key with FNV-1a.
+func (c *Cache) shard(key cacheKey) *cacheShard {
+	h := uint32(2166136261)
+	for _, part := range []string{key.ipStr, key.name} {
+		for i := 0; i < len(part); i++ {
+			h = (h ^ uint32(part[i])) * 16777619
+		}
+	}
+	h = (h ^ uint32(key.qtype)) * 16777619
+	return c.shards[h%cacheShards]
+}
+
+func (c *Cache) lookup(key cacheKey) (cacheEntry, bool) {
+	return c.shard(key).lookup(key)
+}
+
+func (c *cacheShard) lookup(key cacheKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return *elem.Value.(*cacheEntry), true
+}
+
+// get returns copies of the cached records with their TTL lowered to the
+// remaining lifetime. Negative entries come back with no records and the
+// cached rcode; ok is false when nothing usable is cached.
+func (c *Cache) get(ipStr, name string, qtype uint16) (rrs []dns.RR, rcode int, ok bool) {
+	entry, found := c.lookup(newCacheKey(ipStr, name, qtype))
+	if !found {
+		return nil, 0, false
+	}
+	remaining := time.Until(entry.expires)
+	if remaining <= 0 {
+		return nil, 0, false
+	}
+	return withOwner(copyWithTTL(entry.rrs, uint32(remaining/time.Second)), name), entry.rcode, true
+}
+
+// expiresSoon reports whether the records cached for the question have no
+// more than threshold of their lifetime left. Negative entries never do.
+func (c *Cache) expiresSoon(ipStr, name string, qtype uint16, threshold float64) bool {
+	entry, ok := c.lookup(newCacheKey(ipStr, name, qtype))
+	if !ok || len(entry.rrs) == 0 {
+		return false
+	}
+	remaining := time.Until(entry.expires)
+	return remaining > 0 && remaining <= time.Duration(float64(entry.lifetime)*threshold)
+}
+
+// getStale returns records that expired less than window ago. Entries stay
+// in the cache for that long before removeExpired evicts them.
+func (c *Cache) getStale(ipStr, name string, qtype uint16, window time.Duration) []dns.RR {
+	entry, ok := c.lookup(newCacheKey(ipStr, name, qtype))
+	if !ok || len(entry.rrs) == 0 || time.Since(entry.expires) > window {
+		return nil
+	}
+	return withOwner(copyWithTTL(entry.rrs, staleTTL), name)
+}
+
+// newCacheKey ignores the case of name, which the entry may have been
+// stored under in a different spelling.
+func newCacheKey(ipStr, name string, qtype uint16) cacheKey {
+	return cacheKey{ipStr, strings.ToLower(name), qtype}
+}
+
+// withOwner spells the owner names that match name the way the query did.
+func withOwner(rrs []dns.RR, name string) []dns.RR {
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = name
+		}
+	}
+	return rrs
+}
+
+func copyWithTTL(rrs []dns.RR, ttl uint32) []dns.RR {
+	copies := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copies[i] = dns.Copy(rr)
+		copies[i].Header().Ttl = ttl
+	}
+	return copies
+}
+
+// set stores rrs unless the cache was invalidated after epoch, when they
+// may have been worked out from a config that is gone.
+func (c *Cache) set(epoch uint64, ipStr, name string, qtype uint16, rrs []dns.RR) {
+	if len(rrs) == 0 {
+		return
+	}
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	c.store(epoch, cacheEntry{key: newCacheKey(ipStr, name, qtype), rrs: rrs, rcode: dns.RcodeSuccess, expires: expiry(ttl), lifetime: time.Duration(ttl) * time.Second})
+}
+
+// setNegative remembers that name has no records of qtype, either because
+// the name does not exist (NXDOMAIN) or because it has other types only.
+func (c *Cache) setNegative(epoch uint64, ipStr, name string, qtype uint16, rcode int, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	c.store(epoch, cacheEntry{key: newCacheKey(ipStr, name, qtype), rcode: rcode, expires: expiry(ttl)})
+}
+
+func expiry(ttl uint32) time.Time {
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+func (c *Cache) store(epoch uint64, entry cacheEntry) {
+	shard := c.shard(entry.key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	// invalidate moves the epoch on before it clears the shards, so under
+	// the shard lock an entry either lands before the clear or is turned
+	// away.
+	if epoch != c.currentEpoch() {
+		return
+	}
+	shard.storeLocked(entry)
+}
+
+// storeLocked adds or replaces the entry. The caller must hold c.mu.
+func (c *cacheShard) storeLocked(entry cacheEntry) {
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = &entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(&entry)
+	c.evict()
+}
+
+// evict drops least recently used entries until the shard fits. The caller
+// must hold c.mu.
+func (c *cacheShard) evict() {
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *cacheShard) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// setMaxEntries divides maxEntries over the shards, rounding up so that
+// every shard keeps at least one entry.
+func (c *Cache) setMaxEntries(maxEntries int) {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	perShard := (maxEntries + cacheShards - 1) / cacheShards
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		shard.maxEntries = perShard
+		shard.evict()
+		shard.mu.Unlock()
+	}
+}
+
+// size counts the entries, expired ones included until the next sweep.
+func (c *Cache) size() int {
+	n := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		n += shard.order.Len()
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// currentEpoch is read before the config a query answers from, so that a
+// change of config in between shows as a newer epoch.
+func (c *Cache) currentEpoch() uint64 {
+	return atomic.LoadUint64(&c.epoch)
+}
+
+// invalidate drops every answer after a change of config, along with those
+// that queries still running on the old config would store later.
+func (c *Cache) invalidate() {
+	atomic.AddUint64(&c.epoch, 1)
+	c.flush()
+}
+
+func (c *Cache) flush() {
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		shard.entries = map[cacheKey]*list.Element{}
+		shard.order.Init()
+		shard.mu.Unlock()
+	}
+}
+
+// removeExpired drops entries that expired more than retain ago.
+func (c *Cache) removeExpired(retain time.Duration) {
+	now := time.Now().Add(-retain)
+	for _, shard := range c.shards {
+		shard.removeExpired(now)
+	}
+}
+
+func (c *cacheShard) removeExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if !elem.Value.(*cacheEntry).expires.After(now) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *Cache) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.removeExpired(currentConfig().StaleWindow)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testA(name, ip string, ttl uint32) []dns.RR {
+	return []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP(ip)}}
+}
+
+func TestConcurrentQueriesForOneName(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 0.0.0.0/0
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+`))
+
+	// Run with -race: every query reads and most write the same cache entry.
+	var wg sync.WaitGroup
+	writers := make([]*recordingWriter, 300)
+	for i := range writers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := new(dns.Msg)
+			r.SetQuestion("nas.home.", dns.TypeA)
+			writers[i] = handle(t, "127.0.0.1", r)
+		}(i)
+	}
+	wg.Wait()
+	for i, w := range writers {
+		if m := w.reply(t); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.168.1.5" {
+			t.Fatalf("query %d answered %v", i, m.Answer)
+		}
+	}
+}
+
+func TestCachedRuleExpires(t *testing.T) {
+	const rules = `
+networks:
+- cidr: 0.0.0.0/0
+  rules:
+    nas.home: {ip: %s, ttl: 1}
+matchBy: client
+`
+	useConfig(t, loadTestConfig(t, fmt.Sprintf(rules, "192.168.1.5")))
+	if got := answerValues(query(t, "127.0.0.1", "nas.home.", dns.TypeA)); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Fatalf("first query answered %v", got)
+	}
+
+	// Change the rule behind the cache: the cached answer is served until
+	// its TTL runs out, then the rule is looked up again.
+	setConfig(loadTestConfig(t, fmt.Sprintf(rules, "192.168.1.6")))
+	if got := answerValues(query(t, "127.0.0.1", "nas.home.", dns.TypeA)); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("query within the TTL answered %v, want the cached 192.168.1.5", got)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if got := answerValues(query(t, "127.0.0.1", "nas.home.", dns.TypeA)); len(got) != 1 || got[0] != "192.168.1.6" {
+		t.Errorf("query after the TTL answered %v, want 192.168.1.6", got)
+	}
+}
+
+func TestUpstreamAnswerIsCached(t *testing.T) {
+	var asked int32
+	answer := stubAnswering("10.30.30.30")
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+		answer(w, r)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nmatchBy: client\n"))
+
+	for i := 0; i < 2; i++ {
+		if got := answerValues(query(t, "10.0.0.1", "cached.example.", dns.TypeA)); len(got) != 1 || got[0] != "10.30.30.30" {
+			t.Fatalf("query %d answered %v, want 10.30.30.30", i+1, got)
+		}
+	}
+	if got := atomic.LoadInt32(&asked); got != 1 {
+		t.Errorf("upstream was asked %d times, want 1", got)
+	}
+}
+
+func TestAAndAAAAAreCachedApart(t *testing.T) {
+	var asked int32
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("10.40.40.40")})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("fd00::40")})
+		}
+		w.WriteMsg(m)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nmatchBy: client\n"))
+
+	for i := 0; i < 2; i++ {
+		if got := answerValues(query(t, "10.0.0.1", "dual.example.", dns.TypeA)); len(got) != 1 || got[0] != "10.40.40.40" {
+			t.Errorf("A query %d answered %v", i+1, got)
+		}
+		if got := answerValues(query(t, "10.0.0.1", "dual.example.", dns.TypeAAAA)); len(got) != 1 || got[0] != "fd00::40" {
+			t.Errorf("AAAA query %d answered %v", i+1, got)
+		}
+	}
+	if got := atomic.LoadInt32(&asked); got != 2 {
+		t.Errorf("upstream was asked %d times, want 2", got)
+	}
+}
+
+func TestStaleAnswerWhileUpstreamIsDown(t *testing.T) {
+	var down int32
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.LoadInt32(&down) == 1 {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}, A: net.ParseIP("10.6.6.6")})
+		w.WriteMsg(m)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nupstreamTimeout: 200ms\nserveStale: true\nmatchBy: client\n"))
+
+	if got := answerValues(query(t, "10.0.0.1", "stale.example.", dns.TypeA)); len(got) != 1 || got[0] != "10.6.6.6" {
+		t.Fatalf("first query answered %v", got)
+	}
+	atomic.StoreInt32(&down, 1)
+	time.Sleep(1100 * time.Millisecond)
+	m := query(t, "10.0.0.1", "stale.example.", dns.TypeA)
+	if got := answerValues(m); m.Rcode != dns.RcodeSuccess || len(got) != 1 || got[0] != "10.6.6.6" {
+		t.Fatalf("query with the upstream down got %s %v, want the stale 10.6.6.6", dns.RcodeToString[m.Rcode], got)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != staleTTL {
+		t.Errorf("stale answer has TTL %d, want %d", ttl, staleTTL)
+	}
+}
+
+func TestNXDOMAINIsCached(t *testing.T) {
+	var asked int32
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = append(m.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.example.", Mbox: "admin.example.", Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 30})
+		w.WriteMsg(m)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nmatchBy: client\n"))
+
+	for i := 0; i < 2; i++ {
+		if m := query(t, "10.0.0.1", "missing.example.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+			t.Errorf("query %d got %s, want NXDOMAIN", i+1, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if got := atomic.LoadInt32(&asked); got != 1 {
+		t.Errorf("upstream was asked %d times, want 1", got)
+	}
+}
+
+func TestCacheShardEvictsLeastRecentlyUsed(t *testing.T) {
+	shard := NewCache().shards[0]
+	shard.maxEntries = 3
+	key := func(i int) cacheKey {
+		return newCacheKey("10.0.0.1", fmt.Sprintf("host%d.test.", i), dns.TypeA)
+	}
+	for i := 1; i <= 3; i++ {
+		shard.storeLocked(cacheEntry{key: key(i), rrs: testA(key(i).name, "10.1.1.1", 60), expires: expiry(60)})
+	}
+	// Touch host1 so that host2 is now the least recently used.
+	if _, ok := shard.lookup(key(1)); !ok {
+		t.Fatal("host1 missing before the cap was reached")
+	}
+	shard.storeLocked(cacheEntry{key: key(4), rrs: testA(key(4).name, "10.1.1.1", 60), expires: expiry(60)})
+
+	for i, want := range map[int]bool{1: true, 2: false, 3: true, 4: true} {
+		if _, ok := shard.lookup(key(i)); ok != want {
+			t.Errorf("host%d cached = %v, want %v", i, ok, want)
+		}
+	}
+	if shard.order.Len() != 3 {
+		t.Errorf("shard holds %d entries, want 3", shard.order.Len())
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c := NewCache()
+	c.setMaxEntries(cacheShards * 2)
+	for i := 0; i < cacheShards*20; i++ {
+		name := fmt.Sprintf("host%d.test.", i)
+		c.set(c.currentEpoch(), "10.0.0.1", name, dns.TypeA, testA(name, "10.1.1.1", 60))
+	}
+	if size := c.size(); size > cacheShards*2 {
+		t.Errorf("cache holds %d entries, want at most %d", size, cacheShards*2)
+	}
+	// The entry stored last is the most recently used of its shard.
+	last := fmt.Sprintf("host%d.test.", cacheShards*20-1)
+	if _, _, ok := c.get("10.0.0.1", last, dns.TypeA); !ok {
+		t.Errorf("%s was evicted", last)
+	}
+}
+
+func TestInvalidateTurnsAwayOldAnswers(t *testing.T) {
+	c := NewCache()
+	before := c.currentEpoch()
+	c.invalidate()
+	// A query that read the config before the change stores its answer
+	// only after invalidate has run.
+	c.set(before, "10.0.0.1", "old.test.", dns.TypeA, testA("old.test.", "10.1.1.1", 60))
+	if _, _, ok := c.get("10.0.0.1", "old.test.", dns.TypeA); ok {
+		t.Error("answer from before the invalidation was cached")
+	}
+	c.set(c.currentEpoch(), "10.0.0.1", "new.test.", dns.TypeA, testA("new.test.", "10.2.2.2", 60))
+	if _, _, ok := c.get("10.0.0.1", "new.test.", dns.TypeA); !ok {
+		t.Error("answer from after the invalidation was not cached")
+	}
+}
+
+func TestCacheSetMaxEntriesShrinks(t *testing.T) {
+	c := NewCache()
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("host%d.test.", i)
+		c.set(c.currentEpoch(), "10.0.0.1", name, dns.TypeA, testA(name, "10.1.1.1", 60))
+	}
+	c.setMaxEntries(cacheShards)
+	if size := c.size(); size > cacheShards {
+		t.Errorf("cache holds %d entries after shrinking, want at most %d", size, cacheShards)
+	}
+}
+
+// singleLockCache puts every key in one shard, as the cache was before it
+// was split.
+func singleLockCache() *Cache {
+	c := NewCache()
+	for i := range c.shards {
+		c.shards[i] = c.shards[0]
+	}
+	c.shards[0].maxEntries = defaultCacheMaxEntries
+	return c
+}
+
+// BenchmarkCacheParallel mixes lookups with one store in ten over a thousand
+// names from all procs at once.
+func BenchmarkCacheParallel(b *testing.B) {
+	names := make([]string, 1000)
+	records := make([][]dns.RR, len(names))
+	for i := range names {
+		names[i] = fmt.Sprintf("host%d.bench.test.", i)
+		records[i] = testA(names[i], "10.1.1.1", 3600)
+	}
+	for name, c := range map[string]*Cache{"SingleLock": singleLockCache(), "Sharded": NewCache()} {
+		b.Run(name, func(b *testing.B) {
+			for i := range names {
+				c.set(c.currentEpoch(), "10.0.0.1", names[i], dns.TypeA, records[i])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			var procs int64
+			b.RunParallel(func(pb *testing.PB) {
+				// Each proc starts elsewhere in the names so that they do
+				// not walk the same shards in step.
+				i := int(atomic.AddInt64(&procs, 1)) * 997
+				for pb.Next() {
+					n := i % len(names)
+					if i%10 == 0 {
+						c.set(c.currentEpoch(), "10.0.0.1", names[n], dns.TypeA, records[n])
+					} else {
+						c.get("10.0.0.1", names[n], dns.TypeA)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
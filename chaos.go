@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// chaosAnswer answers the CHAOS class TXT names that monitoring tools use
+// to identify a server. With hideVersion, and for any other CHAOS query,
+// the reply is REFUSED.
+func chaosAnswer(q dns.Question, config Config) ([]dns.RR, int) {
+	if (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) || config.HideVersion {
+		return nil, dns.RcodeRefused
+	}
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		value = config.Version
+	case "hostname.bind.", "id.server.":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, dns.RcodeServerFailure
+		}
+		value = hostname
+	default:
+		return nil, dns.RcodeRefused
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}
+	return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{value}}}, dns.RcodeSuccess
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// askChaos queries name in the CHAOS class.
+func askChaos(t *testing.T, c Config, name string) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.Question = []dns.Question{{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassCHAOS}}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if err := parseQuery(context.Background(), m, r, c, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}, &QueryLog{}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestVersionBind(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules: {}
+version: home-dns 1.2
+`)
+	for _, name := range []string{"version.bind.", "VERSION.SERVER."} {
+		m := askChaos(t, c, name)
+		if m.Rcode != dns.RcodeSuccess || !reflect.DeepEqual(answerValues(m), []string{`"home-dns 1.2"`}) {
+			t.Errorf("%s = %s %v, want the configured version", name, dns.RcodeToString[m.Rcode], answerValues(m))
+		}
+		if len(m.Answer) == 1 && m.Answer[0].Header().Class != dns.ClassCHAOS {
+			t.Errorf("%s answered in class %s", name, dns.ClassToString[m.Answer[0].Header().Class])
+		}
+	}
+	if m := askChaos(t, c, "authors.bind."); m.Rcode != dns.RcodeRefused {
+		t.Errorf("authors.bind. = %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestHideVersion(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules: {}
+version: home-dns 1.2
+hideVersion: true
+`)
+	for _, name := range []string{"version.bind.", "hostname.bind."} {
+		if m := askChaos(t, c, name); m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+			t.Errorf("%s = %s %v with hideVersion, want REFUSED", name, dns.RcodeToString[m.Rcode], answerValues(m))
+		}
+	}
+}
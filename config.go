@@ -0,0 +1,972 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+	"gopkg.in/yaml.v2"
+)
+
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	var multi []string
+	if err := unmarshal(&multi); err != nil {
+		return err
+	}
+	*l = StringList(multi)
+	return nil
+}
+
+// RawAddress is an address of a rule, written as a plain address or as
+// {ip: <address>, weight: <n>} to get a share of answers relative to the
+// other addresses of the same family.
+type RawAddress struct {
+	IP     string `yaml:"ip"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+type AddressList []RawAddress
+
+func (l *AddressList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single RawAddress
+	if err := single.UnmarshalYAML(unmarshal); err == nil {
+		*l = AddressList{single}
+		return nil
+	}
+	var multi []RawAddress
+	if err := unmarshal(&multi); err != nil {
+		return err
+	}
+	*l = AddressList(multi)
+	return nil
+}
+
+// MarshalYAML writes plain addresses unless a weight was given.
+func (a RawAddress) MarshalYAML() (interface{}, error) {
+	if a.Weight == 0 {
+		return a.IP, nil
+	}
+	type plain RawAddress
+	return plain(a), nil
+}
+
+func (a *RawAddress) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		a.IP = short
+		return nil
+	}
+	type plain RawAddress
+	return unmarshal((*plain)(a))
+}
+
+// addresses turns plain addresses into an AddressList.
+func addresses(ips ...string) AddressList {
+	l := make(AddressList, len(ips))
+	for i, ip := range ips {
+		l[i] = RawAddress{IP: ip}
+	}
+	return l
+}
+
+type RawRule struct {
+	IP       AddressList  `yaml:"ip,omitempty"`
+	CNAME    string       `yaml:"cname,omitempty"`
+	TXT      []string     `yaml:"txt,omitempty"`
+	MX       []string     `yaml:"mx,omitempty"`
+	HTTPS    []string     `yaml:"https,omitempty"`
+	SVCB     []string     `yaml:"svcb,omitempty"`
+	SRV      []RawSRV     `yaml:"srv,omitempty"`
+	Schedule *RawSchedule `yaml:"schedule,omitempty"`
+	TTL      uint32       `yaml:"ttl,omitempty"`
+}
+
+// isAddressList tells a short-form list of addresses apart from a list of
+// SRV records, which also decodes into RawAddress but without an ip.
+func isAddressList(ips []RawAddress) bool {
+	for _, ip := range ips {
+		if ip.IP == "" {
+			return false
+		}
+	}
+	return true
+}
+
+type RawSRV struct {
+	Priority uint16 `yaml:"priority"`
+	Weight   uint16 `yaml:"weight"`
+	Port     uint16 `yaml:"port"`
+	Target   string `yaml:"target"`
+}
+
+// UnmarshalYAML takes a bare address, or a host name as CNAME target. A
+// value shaped like an address that does not parse as one is an error rather
+// than a CNAME.
+func (r *RawRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		switch {
+		case net.ParseIP(short) != nil:
+			r.IP = addresses(short)
+		case looksLikeIP(short):
+			return fmt.Errorf("Invalid IP address %q", short)
+		default:
+			r.CNAME = short
+		}
+		return nil
+	}
+	var ips []RawAddress
+	if err := unmarshal(&ips); err == nil && isAddressList(ips) {
+		r.IP = AddressList(ips)
+		return nil
+	}
+	var srv []RawSRV
+	if err := unmarshal(&srv); err == nil {
+		r.SRV = srv
+		return nil
+	}
+	type plain RawRule
+	return unmarshal((*plain)(r))
+}
+
+type RawNetwork struct {
+	CIDR          StringList         `yaml:"cidr"`
+	Rules         map[string]RawRule `yaml:"rules"`
+	RegexRules    map[string]RawRule `yaml:"regexRules,omitempty"`
+	Default       *RawRule           `yaml:"default,omitempty"`
+	Authoritative bool               `yaml:"authoritative,omitempty"`
+	Upstream      []RawUpstream      `yaml:"upstream,omitempty"`
+	RequireTSIG   bool               `yaml:"requireTsig,omitempty"`
+	AllowUpdate   bool               `yaml:"allowUpdate,omitempty"`
+	SOA           *RawSOA            `yaml:"soa,omitempty"`
+	NS            []string           `yaml:"ns,omitempty"`
+}
+
+type RawConfig struct {
+	Include          StringList               `yaml:"include,omitempty"`
+	WatchConfig      bool                     `yaml:"watchConfig,omitempty"`
+	Networks         []RawNetwork             `yaml:"networks"`
+	DefaultTTL       uint32                   `yaml:"defaultTtl,omitempty"`
+	DefaultAdapter   string                   `yaml:"adapter,omitempty"`
+	AdapterFamily    string                   `yaml:"adapterFamily,omitempty"`
+	BindAddress      string                   `yaml:"bindAddress,omitempty"`
+	Port             int                      `yaml:"port,omitempty"`
+	User             string                   `yaml:"user,omitempty"`
+	Group            string                   `yaml:"group,omitempty"`
+	Proto            string                   `yaml:"protocol,omitempty"`
+	Listen           []RawListen              `yaml:"listen,omitempty"`
+	TCPMaxConns      int                      `yaml:"tcpMaxConnections,omitempty"`
+	TCPIdleTimeout   time.Duration            `yaml:"tcpIdleTimeout,omitempty"`
+	MaxConcurrent    int                      `yaml:"maxConcurrentQueries,omitempty"`
+	QueueSize        *int                     `yaml:"queueSize,omitempty"`
+	MatchBy          string                   `yaml:"matchBy,omitempty"`
+	ECS              bool                     `yaml:"ecs,omitempty"`
+	Upstream         []RawUpstream            `yaml:"upstream,omitempty"`
+	CacheMaxEntries  int                      `yaml:"cacheMaxEntries,omitempty"`
+	NegativeTTL      *uint32                  `yaml:"negativeTtl,omitempty"`
+	Recursion        *bool                    `yaml:"recursion,omitempty"`
+	ServeStale       bool                     `yaml:"serveStale,omitempty"`
+	StaleWindow      time.Duration            `yaml:"staleWindow,omitempty"`
+	Prefetch         float64                  `yaml:"prefetchThreshold,omitempty"`
+	ResolverMode     string                   `yaml:"resolverMode,omitempty"`
+	RootServers      []string                 `yaml:"rootServers,omitempty"`
+	UpstreamStrategy string                   `yaml:"upstreamStrategy,omitempty"`
+	ForwardZones     map[string][]RawUpstream `yaml:"forwardZones,omitempty"`
+	UpstreamTimeout  time.Duration            `yaml:"upstreamTimeout,omitempty"`
+	UpstreamRetries  int                      `yaml:"upstreamRetries,omitempty"`
+	Compress         bool                     `yaml:"compress,omitempty"`
+	Debug            bool                     `yaml:"debug,omitempty"`
+	Version          string                   `yaml:"version,omitempty"`
+	HideVersion      bool                     `yaml:"hideVersion,omitempty"`
+	RoundRobin       bool                     `yaml:"roundRobin,omitempty"`
+	MetricsAddr      string                   `yaml:"metricsAddr,omitempty"`
+	LogFormat        string                   `yaml:"logFormat,omitempty"`
+	LogFile          RawLogFile               `yaml:"logFile,omitempty"`
+	LogTarget        string                   `yaml:"logTarget,omitempty"`
+	Syslog           RawSyslog                `yaml:"syslog,omitempty"`
+	Blocklist        RawBlocklist             `yaml:"blocklist,omitempty"`
+	BlockMode        string                   `yaml:"blockMode,omitempty"`
+	BlockPrivate     bool                     `yaml:"blockPrivateUpstream,omitempty"`
+	AnyMode          string                   `yaml:"anyMode,omitempty"`
+	EDNSUDPSize      uint16                   `yaml:"ednsUdpSize,omitempty"`
+	PrivateAllow     []string                 `yaml:"privateUpstreamAllow,omitempty"`
+	RateLimit        RawRateLimit             `yaml:"rateLimit,omitempty"`
+	Admin            RawAdmin                 `yaml:"admin,omitempty"`
+	DoH              RawDoH                   `yaml:"doh,omitempty"`
+	DoT              RawDoT                   `yaml:"dot,omitempty"`
+	TSIGKeys         []RawTSIGKey             `yaml:"tsigKeys,omitempty"`
+	Hosts            RawHosts                 `yaml:"hosts,omitempty"`
+	Zones            RawZones                 `yaml:"zones,omitempty"`
+	Etcd             RawEtcd                  `yaml:"etcd,omitempty"`
+	Tracing          RawTracing               `yaml:"tracing,omitempty"`
+	Backend          string                   `yaml:"backend,omitempty"`
+	DSN              string                   `yaml:"dsn,omitempty"`
+	Timezone         string                   `yaml:"timezone,omitempty"`
+	AllowedNets      []string                 `yaml:"allowedNetworks,omitempty"`
+}
+
+const (
+	defaultTTL         = 3600
+	defaultNegativeTTL = 300
+	defaultStaleWindow = time.Hour
+	// defaultEDNSUDPSize avoids IP fragmentation, as recommended by DNS
+	// Flag Day 2020.
+	defaultEDNSUDPSize = 1232
+)
+
+type MXRecord struct {
+	Preference uint16
+	Host       string
+}
+
+type Rule struct {
+	IPs      []string
+	Schedule *Schedule
+	// Weights runs parallel to IPs and is nil unless a weight was given.
+	Weights []int
+	CNAME   string
+	TXT     []string
+	MX      []MXRecord
+	HTTPS   []dns.SVCB
+	SVCB    []dns.SVCB
+	SRV     []dns.SRV
+	TTL     uint32
+	// records holds the answers of the rule by type, built once at load
+	// so that a query only copies them and sets the owner name.
+	records map[uint16][]dns.RR
+	// balancers pick the one address of the answer, per record type, when
+	// the rule has weights.
+	balancers map[uint16]*smoothWeighted
+}
+
+// answer returns copies of the records of qtype owned by name.
+func (rule Rule) answer(name string, qtype uint16) []dns.RR {
+	templates := rule.records[qtype]
+	answers := make([]dns.RR, len(templates))
+	for i, template := range templates {
+		answers[i] = dns.Copy(template)
+		answers[i].Header().Name = name
+	}
+	if balancer, ok := rule.balancers[qtype]; ok {
+		answers = []dns.RR{answers[balancer.next()]}
+	}
+	return answers
+}
+
+// compile builds the records of the rule. An address that does not parse
+// fails here, when the rule is loaded, rather than on the first query.
+func (rule *Rule) compile() error {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Rrtype: rrtype, Class: dns.ClassINET, Ttl: rule.TTL}
+	}
+	rule.records = map[uint16][]dns.RR{}
+	add := func(rr dns.RR) {
+		rrtype := rr.Header().Rrtype
+		rule.records[rrtype] = append(rule.records[rrtype], rr)
+	}
+	weights := map[uint16][]int{}
+	for i, value := range rule.IPs {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP address %q", value)
+		}
+		rr := addressRecord("", ip, rule.TTL)
+		add(rr)
+		if rule.Weights != nil {
+			weight := rule.Weights[i]
+			if weight == 0 {
+				weight = 1
+			}
+			weights[rr.Header().Rrtype] = append(weights[rr.Header().Rrtype], weight)
+		}
+	}
+	if len(weights) > 0 {
+		rule.balancers = map[uint16]*smoothWeighted{}
+		for rrtype, w := range weights {
+			rule.balancers[rrtype] = newSmoothWeighted(w)
+		}
+	}
+	for _, txt := range rule.TXT {
+		add(&dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{txt}})
+	}
+	for _, mx := range rule.MX {
+		add(&dns.MX{Hdr: hdr(dns.TypeMX), Preference: mx.Preference, Mx: mx.Host})
+	}
+	for _, srv := range rule.SRV {
+		record := srv
+		record.Hdr = hdr(dns.TypeSRV)
+		add(&record)
+	}
+	for _, binding := range rule.HTTPS {
+		https := &dns.HTTPS{SVCB: binding}
+		https.Hdr = hdr(dns.TypeHTTPS)
+		add(https)
+	}
+	for _, binding := range rule.SVCB {
+		svcb := binding
+		svcb.Hdr = hdr(dns.TypeSVCB)
+		add(&svcb)
+	}
+	return nil
+}
+
+func parseMX(value string) (MXRecord, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return MXRecord{}, fmt.Errorf("MX record %q must be \"<priority> <host>\"", value)
+	}
+	preference, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return MXRecord{}, fmt.Errorf("Invalid MX priority in %q: %v", value, err)
+	}
+	if _, ok := dns.IsDomainName(fields[1]); !ok {
+		return MXRecord{}, fmt.Errorf("Invalid MX host in %q", value)
+	}
+	return MXRecord{Preference: uint16(preference), Host: dns.Fqdn(fields[1])}, nil
+}
+
+// parseSVCB reads an SVCB or HTTPS record in presentation format without
+// the owner name, e.g. "1 . alpn=h3,h2 ipv4hint=192.0.2.1".
+func parseSVCB(value string) (dns.SVCB, error) {
+	rr, err := dns.NewRR(". IN SVCB " + value)
+	if err != nil {
+		return dns.SVCB{}, fmt.Errorf("Invalid service binding %q: %v", value, err)
+	}
+	if rr == nil {
+		return dns.SVCB{}, fmt.Errorf("Empty service binding")
+	}
+	return *rr.(*dns.SVCB), nil
+}
+
+type Network struct {
+	Name          string
+	Ranger        cidranger.Ranger
+	Rules         map[string]Rule
+	RegexRules    []RegexRule
+	Default       *Rule
+	Authoritative bool
+	Reverse       map[string][]reverseEntry
+	Forwarder     *Forwarder
+	RequireTSIG   bool
+	AllowUpdate   bool
+	Zone          *Zone
+	source        RuleSource
+	sourceID      int64
+	fromEtcd      bool
+}
+
+type reverseEntry struct {
+	Name string
+	TTL  uint32
+}
+
+// index rebuilds the PTR index from the address rules. Wildcard rules have
+// no single name to point back to and are left out.
+func (network *Network) index() {
+	network.Reverse = map[string][]reverseEntry{}
+	names := make([]string, 0, len(network.Rules))
+	for name := range network.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+		rule := network.Rules[name]
+		for _, value := range rule.IPs {
+			ptr, err := dns.ReverseAddr(value)
+			if err != nil {
+				continue
+			}
+			network.Reverse[ptr] = append(network.Reverse[ptr], reverseEntry{Name: name, TTL: rule.TTL})
+		}
+	}
+}
+
+// candidates returns the rule for name followed by the "*." wildcard rules
+// above it, closest first. A wildcard never matches the name it is anchored
+// at. Schedules decide later which of them applies.
+func (network Network) candidates(name string) []Rule {
+	if network.source != nil {
+		if rule, ok := network.lookupSource(name); ok {
+			return []Rule{rule}
+		}
+		return nil
+	}
+	rules := []Rule{}
+	if rule, ok := network.Rules[name]; ok {
+		rules = append(rules, rule)
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if rule, ok := network.Rules["*."+dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			rules = append(rules, rule)
+		}
+	}
+	for _, regexRule := range network.RegexRules {
+		if regexRule.Pattern.MatchString(name) {
+			rules = append(rules, regexRule.Rule)
+		}
+	}
+	return rules
+}
+
+type Config struct {
+	Networks        []Network
+	DefaultAdapter  string
+	DefaultTTL      uint32
+	AdapterFamily   string
+	MatchBy         string
+	ECS             bool
+	ServerIP        *net.IP
+	Forwarder       *Forwarder
+	SystemForwarder *Forwarder
+	ForwardZones    map[string]*Forwarder
+	StaleWindow     time.Duration
+	// PrefetchThreshold is the share of its TTL a cache entry has left when
+	// a hit refreshes it in the background; 0 turns prefetching off.
+	PrefetchThreshold float64
+	NegativeTTL       uint32
+	Recursion         bool
+	Location          *time.Location
+	CacheMaxEntries   int
+	RoundRobin        bool
+	Compress          bool
+	Debug             bool
+	Version           string
+	HideVersion       bool
+	Logger            QueryLogger
+	Blocklist         *Blocklist
+	BlocklistSource   RawBlocklist
+	BlockMode         string
+	AnyMode           string
+	// EDNSUDPSize is the UDP payload size advertised in replies to EDNS0
+	// queries, and the most a UDP reply may take.
+	EDNSUDPSize uint16
+	// BlockPrivateUpstream drops private addresses from upstream answers,
+	// except for names under PrivateUpstreamAllow.
+	BlockPrivateUpstream bool
+	PrivateUpstreamAllow map[string]bool
+	RateLimiter          *RateLimiter
+	// QueryPool bounds the queries handled at once; nil means no limit.
+	QueryPool      *queryLimiter
+	Allowed        cidranger.Ranger
+	RuleSource     RuleSource
+	DoTCertificate *tls.Certificate
+	TSIGKeys       map[string]tsigKey
+	// WatchConfig reloads the config file when it changes.
+	WatchConfig bool
+	// Generation counts reloads, and is added to the serial of zones.
+	Generation uint32
+	Nolog      bool
+	// cacheEpoch is the epoch of dnsCache from before the config was read;
+	// answers from a config replaced since are not cached.
+	cacheEpoch uint64
+}
+
+var (
+	configMu sync.RWMutex
+	config   = Config{}
+)
+
+func currentConfig() Config {
+	epoch := dnsCache.currentEpoch()
+	configMu.RLock()
+	c := config
+	configMu.RUnlock()
+	c.cacheEpoch = epoch
+	return c
+}
+
+func setConfig(c Config) {
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+}
+
+func updateConfig(update func(c *Config)) {
+	configMu.Lock()
+	update(&config)
+	configMu.Unlock()
+}
+
+// configChangeMu serializes reloads, admin rule changes, dynamic updates and
+// etcd snapshots. Each builds on what it read before swapping the config in,
+// so without it a reload that read the file before an admin save would drop
+// the saved rule, and two reloads at once could lose a generation or close
+// the rule source in use. Admin changes hold it until the saved file is
+// renamed, so the file and memory see them in the same order.
+var configChangeMu sync.Mutex
+
+// loadMode tells buildConfig what a config is loaded for.
+type loadMode int
+
+const (
+	// loadCheck builds a config for --check, --print-config and --dump-zone,
+	// which must not touch anything outside the config files.
+	loadCheck loadMode = iota
+	// loadServe builds the config the server starts with.
+	loadServe
+	// loadReload builds a config to replace the running one.
+	loadReload
+)
+
+func loadConfig(configPath string, nolog bool, mode loadMode) (Config, RawConfig, error) {
+	rawConfig := RawConfig{}
+	dat, err := readConfigData(configPath)
+	if err != nil {
+		return Config{}, rawConfig, err
+	}
+	if err := yaml.Unmarshal(dat, &rawConfig); err != nil {
+		return Config{}, rawConfig, err
+	}
+	applyFlagOverrides(&rawConfig)
+	if err := rawConfig.validate(); err != nil {
+		return Config{}, rawConfig, err
+	}
+	_config, err := buildConfig(rawConfig, nolog, mode)
+	return _config, rawConfig, err
+}
+
+// saveConfig re-reads the config file, applies update and writes it back
+// through a temporary file so a crash never leaves half a config behind.
+// Comments are lost; fields are written in the order RawConfig declares.
+// Included files are left alone, and JSON, TOML and files with ${VAR}
+// references are not written at all.
+func saveConfig(configPath string, update func(rawConfig *RawConfig)) error {
+	if configFormat(configPath) != "yaml" {
+		return fmt.Errorf("%s is not YAML, which is the only format saving writes", configPath)
+	}
+	rawConfig := RawConfig{}
+	dat, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(dat), "${") {
+		return fmt.Errorf("%s refers to environment variables, which saving would replace with their values", configPath)
+	}
+	if err := yaml.Unmarshal(dat, &rawConfig); err != nil {
+		return err
+	}
+	update(&rawConfig)
+	if err := rawConfig.validate(); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(rawConfig)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(configPath), "."+filepath.Base(configPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// The file may be valid alone and still not load once its includes are
+	// merged over it. The temporary file sits next to the config, so its
+	// include paths resolve the same way.
+	if _, _, err := loadConfig(tmp.Name(), true, loadCheck); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// hasCIDR compares by parsed network so that "10.0.0.1/8" and "10.0.0.0/8"
+// refer to the same entry.
+func (network RawNetwork) hasCIDR(cidr string) bool {
+	_, want, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	for _, c := range network.CIDR {
+		if _, have, err := net.ParseCIDR(c); err == nil && have.String() == want.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (rawConfig *RawConfig) setRule(cidr, name string, rule RawRule) {
+	if _, network, err := net.ParseCIDR(cidr); err == nil {
+		cidr = network.String()
+	}
+	idx := -1
+	for i, network := range rawConfig.Networks {
+		if network.hasCIDR(cidr) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		rawConfig.Networks = append(rawConfig.Networks, RawNetwork{CIDR: StringList{cidr}})
+		idx = len(rawConfig.Networks) - 1
+	}
+	network := &rawConfig.Networks[idx]
+	if network.Rules == nil {
+		network.Rules = map[string]RawRule{}
+	}
+	deleteRawRule(network.Rules, name)
+	network.Rules[name] = rule
+}
+
+func (rawConfig *RawConfig) deleteRule(cidr, name string) {
+	for _, network := range rawConfig.Networks {
+		if cidr != "" && !network.hasCIDR(cidr) {
+			continue
+		}
+		deleteRawRule(network.Rules, name)
+	}
+}
+
+// deleteRawRule removes every spelling of name from rules, with or without
+// the trailing dot and in any case.
+func deleteRawRule(rules map[string]RawRule, name string) {
+	for key := range rules {
+		if strings.EqualFold(dns.Fqdn(key), dns.Fqdn(name)) {
+			delete(rules, key)
+		}
+	}
+}
+
+func buildConfig(rawConfig RawConfig, nolog bool, mode loadMode) (Config, error) {
+	_config := Config{cacheEpoch: dnsCache.currentEpoch(), DefaultAdapter: rawConfig.DefaultAdapter, AdapterFamily: rawConfig.AdapterFamily, MatchBy: rawConfig.MatchBy, ECS: rawConfig.ECS, RoundRobin: rawConfig.RoundRobin, Compress: rawConfig.Compress, Debug: rawConfig.Debug || debugFlag, Version: rawConfig.Version, HideVersion: rawConfig.HideVersion, AnyMode: rawConfig.AnyMode, EDNSUDPSize: rawConfig.EDNSUDPSize, PrefetchThreshold: rawConfig.Prefetch, WatchConfig: rawConfig.WatchConfig, Nolog: nolog}
+	if _config.Version == "" {
+		_config.Version = "dynamic-name-server " + version
+	}
+	if _config.MatchBy == "" {
+		_config.MatchBy = "server"
+	}
+	if _config.AnyMode == "" {
+		_config.AnyMode = "hinfo"
+	}
+	if _config.EDNSUDPSize == 0 {
+		_config.EDNSUDPSize = defaultEDNSUDPSize
+	}
+	if _config.MatchBy == "server" && mode != loadCheck {
+		ip, err := getIPAddress(_config)
+		if err != nil {
+			log.Printf("[WARN] %v; matching on client addresses until one is found\n", err)
+		}
+		_config.ServerIP = ip
+	}
+	logger, err := newQueryLogger(rawConfig.LogFormat)
+	if err != nil {
+		return Config{}, err
+	}
+	_config.Logger = logger
+	ttl := uint32(defaultTTL)
+	if rawConfig.DefaultTTL != 0 {
+		ttl = rawConfig.DefaultTTL
+	}
+	_config.DefaultTTL = ttl
+	for idx, network := range rawConfig.Networks {
+		ranger := cidranger.NewPCTrieRanger()
+		for _, cidrStr := range network.CIDR {
+			_, cidr, err := net.ParseCIDR(cidrStr)
+			if err != nil {
+				return Config{}, fmt.Errorf("Invalid CIDR %q in network %d: %v", cidrStr, idx, err)
+			}
+			ranger.Insert(cidranger.NewBasicRangerEntry(*cidr))
+		}
+		rules := map[string]Rule{}
+		for domain, rawRule := range network.Rules {
+			rule, err := buildRule(rawRule, ttl)
+			if err != nil {
+				return Config{}, fmt.Errorf("Invalid rule for %s in network %d: %v", domain, idx, err)
+			}
+			rules[dns.Fqdn(strings.ToLower(domain))] = rule
+		}
+		regexRules, err := buildRegexRules(network.RegexRules, ttl)
+		if err != nil {
+			return Config{}, fmt.Errorf("Invalid regexRules in network %d: %v", idx, err)
+		}
+		var defaultRule *Rule
+		if network.Default != nil {
+			rule, err := buildRule(*network.Default, ttl)
+			if err != nil {
+				return Config{}, fmt.Errorf("Invalid default rule in network %d: %v", idx, err)
+			}
+			defaultRule = &rule
+		}
+		forwarder, err := newForwarder(network.Upstream, rawConfig.UpstreamStrategy, rawConfig.UpstreamTimeout, rawConfig.UpstreamRetries)
+		if err != nil {
+			return Config{}, fmt.Errorf("Invalid upstream in network %d: %v", idx, err)
+		}
+		_config.Networks = append(_config.Networks, Network{Name: strings.Join(network.CIDR, ","), Ranger: ranger, Rules: rules, RegexRules: regexRules, Default: defaultRule, Authoritative: network.Authoritative, Forwarder: forwarder, RequireTSIG: network.RequireTSIG, AllowUpdate: network.AllowUpdate, Zone: buildZone(network.SOA, network.NS, ttl)})
+	}
+	if len(rawConfig.Hosts.Files) > 0 {
+		if err := addHosts(&_config, rawConfig.Hosts); err != nil {
+			return Config{}, fmt.Errorf("Failed to read hosts files: %v", err)
+		}
+	}
+	if len(rawConfig.Zones.Files) > 0 {
+		if err := addZones(&_config, rawConfig.Zones); err != nil {
+			return Config{}, fmt.Errorf("Failed to read zone files: %v", err)
+		}
+	}
+	_config.DoTCertificate, err = loadDoTCertificate(rawConfig.DoT)
+	if err != nil {
+		return Config{}, err
+	}
+	_config.TSIGKeys, err = buildTSIGKeys(rawConfig.TSIGKeys)
+	if err != nil {
+		return Config{}, err
+	}
+	for i := range _config.Networks {
+		_config.Networks[i].index()
+	}
+	if !rawConfig.Blocklist.empty() {
+		// Only the first load waits for remote lists; a reload takes the
+		// copies already downloaded so that it never blocks on the network.
+		blocklist, _, err := buildBlocklist(rawConfig.Blocklist, mode == loadServe)
+		if err != nil {
+			return Config{}, err
+		}
+		_config.Blocklist = blocklist
+		_config.BlocklistSource = rawConfig.Blocklist
+		_config.BlockMode = rawConfig.BlockMode
+	}
+	if rawConfig.BlockPrivate {
+		_config.BlockPrivateUpstream = true
+		_config.PrivateUpstreamAllow = map[string]bool{}
+		for _, zone := range rawConfig.PrivateAllow {
+			_config.PrivateUpstreamAllow[dns.Fqdn(strings.ToLower(zone))] = true
+		}
+	}
+	if len(rawConfig.AllowedNets) > 0 {
+		_config.Allowed = cidranger.NewPCTrieRanger()
+		for _, cidrStr := range rawConfig.AllowedNets {
+			_, cidr, err := net.ParseCIDR(cidrStr)
+			if err != nil {
+				return Config{}, fmt.Errorf("Invalid CIDR %q in allowedNetworks: %v", cidrStr, err)
+			}
+			_config.Allowed.Insert(cidranger.NewBasicRangerEntry(*cidr))
+		}
+	}
+	if rawConfig.RateLimit.QPS > 0 {
+		// On reload, clients keep their buckets unless the limits changed.
+		if previous := currentConfig().RateLimiter; mode == loadReload && previous != nil && previous.raw == rawConfig.RateLimit {
+			_config.RateLimiter = previous
+		} else {
+			_config.RateLimiter = NewRateLimiter(rawConfig.RateLimit)
+		}
+	}
+	// Likewise the pool, whose slots queries in flight still hold.
+	if previous := currentConfig().QueryPool; mode == loadReload && previous.sameSize(rawConfig.MaxConcurrent, rawConfig.queueSize()) {
+		_config.QueryPool = previous
+	} else {
+		_config.QueryPool = newQueryLimiter(rawConfig.MaxConcurrent, rawConfig.queueSize())
+	}
+	_config.CacheMaxEntries = rawConfig.CacheMaxEntries
+	_config.Recursion = rawConfig.Recursion == nil || *rawConfig.Recursion
+	_config.Location = time.Local
+	if rawConfig.Timezone != "" {
+		loc, err := time.LoadLocation(rawConfig.Timezone)
+		if err != nil {
+			return Config{}, fmt.Errorf("Invalid timezone %q: %v", rawConfig.Timezone, err)
+		}
+		_config.Location = loc
+	}
+	_config.NegativeTTL = defaultNegativeTTL
+	if rawConfig.NegativeTTL != nil {
+		_config.NegativeTTL = *rawConfig.NegativeTTL
+	}
+	if rawConfig.ServeStale {
+		_config.StaleWindow = defaultStaleWindow
+		if rawConfig.StaleWindow != 0 {
+			_config.StaleWindow = rawConfig.StaleWindow
+		}
+	}
+	forwarder, err := newForwarder(rawConfig.Upstream, rawConfig.UpstreamStrategy, rawConfig.UpstreamTimeout, rawConfig.UpstreamRetries)
+	if err != nil {
+		return Config{}, err
+	}
+	if rawConfig.ResolverMode == "recursive" {
+		resolver := newRecursiveResolver(rawConfig.RootServers, rawConfig.UpstreamTimeout)
+		forwarder = &Forwarder{Upstreams: []Upstream{resolver}, Strategy: "failover", Retries: rawConfig.UpstreamRetries}
+	}
+	_config.Forwarder = forwarder
+	for zone, raws := range rawConfig.ForwardZones {
+		zoneForwarder, err := newForwarder(raws, rawConfig.UpstreamStrategy, rawConfig.UpstreamTimeout, rawConfig.UpstreamRetries)
+		if err != nil {
+			return Config{}, fmt.Errorf("Invalid forward zone %s: %v", zone, err)
+		}
+		if zoneForwarder == nil {
+			continue
+		}
+		if _config.ForwardZones == nil {
+			_config.ForwardZones = map[string]*Forwarder{}
+		}
+		_config.ForwardZones[dns.Fqdn(strings.ToLower(zone))] = zoneForwarder
+	}
+	if forwarder == nil {
+		_config.SystemForwarder = systemForwarder(rawConfig.UpstreamTimeout, rawConfig.UpstreamRetries)
+	}
+	// The backend is opened last so that no later error leaks it, and never
+	// for a check, since opening it may create the database and migrate it.
+	if rawConfig.Backend != "" && mode != loadCheck {
+		source, err := openRuleSource(rawConfig.Backend, rawConfig.DSN)
+		if err != nil {
+			return Config{}, err
+		}
+		networks, err := source.Networks(ttl)
+		if err != nil {
+			source.Close()
+			return Config{}, fmt.Errorf("Failed to read networks from %s backend: %v", rawConfig.Backend, err)
+		}
+		_config.Networks = append(_config.Networks, networks...)
+		_config.RuleSource = source
+	}
+	return _config, nil
+}
+
+func buildRule(rawRule RawRule, ttl uint32) (Rule, error) {
+	schedule, err := parseSchedule(rawRule.Schedule)
+	if err != nil {
+		return Rule{}, err
+	}
+	rule := Rule{CNAME: rawRule.CNAME, TXT: rawRule.TXT, TTL: rawRule.TTL, Schedule: schedule}
+	for _, address := range rawRule.IP {
+		ip := net.ParseIP(address.IP)
+		if ip == nil {
+			return Rule{}, fmt.Errorf("Invalid IP address %q", address.IP)
+		}
+		rule.IPs = append(rule.IPs, ip.String())
+		if address.Weight != 0 && rule.Weights == nil {
+			rule.Weights = make([]int, len(rawRule.IP))
+		}
+	}
+	if rule.Weights != nil {
+		for i, address := range rawRule.IP {
+			rule.Weights[i] = address.Weight
+		}
+	}
+	if rule.CNAME != "" {
+		if _, ok := dns.IsDomainName(rule.CNAME); !ok || looksLikeIP(rule.CNAME) {
+			return Rule{}, fmt.Errorf("Invalid hostname %q", rule.CNAME)
+		}
+		rule.CNAME = dns.Fqdn(strings.ToLower(rule.CNAME))
+	}
+	for _, value := range rawRule.MX {
+		mx, err := parseMX(value)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.MX = append(rule.MX, mx)
+	}
+	for _, srv := range rawRule.SRV {
+		rule.SRV = append(rule.SRV, dns.SRV{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: dns.Fqdn(srv.Target)})
+	}
+	for _, value := range rawRule.HTTPS {
+		svcb, err := parseSVCB(value)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.HTTPS = append(rule.HTTPS, svcb)
+	}
+	for _, value := range rawRule.SVCB {
+		svcb, err := parseSVCB(value)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.SVCB = append(rule.SVCB, svcb)
+	}
+	if rule.TTL == 0 {
+		rule.TTL = ttl
+	}
+	if err := rule.compile(); err != nil {
+		return Rule{}, err
+	}
+	return rule, nil
+}
+
+func (c Config) allows(clientIP net.IP) bool {
+	if c.Allowed == nil {
+		return true
+	}
+	if clientIP == nil {
+		return false
+	}
+	allowed, err := c.Allowed.Contains(clientIP)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return allowed
+}
+
+// ruleSourceCloseDelay is how long a replaced rule source stays open, well
+// beyond the time any query takes.
+const ruleSourceCloseDelay = 30 * time.Second
+
+func reloadConfig(configPath string, nolog bool) error {
+	configChangeMu.Lock()
+	defer configChangeMu.Unlock()
+	_config, _, err := loadConfig(configPath, nolog, loadReload)
+	if err != nil {
+		return err
+	}
+	if etcdSource != nil {
+		etcdSource.apply(&_config)
+	}
+	previous := currentConfig()
+	_config.Generation = previous.Generation + 1
+	setConfig(_config)
+	if previous.RuleSource != nil {
+		// Queries that started before the swap may still look rules up in
+		// the old source.
+		time.AfterFunc(ruleSourceCloseDelay, func() {
+			previous.RuleSource.Close()
+		})
+	}
+	dnsCache.invalidate()
+	dnsCache.setMaxEntries(_config.CacheMaxEntries)
+	return nil
+}
+
+func reloadOnSignal(configPath string, nolog bool) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := reloadConfig(configPath, nolog); err != nil {
+			log.Printf("Failed to reload %s, keeping previous config: %v\n", configPath, err)
+			continue
+		}
+		log.Printf("Reloaded config from %s\n", configPath)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestFile writes text to name in a temporary directory of the test
+// and returns its path.
+func writeTestFile(t testing.TB, name, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadTestConfig loads text the way --check does.
+func loadTestConfig(t testing.TB, text string) Config {
+	t.Helper()
+	c, _, err := loadConfig(writeTestFile(t, "config.yml", text), true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// useConfig makes c the running config for the rest of the test.
+func useConfig(t testing.TB, c Config) {
+	t.Helper()
+	previous := currentConfig()
+	setConfig(c)
+	dnsCache.flush()
+	t.Cleanup(func() {
+		setConfig(previous)
+		dnsCache.flush()
+	})
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	const rules = `networks:
+- cidr: 127.0.0.0/8
+  rules:
+    nas.home: %s
+matchBy: client
+port: %d
+`
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(rules, "192.168.1.5", port))
+	server := startMain(t, "--config", path)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	if got := answerValues(exchangeUntilAnswered(t, "udp", addr, "nas.home.")); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Fatalf("answered %v before the reload", got)
+	}
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(rules, "192.168.1.6", port)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := answerValues(exchangeUntilAnswered(t, "udp", addr, "nas.home."))
+		if len(got) == 1 && got[0] == "192.168.1.6" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("answered %v after the reload, want 192.168.1.6", got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMalformedRuleFailsAtLoad(t *testing.T) {
+	tests := map[string]string{
+		"address": `ip: 10.0.0.300`,
+		"mx":      `mx: ["ten mail.home."]`,
+		"https":   `https: ["1 . ipv4hint=fd00::1"]`,
+	}
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestFile(t, "config.yml", `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home:
+      `+rule+`
+matchBy: client
+`)
+			if _, _, err := loadConfig(path, true, loadCheck); err == nil {
+				t.Error("malformed rule loaded")
+			}
+		})
+	}
+}
+
+func TestRuleRecordsPrepared(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+`)
+	rule := c.Networks[0].Rules["nas.home."]
+	if len(rule.records[dns.TypeA]) != 1 {
+		t.Fatalf("records of nas.home. = %v, want one A record", rule.records)
+	}
+	// Each answer is a copy that a query may change.
+	answer := rule.answer("NAS.home.", dns.TypeA)
+	answer[0].Header().Ttl = 1
+	if template := rule.records[dns.TypeA][0]; template.Header().Ttl == 1 || template.Header().Name != "" {
+		t.Errorf("answering changed the prepared record to %s", template)
+	}
+}
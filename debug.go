@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// debugFlag turns on debug output regardless of the config file, so that it
+// survives reloads.
+var debugFlag bool
+
+// tracef notes a step of the resolution for the debug dump.
+func (state *queryState) tracef(format string, args ...interface{}) {
+	if state.config.Debug {
+		state.entry.Trace = append(state.entry.Trace, fmt.Sprintf(format, args...))
+	}
+}
+
+// traceNetworks records which networks contain the address that rules are
+// matched on, and which do not.
+func (state *queryState) traceNetworks() {
+	if !state.config.Debug {
+		return
+	}
+	matched := map[string]bool{}
+	for i, network := range matchNetworks(state.config, state.ip) {
+		matched[network.Name] = true
+		state.tracef("network %s contains %s (rank %d)", network.Name, state.ipStr, i+1)
+	}
+	for _, network := range state.config.Networks {
+		if !matched[network.Name] {
+			state.tracef("network %s does not contain %s", network.Name, state.ipStr)
+		}
+	}
+}
+
+func logDebug(r, m *dns.Msg, entry QueryLog) {
+	lines := []string{fmt.Sprintf("[DEBUG] query %d from %s", r.Id, entry.Client)}
+	for _, q := range r.Question {
+		lines = append(lines, fmt.Sprintf("  question: %s %s %s", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype]))
+	}
+	for _, step := range entry.Trace {
+		lines = append(lines, "  "+step)
+	}
+	lines = append(lines, "  rcode: "+dns.RcodeToString[m.Rcode])
+	for _, rr := range m.Answer {
+		lines = append(lines, "  answer: "+rr.String())
+	}
+	log.Println(strings.Join(lines, "\n"))
+}
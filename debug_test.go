@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// captureLog collects what the standard logger prints for the rest of the
+// test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestDebugTrace(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+- cidr: 172.16.0.0/12
+  rules:
+    nas.home: 172.16.1.5
+matchBy: client
+recursion: false
+debug: true
+`))
+	logged := captureLog(t)
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	handle(t, "10.1.2.3", r)
+
+	for _, want := range []string{
+		"[DEBUG] query ",
+		"question: nas.home. IN A",
+		"matching on client address 10.1.2.3",
+		"network 10.0.0.0/8 contains 10.1.2.3 (rank 1)",
+		"network 172.16.0.0/12 does not contain 10.1.2.3",
+		"cache miss for nas.home. A",
+		"rule for nas.home. found in network 10.0.0.0/8",
+		"rcode: NOERROR",
+		"answer: nas.home.\t",
+	} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("trace lacks %q:\n%s", want, logged)
+		}
+	}
+
+	logged.Reset()
+	handle(t, "10.1.2.3", r)
+	if !strings.Contains(logged.String(), "cache hit for nas.home. A") {
+		t.Errorf("second query not traced as a cache hit:\n%s", logged)
+	}
+}
+
+func TestDebugOff(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+`))
+	logged := captureLog(t)
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	handle(t, "10.1.2.3", r)
+	if strings.Contains(logged.String(), "[DEBUG]") {
+		t.Errorf("debug output without debug: true:\n%s", logged)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// RawDoH configures the DNS-over-HTTPS listener (RFC 8484). Without a
+// certificate it serves plain HTTP, for use behind a TLS-terminating proxy.
+type RawDoH struct {
+	Addr     string `yaml:"addr,omitempty"`
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+}
+
+const dohContentType = "application/dns-message"
+
+// newDoHServer loads the certificate up front, while the key file is still
+// readable before privileges are dropped.
+func newDoHServer(raw RawDoH) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", handleDoH)
+	server := &http.Server{Addr: raw.Addr, Handler: mux}
+	if raw.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(raw.CertFile, raw.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load DoH certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return server, nil
+}
+
+func serveDoH(server *http.Server, listener net.Listener) {
+	log.Printf("DoH listening at %s\n", server.Addr)
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("DoH listener failed: %v\n", err)
+	}
+}
+
+func handleDoH(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err != nil || len(packed) == 0 || req.Unpack(packed) != nil {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "Invalid client address", http.StatusBadRequest)
+		return
+	}
+	rw := &dohResponseWriter{remote: remote}
+	if tsig := req.IsTsig(); tsig != nil {
+		rw.tsigStatus = dns.TsigVerifyWithProvider(packed, tsigProvider{}, "", false)
+		rw.requestMAC = tsig.MAC
+	}
+	handleDNSRequest(rw, req)
+	if rw.reply == nil {
+		// The rate limiter dropped the query.
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(rw.maxAge)))
+	w.Write(rw.reply)
+}
+
+// dohResponseWriter hands the reply of handleDNSRequest back to the HTTP
+// handler. The client address is a TCP one, so replies are never truncated.
+type dohResponseWriter struct {
+	remote     net.Addr
+	reply      []byte
+	maxAge     uint32
+	tsigStatus error
+	requestMAC string
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return nil }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg packs m right away, as the handler reuses it once it returns.
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	var packed []byte
+	var err error
+	if m.IsTsig() != nil {
+		packed, _, err = dns.TsigGenerateWithProvider(m, tsigProvider{}, w.requestMAC, false)
+	} else {
+		packed, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+	w.reply = packed
+	for i, rr := range m.Answer {
+		if i == 0 || rr.Header().Ttl < w.maxAge {
+			w.maxAge = rr.Header().Ttl
+		}
+	}
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.reply = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
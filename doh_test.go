@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const dohTestConfig = `
+networks:
+- cidr: 192.0.2.0/24
+  rules:
+    nas.home:
+      ip: 192.168.1.5
+      ttl: 300
+matchBy: client
+recursion: false
+`
+
+// dohQuery packs a query for name; httptest requests come from 192.0.2.1.
+func dohQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	packed, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func dohReply(t *testing.T, rec *httptest.ResponseRecorder) *dns.Msg {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HTTP %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != dohContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, dohContentType)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDoHPost(t *testing.T) {
+	useConfig(t, loadTestConfig(t, dohTestConfig))
+	handler := mustDoHServer(t).Handler
+
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(dohQuery(t, "nas.home.")))
+	req.Header.Set("Content-Type", dohContentType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	m := dohReply(t, rec)
+	if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("answer = %v, want 192.168.1.5", got)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("Cache-Control = %q, want max-age=300", cc)
+	}
+}
+
+func TestDoHGet(t *testing.T) {
+	useConfig(t, loadTestConfig(t, dohTestConfig))
+	rec := httptest.NewRecorder()
+	query := base64.RawURLEncoding.EncodeToString(dohQuery(t, "nas.home."))
+	mustDoHServer(t).Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+query, nil))
+	if got := answerValues(dohReply(t, rec)); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("answer = %v, want 192.168.1.5", got)
+	}
+}
+
+func TestDoHRejects(t *testing.T) {
+	useConfig(t, loadTestConfig(t, dohTestConfig))
+	handler := mustDoHServer(t).Handler
+	tests := []struct {
+		name, method, contentType string
+		body                      []byte
+		want                      int
+	}{
+		{"wrong content type", http.MethodPost, "application/json", dohQuery(t, "nas.home."), http.StatusUnsupportedMediaType},
+		{"not a DNS message", http.MethodPost, dohContentType, []byte("hello"), http.StatusBadRequest},
+		{"empty body", http.MethodPost, dohContentType, nil, http.StatusBadRequest},
+		{"other method", http.MethodPut, dohContentType, dohQuery(t, "nas.home."), http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/dns-query", bytes.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: HTTP %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// RawDoT configures the DNS-over-TLS listener (RFC 7858). The certificate
+// is read again on every reload; a change of addr needs a restart.
+type RawDoT struct {
+	Addr     string `yaml:"addr,omitempty"`
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+}
+
+const defaultDoTAddr = ":853"
+
+func loadDoTCertificate(raw RawDoT) (*tls.Certificate, error) {
+	if raw.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(raw.CertFile, raw.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load dot certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// newDoTServer serves the certificate of the current config, so that a
+// reload swaps it for new connections.
+func newDoTServer(raw RawDoT) *dns.Server {
+	addr := raw.Addr
+	if addr == "" {
+		addr = defaultDoTAddr
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return currentConfig().DoTCertificate, nil
+		},
+	}
+	return &dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: tlsConfig}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to a
+// temporary directory and returns their paths and the parsed certificate.
+func writeSelfSignedCert(t *testing.T, serial int64) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "dns.home"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func dotTestConfig(certFile, keyFile string) string {
+	return `
+networks:
+- cidr: 127.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+recursion: false
+dot:
+  certFile: ` + certFile + `
+  keyFile: ` + keyFile + `
+`
+}
+
+func TestDoT(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, 1)
+	useConfig(t, loadTestConfig(t, dotTestConfig(certFile, keyFile)))
+
+	server := newDoTServer(RawDoT{Addr: "127.0.0.1:0"})
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ActivateAndServe does not add TLS to a listener it is given.
+	server.Listener = tls.NewListener(l, server.TLSConfig)
+	server.Handler = dns.HandlerFunc(handleDNSRequest)
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	query := func(trusted *x509.Certificate) (*dns.Msg, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(trusted)
+		client := &dns.Client{Net: "tcp-tls", Timeout: 2 * time.Second, TLSConfig: &tls.Config{RootCAs: roots}}
+		r := new(dns.Msg)
+		r.SetQuestion("nas.home.", dns.TypeA)
+		m, _, err := client.Exchange(r, l.Addr().String())
+		return m, err
+	}
+	m, err := query(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("answer over TLS = %v", got)
+	}
+
+	// New connections get the certificate of a reloaded config.
+	certFile, keyFile, renewed := writeSelfSignedCert(t, 2)
+	setConfig(loadTestConfig(t, dotTestConfig(certFile, keyFile)))
+	if _, err := query(cert); err == nil {
+		t.Error("old certificate still served after the reload")
+	}
+	if _, err := query(renewed); err != nil {
+		t.Errorf("renewed certificate: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in a config file with the
+// value of the environment variable, or default when it is unset or empty.
+// $$ stands for a literal $, and a $ followed by anything else is kept.
+// Comments, from a # outside quotes to the end of the line, are left as they
+// are, so that they may mention ${VAR} without it having to be set.
+func expandEnv(data string, lookup func(string) (string, bool)) (string, error) {
+	var out strings.Builder
+	var quote byte
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '\n':
+			quote = 0
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || data[i-1] == ' ' || data[i-1] == '\t' || data[i-1] == '\n'):
+			end := strings.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			out.WriteString(data[i : i+end])
+			i += end - 1
+			continue
+		}
+		if data[i] != '$' || i+1 == len(data) {
+			out.WriteByte(data[i])
+			continue
+		}
+		switch data[i+1] {
+		case '$':
+			out.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			out.WriteByte('$')
+			continue
+		}
+		end := strings.IndexByte(data[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated ${ at offset %d", i)
+		}
+		ref := data[i+2 : i+end]
+		name, fallback, hasDefault := strings.Cut(ref, ":-")
+		if !validEnvName(name) {
+			return "", fmt.Errorf("Invalid environment variable reference ${%s}", ref)
+		}
+		value, ok := lookup(name)
+		switch {
+		case ok && value != "":
+			out.WriteString(value)
+		case hasDefault:
+			out.WriteString(fallback)
+		case ok:
+		default:
+			return "", fmt.Errorf("Environment variable %s is not set and has no default", name)
+		}
+		i += end
+	}
+	return out.String(), nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
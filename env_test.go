@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"HOST": "10.0.0.5", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "ip: ${HOST}", want: "ip: 10.0.0.5"},
+		{in: "ip: ${HOST:-10.0.0.1}", want: "ip: 10.0.0.5"},
+		{in: "ip: ${UNSET:-10.0.0.1}", want: "ip: 10.0.0.1"},
+		{in: "ip: ${EMPTY:-10.0.0.1}", want: "ip: 10.0.0.1"},
+		{in: "ip: ${EMPTY}", want: "ip: "},
+		{in: "price: $$5 and $5", want: "price: $5 and $5"},
+		{in: "a: 1 # uses ${UNSET}\nb: ${HOST}", want: "a: 1 # uses ${UNSET}\nb: 10.0.0.5"},
+		{in: `txt: "#${HOST}"`, want: `txt: "#10.0.0.5"`},
+		{in: "ip: ${UNSET}", wantErr: true},
+		{in: "ip: ${HOST", wantErr: true},
+		{in: "ip: ${1HOST}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.in, lookup)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandEnv(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	t.Setenv("DNS_TEST_NAS", "192.168.1.5")
+	c := loadTestConfig(t, `
+networks:
+- cidr: ${DNS_TEST_CIDR:-10.0.0.0/8}
+  rules:
+    nas.home: ${DNS_TEST_NAS}
+matchBy: client
+`)
+	if rule := c.Networks[0].Rules["nas.home."]; c.Networks[0].Name != "10.0.0.0/8" || len(rule.IPs) != 1 || rule.IPs[0] != "192.168.1.5" {
+		t.Errorf("network %s, nas.home. = %+v", c.Networks[0].Name, rule)
+	}
+	path := writeTestFile(t, "config.yml", "networks: []\nmetricsAddr: ${DNS_TEST_UNSET}\n")
+	if _, _, err := loadConfig(path, true, loadCheck); err == nil {
+		t.Error("config with an undefined variable loaded")
+	}
+}
+
+// TestTemplateLoads keeps the sample config in sync with the loader. The
+// hosts file and timezone it names may be missing on the test host.
+func TestTemplateLoads(t *testing.T) {
+	for _, path := range []string{"/etc/hosts", "/usr/share/zoneinfo/Europe/Berlin"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Skipf("template needs %s: %v", path, err)
+		}
+	}
+	captureLog(t)
+	if _, _, err := loadConfig("config.yml.template", true, loadCheck); err != nil {
+		t.Fatal(err)
+	}
+}
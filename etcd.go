@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultEtcdPrefix      = "/dynamic-name-server/rules/"
+	defaultEtcdDialTimeout = 5 * time.Second
+	etcdRetryInterval      = 5 * time.Second
+)
+
+type RawEtcd struct {
+	Endpoints   []string      `yaml:"endpoints,omitempty"`
+	Prefix      string        `yaml:"prefix,omitempty"`
+	Username    string        `yaml:"username,omitempty"`
+	Password    string        `yaml:"password,omitempty"`
+	DialTimeout time.Duration `yaml:"dialTimeout,omitempty"`
+}
+
+// etcdRules mirrors the keys under prefix. A key is <prefix><cidr>/<name>,
+// e.g. /dynamic-name-server/rules/10.0.0.0/8/host.example., and its value
+// is a rule in the same YAML forms the config file accepts.
+type etcdRules struct {
+	client etcdClient
+	prefix string
+
+	mu    sync.Mutex
+	rules map[string]map[string]RawRule
+}
+
+var etcdSource *etcdRules
+
+// etcdClient is the part of clientv3.Client that etcdRules uses.
+type etcdClient interface {
+	clientv3.KV
+	clientv3.Watcher
+}
+
+func newEtcdRules(raw RawEtcd) (*etcdRules, error) {
+	dialTimeout := raw.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultEtcdDialTimeout
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   raw.Endpoints,
+		Username:    raw.Username,
+		Password:    raw.Password,
+		DialTimeout: dialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := raw.Prefix
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &etcdRules{client: client, prefix: prefix, rules: map[string]map[string]RawRule{}}, nil
+}
+
+func (e *etcdRules) parseKey(key string) (cidr, name string, ok bool) {
+	rest := strings.TrimPrefix(key, e.prefix)
+	idx := strings.LastIndex(rest, "/")
+	if idx < 0 {
+		return "", "", false
+	}
+	cidr, name = rest[:idx], rest[idx+1:]
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return "", "", false
+	}
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", "", false
+	}
+	return cidr, dns.Fqdn(strings.ToLower(name)), true
+}
+
+func (e *etcdRules) put(key string, value []byte) {
+	cidr, name, ok := e.parseKey(key)
+	if !ok {
+		log.Printf("[WARN] Ignoring etcd key %s\n", key)
+		return
+	}
+	rule := RawRule{}
+	if err := yaml.Unmarshal(value, &rule); err != nil {
+		log.Printf("[WARN] Ignoring etcd key %s: %v\n", key, err)
+		return
+	}
+	if problems := validateRule(rule); len(problems) > 0 {
+		log.Printf("[WARN] Ignoring etcd key %s: rule %s\n", key, strings.Join(problems, ", "))
+		return
+	}
+	if e.rules[cidr] == nil {
+		e.rules[cidr] = map[string]RawRule{}
+	}
+	e.rules[cidr][name] = rule
+}
+
+func (e *etcdRules) delete(key string) {
+	cidr, name, ok := e.parseKey(key)
+	if !ok {
+		return
+	}
+	delete(e.rules[cidr], name)
+	if len(e.rules[cidr]) == 0 {
+		delete(e.rules, cidr)
+	}
+}
+
+// networks builds one network per CIDR found in etcd, in a stable order.
+func (e *etcdRules) networks(ttl uint32) []Network {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cidrs := make([]string, 0, len(e.rules))
+	for cidr := range e.rules {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	networks := []Network{}
+	for _, cidrStr := range cidrs {
+		_, cidr, _ := net.ParseCIDR(cidrStr)
+		ranger := cidranger.NewPCTrieRanger()
+		ranger.Insert(cidranger.NewBasicRangerEntry(*cidr))
+		rules := map[string]Rule{}
+		for name, raw := range e.rules[cidrStr] {
+			rule, err := buildRule(raw, ttl)
+			if err != nil {
+				continue
+			}
+			rules[name] = rule
+		}
+		network := Network{Name: cidrStr, Ranger: ranger, Rules: rules, fromEtcd: true}
+		network.index()
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// apply replaces the etcd networks of c with the current snapshot. Networks
+// from the config file keep their place in front.
+func (e *etcdRules) apply(c *Config) {
+	networks := []Network{}
+	for _, network := range c.Networks {
+		if !network.fromEtcd {
+			networks = append(networks, network)
+		}
+	}
+	c.Networks = append(networks, e.networks(c.DefaultTTL)...)
+}
+
+func (e *etcdRules) publish() {
+	configChangeMu.Lock()
+	defer configChangeMu.Unlock()
+	updateConfig(e.apply)
+	dnsCache.invalidate()
+}
+
+// load replaces the mirror with a snapshot of the prefix and returns the
+// revision to watch from.
+func (e *etcdRules) load(ctx context.Context) (int64, error) {
+	resp, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	e.mu.Lock()
+	e.rules = map[string]map[string]RawRule{}
+	for _, kv := range resp.Kvs {
+		e.put(string(kv.Key), kv.Value)
+	}
+	e.mu.Unlock()
+	e.publish()
+	return resp.Header.Revision, nil
+}
+
+// watch keeps the served rules in sync with etcd. Whenever the watch breaks,
+// for example after a compaction or a lost connection, it starts over with
+// a fresh snapshot.
+func (e *etcdRules) watch(ctx context.Context) {
+	for {
+		revision, err := e.load(ctx)
+		if err != nil {
+			log.Printf("[WARN] Failed to read rules from etcd: %v\n", err)
+		} else {
+			e.follow(ctx, revision)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(etcdRetryInterval):
+		}
+	}
+}
+
+func (e *etcdRules) follow(ctx context.Context, revision int64) {
+	watchCtx := clientv3.WithRequireLeader(ctx)
+	for resp := range e.client.Watch(watchCtx, e.prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1)) {
+		if err := resp.Err(); err != nil {
+			log.Printf("[WARN] etcd watch failed: %v\n", err)
+			return
+		}
+		e.mu.Lock()
+		for _, ev := range resp.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				e.put(string(ev.Kv.Key), ev.Kv.Value)
+			case clientv3.EventTypeDelete:
+				e.delete(string(ev.Kv.Key))
+			}
+		}
+		e.mu.Unlock()
+		e.publish()
+	}
+}
+
+func (e *etcdRules) Close() error {
+	return e.client.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcd serves a fixed snapshot and hands out the events sent to it as
+// one watch.
+type fakeEtcd struct {
+	clientv3.KV
+	clientv3.Watcher
+	snapshot []*mvccpb.KeyValue
+	events   chan clientv3.WatchResponse
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: 1}, Kvs: f.snapshot}, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return f.events
+}
+
+func (f *fakeEtcd) Close() error {
+	return nil
+}
+
+func (f *fakeEtcd) send(eventType mvccpb.Event_EventType, key, value string) {
+	f.events <- clientv3.WatchResponse{Events: []*clientv3.Event{{Type: eventType, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value)}}}}
+}
+
+// waitForAnswer asks until the answer matches want or a second has passed.
+func waitForAnswer(t *testing.T, client, name string, qtype uint16, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := answerValues(ask(t, currentConfig(), client, name, qtype))
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, want %v", name, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEtcdPutUpdatesAnswer(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  authoritative: true
+  rules:
+    file.test: 10.1.1.1
+matchBy: client
+`))
+	fake := &fakeEtcd{
+		snapshot: []*mvccpb.KeyValue{{Key: []byte(defaultEtcdPrefix + "10.0.0.0/8/live.test"), Value: []byte("10.2.2.2")}},
+		events:   make(chan clientv3.WatchResponse),
+	}
+	rules := &etcdRules{client: fake, prefix: defaultEtcdPrefix, rules: map[string]map[string]RawRule{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rules.watch(ctx)
+
+	waitForAnswer(t, "10.0.0.1", "live.test", dns.TypeA, []string{"10.2.2.2"})
+	fake.send(mvccpb.PUT, defaultEtcdPrefix+"10.0.0.0/8/live.test", "10.3.3.3")
+	waitForAnswer(t, "10.0.0.1", "live.test", dns.TypeA, []string{"10.3.3.3"})
+	fake.send(mvccpb.PUT, defaultEtcdPrefix+"10.0.0.0/8/new.test", "{ip: [10.4.4.4, 10.4.4.5]}")
+	waitForAnswer(t, "10.0.0.1", "new.test", dns.TypeA, []string{"10.4.4.4", "10.4.4.5"})
+	fake.send(mvccpb.DELETE, defaultEtcdPrefix+"10.0.0.0/8/live.test", "")
+	waitForAnswer(t, "10.0.0.1", "live.test", dns.TypeA, []string{})
+	waitForAnswer(t, "10.0.0.1", "file.test", dns.TypeA, []string{"10.1.1.1"})
+}
+
+func TestEtcdIgnoresBadKeys(t *testing.T) {
+	rules := &etcdRules{prefix: defaultEtcdPrefix, rules: map[string]map[string]RawRule{}}
+	rules.put(defaultEtcdPrefix+"not-a-cidr/host.test", []byte("10.1.1.1"))
+	rules.put(defaultEtcdPrefix+"10.0.0.0/8/host.test", []byte("10.0.0.300"))
+	rules.put(defaultEtcdPrefix+"10.0.0.0/8/ok.test", []byte("10.1.1.1"))
+	if got := len(rules.rules["10.0.0.0/8"]); got != 1 {
+		t.Errorf("mirror holds %d rules, want only ok.test", got)
+	}
+}
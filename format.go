@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// configFormat names the format of a config file by its extension. Files
+// with another or no extension are YAML.
+func configFormat(configPath string) string {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	}
+	return "yaml"
+}
+
+// decodeConfigTree decodes a config file into the generic form yaml.v2
+// produces, so JSON and TOML files go through the same yaml field names and
+// short forms as YAML ones once the tree is marshalled back.
+func decodeConfigTree(configPath string, dat []byte) (map[interface{}]interface{}, error) {
+	tree := map[interface{}]interface{}{}
+	switch configFormat(configPath) {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(dat))
+		decoder.UseNumber()
+		var doc map[string]interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		tree, _ = genericTree(doc).(map[interface{}]interface{})
+	case "toml":
+		var doc map[string]interface{}
+		if err := toml.Unmarshal(dat, &doc); err != nil {
+			return nil, err
+		}
+		tree, _ = genericTree(doc).(map[interface{}]interface{})
+	default:
+		if err := yaml.Unmarshal(dat, &tree); err != nil {
+			return nil, err
+		}
+	}
+	if tree == nil {
+		tree = map[interface{}]interface{}{}
+	}
+	return tree, nil
+}
+
+// genericTree converts decoded JSON and TOML values to the map and slice
+// types of yaml.v2. JSON numbers become integers where they are ones, as
+// yaml.v2 would write large floats in a form integer fields reject.
+func genericTree(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		tree := make(map[interface{}]interface{}, len(v))
+		for key, item := range v {
+			tree[key] = genericTree(item)
+		}
+		return tree
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = genericTree(item)
+		}
+		return items
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = genericTree(item)
+		}
+		return items
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
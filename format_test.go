@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yml": `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+    mail.home:
+      mx: ["10 mx.home."]
+      ttl: 120
+defaultTtl: 300
+matchBy: client
+upstream:
+- 8.8.8.8:53
+- addr: tls://1.1.1.1:853
+  serverName: cloudflare-dns.com
+staleWindow: 1h
+prefetchThreshold: 0.1
+recursion: false
+`,
+		"config.json": `{
+  "networks": [
+    {"cidr": "10.0.0.0/8", "rules": {
+      "nas.home": "192.168.1.5",
+      "mail.home": {"mx": ["10 mx.home."], "ttl": 120}
+    }}
+  ],
+  "defaultTtl": 300,
+  "matchBy": "client",
+  "upstream": ["8.8.8.8:53", {"addr": "tls://1.1.1.1:853", "serverName": "cloudflare-dns.com"}],
+  "staleWindow": "1h",
+  "prefetchThreshold": 0.1,
+  "recursion": false
+}`,
+		"config.toml": `
+defaultTtl = 300
+matchBy = "client"
+upstream = ["8.8.8.8:53", {addr = "tls://1.1.1.1:853", serverName = "cloudflare-dns.com"}]
+staleWindow = "1h"
+prefetchThreshold = 0.1
+recursion = false
+
+[[networks]]
+cidr = "10.0.0.0/8"
+
+[networks.rules]
+"nas.home" = "192.168.1.5"
+"mail.home" = {mx = ["10 mx.home."], ttl = 120}
+`,
+	}
+	_, want, err := loadConfig(writeTestFile(t, "config.yml", files["config.yml"]), true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range files {
+		t.Run(name, func(t *testing.T) {
+			c, rawConfig, err := loadConfig(writeTestFile(t, name, text), true, loadCheck)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rawConfig, want) {
+				t.Errorf("config = %+v, want %+v", rawConfig, want)
+			}
+			m := ask(t, c, "10.0.0.1", "nas.home", dns.TypeA)
+			if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+				t.Errorf("answer = %v, want 192.168.1.5", got)
+			}
+		})
+	}
+}
+
+func TestConfigFormatErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"config.json": `{"networks": [`,
+		"config.toml": `networks = [`,
+	} {
+		if _, _, err := loadConfig(writeTestFile(t, name, text), true, loadCheck); err == nil {
+			t.Errorf("%s: loaded a malformed file", name)
+		}
+	}
+}
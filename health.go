@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// serving is 1 while the DNS listeners are accepting queries. A failed
+// reload leaves it alone since the previous config keeps being served.
+var serving int32
+
+func setServing(ok bool) {
+	var v int32
+	if ok {
+		v = 1
+	}
+	atomic.StoreInt32(&serving, v)
+}
+
+// handleHealthz answers as long as the process is running.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers 200 only once the config is loaded and the DNS
+// listeners are up, and 503 before that and while shutting down.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&serving) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func healthStatus(t *testing.T, path string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMetricsServer("").Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestReadyz(t *testing.T) {
+	defer setServing(false)
+	setServing(false)
+	if code := healthStatus(t, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz before serving returned HTTP %d", code)
+	}
+	if code := healthStatus(t, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before serving returned HTTP %d, want 503", code)
+	}
+
+	setServing(true)
+	if code := healthStatus(t, "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz while serving returned HTTP %d, want 200", code)
+	}
+
+	// The previous config keeps being served after a failed reload.
+	useConfig(t, currentConfig())
+	if err := reloadConfig(writeTestFile(t, "config.yml", "networks: [\n"), true); err == nil {
+		t.Fatal("broken config reloaded")
+	}
+	if code := healthStatus(t, "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz after a failed reload returned HTTP %d, want 200", code)
+	}
+}
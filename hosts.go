@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+)
+
+type RawHosts struct {
+	Files   StringList `yaml:"files,omitempty"`
+	Network string     `yaml:"network,omitempty"`
+}
+
+// parseHosts reads hosts(5) lines into name -> addresses, keeping the order
+// in which the addresses appear.
+func parseHosts(r io.Reader) (map[string][]string, error) {
+	hosts := map[string][]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			name = dns.Fqdn(strings.ToLower(name))
+			hosts[name] = append(hosts[name], ip.String())
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+func readHostsFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseHosts(f)
+}
+
+// addHosts merges the hosts files into the network configured with
+// raw.Network, or into a catch-all network when none is given.
+func addHosts(c *Config, raw RawHosts) error {
+	rawRules := map[string]RawRule{}
+	for _, path := range raw.Files {
+		hosts, err := readHostsFile(path)
+		if err != nil {
+			return err
+		}
+		for name, ips := range hosts {
+			rawRule := rawRules[name]
+			rawRule.IP = append(rawRule.IP, addresses(ips...)...)
+			rawRules[name] = rawRule
+		}
+	}
+	rules := make(map[string]Rule, len(rawRules))
+	for name, rawRule := range rawRules {
+		rule, err := buildRule(rawRule, c.DefaultTTL)
+		if err != nil {
+			return err
+		}
+		rules[name] = rule
+	}
+	return mergeRules(c, "hosts", raw.Network, rules)
+}
+
+// mergeRules adds rules to the network configured with cidr, or to a
+// catch-all network called name after all others when cidr is empty. Names
+// that already have a rule there keep it.
+func mergeRules(c *Config, name, cidr string, rules map[string]Rule) error {
+	if cidr == "" {
+		ranger := cidranger.NewPCTrieRanger()
+		for _, cidrStr := range []string{"0.0.0.0/0", "::/0"} {
+			_, all, _ := net.ParseCIDR(cidrStr)
+			ranger.Insert(cidranger.NewBasicRangerEntry(*all))
+		}
+		c.Networks = append(c.Networks, Network{Name: name, Ranger: ranger, Rules: rules})
+		return nil
+	}
+	for i, network := range c.Networks {
+		if !network.hasCIDR(cidr) {
+			continue
+		}
+		if network.Rules == nil {
+			c.Networks[i].Rules = map[string]Rule{}
+		}
+		for domain, rule := range rules {
+			if _, ok := network.Rules[domain]; !ok {
+				c.Networks[i].Rules[domain] = rule
+			}
+		}
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ranger := cidranger.NewPCTrieRanger()
+	ranger.Insert(cidranger.NewBasicRangerEntry(*ipNet))
+	c.Networks = append(c.Networks, Network{Name: cidr, Ranger: ranger, Rules: rules})
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testHostsFile = `# comment
+127.0.0.1   localhost
+10.0.0.5    nas.home nas   # trailing comment
+10.0.0.6    printer.home
+fd00::5     nas.home
+not-an-ip   broken.home
+`
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := parseHosts(strings.NewReader(testHostsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"localhost.":    {"127.0.0.1"},
+		"nas.home.":     {"10.0.0.5", "fd00::5"},
+		"nas.":          {"10.0.0.5"},
+		"printer.home.": {"10.0.0.6"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("parseHosts = %v, want %v", hosts, want)
+	}
+}
+
+func TestHostsResolve(t *testing.T) {
+	path := writeTestFile(t, "hosts", testHostsFile)
+	c := loadTestConfig(t, "matchBy: client\nhosts:\n  files: ["+path+"]\n")
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"nas.home", dns.TypeA, []string{"10.0.0.5"}},
+		{"NAS.home", dns.TypeAAAA, []string{"fd00::5"}},
+		{"printer.home", dns.TypeA, []string{"10.0.0.6"}},
+	}
+	for _, tt := range tests {
+		if got := answerValues(ask(t, c, "192.168.1.10", tt.name, tt.qtype)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s = %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
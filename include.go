@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// readConfigData reads the config file and the files its include list
+// names, in order, each merged over the ones before: maps are merged key by
+// key, networks with the same cidr are merged and other networks appended,
+// and any other value is replaced. Include paths are relative to the
+// including file and may be globs. Each file is read as YAML, JSON or TOML
+// according to its extension.
+func readConfigData(configPath string) ([]byte, error) {
+	merged, err := readConfigTree(configPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(merged)
+}
+
+func readConfigTree(configPath string, stack []string) (map[interface{}]interface{}, error) {
+	abs, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, seen := range stack {
+		if seen == abs {
+			return nil, fmt.Errorf("Include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+		}
+	}
+	stack = append(stack, abs)
+	dat, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := expandEnv(string(dat), os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
+	tree, err := decodeConfigTree(configPath, []byte(expanded))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
+	var includes StringList
+	if raw, ok := tree["include"]; ok {
+		out, _ := yaml.Marshal(raw)
+		if err := yaml.Unmarshal(out, &includes); err != nil {
+			return nil, fmt.Errorf("%s: invalid include: %v", configPath, err)
+		}
+	}
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configPath), pattern)
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %v", configPath, pattern, err)
+		}
+		if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: included file %s does not exist", configPath, pattern)
+		}
+		for _, path := range paths {
+			included, err := readConfigTree(path, stack)
+			if err != nil {
+				return nil, err
+			}
+			delete(included, "include")
+			mergeConfigTree(tree, included)
+		}
+	}
+	return tree, nil
+}
+
+func mergeConfigTree(dst, src map[interface{}]interface{}) {
+	for key, value := range src {
+		if key == "networks" {
+			existing, _ := dst[key].([]interface{})
+			added, _ := value.([]interface{})
+			dst[key] = mergeNetworks(existing, added)
+			continue
+		}
+		from, srcIsMap := value.(map[interface{}]interface{})
+		to, dstIsMap := dst[key].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeConfigTree(to, from)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// mergeNetworks merges each added network over the existing one with the
+// same cidr, so that a later file can override its rules and settings, and
+// appends the others.
+func mergeNetworks(existing, added []interface{}) []interface{} {
+	for _, network := range added {
+		merged := false
+		if key := networkKey(network); key != "" {
+			for _, candidate := range existing {
+				if networkKey(candidate) == key {
+					mergeConfigTree(candidate.(map[interface{}]interface{}), network.(map[interface{}]interface{}))
+					merged = true
+					break
+				}
+			}
+		}
+		if !merged {
+			existing = append(existing, network)
+		}
+	}
+	return existing
+}
+
+// networkKey returns the cidr list of a network entry, or "" when it has
+// none.
+func networkKey(network interface{}) string {
+	entry, ok := network.(map[interface{}]interface{})
+	if !ok || entry["cidr"] == nil {
+		return ""
+	}
+	out, _ := yaml.Marshal(entry["cidr"])
+	var cidrs StringList
+	if err := yaml.Unmarshal(out, &cidrs); err != nil {
+		return ""
+	}
+	return strings.Join(cidrs, ",")
+}
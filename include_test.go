@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("networks.d/10-office.yml", `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    printer.home: 10.0.0.20
+    nas.home: 10.0.0.5
+defaultTtl: 120
+`)
+	write("networks.d/20-lab.yml", `
+networks:
+- cidr: 172.16.0.0/12
+  rules:
+    nas.home: 172.16.0.5
+`)
+	path := write("config.yml", `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+    router.home: 192.168.1.1
+matchBy: client
+recursion: false
+defaultTtl: 300
+include: networks.d/*.yml
+`)
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Networks) != 2 {
+		t.Fatalf("got %d networks, want the office network merged and the lab one added", len(c.Networks))
+	}
+	if c.DefaultTTL != 120 {
+		t.Errorf("defaultTtl = %d, want the included 120", c.DefaultTTL)
+	}
+	tests := []struct {
+		client, name, want string
+	}{
+		// Rules of the same cidr are merged, the included file winning.
+		{"10.0.0.1", "nas.home.", "10.0.0.5"},
+		{"10.0.0.1", "router.home.", "192.168.1.1"},
+		{"10.0.0.1", "printer.home.", "10.0.0.20"},
+		{"172.16.0.1", "nas.home.", "172.16.0.5"},
+	}
+	dnsCache.flush()
+	for _, tt := range tests {
+		if got := answerValues(ask(t, c, tt.client, tt.name, dns.TypeA)); !reflect.DeepEqual(got, []string{tt.want}) {
+			t.Errorf("%s from %s = %v, want %s", tt.name, tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	a := writeTestFile(t, "a.yml", "include: b.yml\nnetworks: []\n")
+	if err := os.WriteFile(filepath.Join(filepath.Dir(a), "b.yml"), []byte("include: a.yml\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadConfig(a, true, loadCheck); err == nil || !strings.Contains(err.Error(), "Include cycle") {
+		t.Errorf("cyclic include: got %v", err)
+	}
+	missing := writeTestFile(t, "config.yml", "include: missing.yml\nnetworks: []\n")
+	if _, _, err := loadConfig(missing, true, loadCheck); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("missing include: got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// sampleConfig is what --init-config writes: enough to answer a few names
+// for one network and forward everything else. config.yml.template lists
+// every setting.
+const sampleConfig = `# Sample dynamic-name-server config. Run with --check to validate changes,
+# and send SIGHUP to reload a running server.
+
+# Port and protocol (udp, tcp or both) to listen on
+port: 53
+protocol: both
+
+# The network is picked by the address of this adapter (matchBy: server), or
+# by the address of the client (matchBy: client). Run with --adapters to list
+# the adapter names of this machine
+matchBy: server
+adapter: Wi-Fi
+adapterFamily: ipv4
+
+# Names without a rule are forwarded to these servers
+upstream:
+- 1.1.1.1
+- 8.8.8.8
+
+# TTL of rule answers, in seconds
+defaultTtl: 3600
+
+networks:
+# While the adapter has an address in 192.168.1.0/24, answer these names
+# from the rules and forward the rest
+- cidr: 192.168.1.0/24
+  rules:
+    # A name to an address
+    nas.home.: 192.168.1.10
+    # A name to another name
+    files.home.: nas.home.
+    # Several addresses and a TTL of their own
+    printer.home.:
+      ip:
+      - 192.168.1.20
+      - 192.168.1.21
+      ttl: 300
+`
+
+// writeSampleConfig writes sampleConfig to configPath, creating its
+// directory. An existing file is only replaced with force.
+func writeSampleConfig(configPath string, force bool) error {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(configPath, flags, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", configPath)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sampleConfig); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// initConfigFlag is --init-config, whose path is optional: "--init-config",
+// "--init-config=<path>" and "--init-config <path>" all work, the first
+// writing to the --config path.
+type initConfigFlag struct {
+	set  bool
+	path string
+}
+
+func (f *initConfigFlag) String() string {
+	return f.path
+}
+
+func (f *initConfigFlag) Set(value string) error {
+	switch value {
+	case "true":
+		f.set = true
+	case "false":
+		f.set = false
+	default:
+		f.set, f.path = true, value
+	}
+	return nil
+}
+
+// IsBoolFlag lets the flag stand alone, as a bool flag would.
+func (f *initConfigFlag) IsBoolFlag() bool {
+	return true
+}
+
+// target returns where to write the sample config: the path given with the
+// flag, the one positional argument after it, or configPath.
+func (f *initConfigFlag) target(configPath string, args []string) (string, error) {
+	switch {
+	case f.path != "":
+		return f.path, nil
+	case len(args) == 1:
+		return args[0], nil
+	case len(args) > 1:
+		return "", fmt.Errorf("--init-config takes one path, got %q; other flags go before it", args)
+	}
+	return configPath, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampleConfigLoads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "etc", "dns", "config.yml")
+	if err := writeSampleConfig(path, false); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatalf("sample config does not load: %v", err)
+	}
+	if len(c.Networks) != 1 || len(c.Networks[0].Rules) != 3 {
+		t.Errorf("sample config has %d networks, want one with three rules", len(c.Networks))
+	}
+
+	if err := writeSampleConfig(path, false); err == nil {
+		t.Error("replaced an existing file without force")
+	}
+	if err := os.WriteFile(path, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSampleConfig(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if dat, _ := os.ReadFile(path); string(dat) != sampleConfig {
+		t.Error("force did not overwrite the file")
+	}
+}
+
+func TestInitConfigFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "alone", args: []string{"--init-config"}, want: "config.yml"},
+		{name: "with equals", args: []string{"--init-config=/etc/dns.yml"}, want: "/etc/dns.yml"},
+		{name: "path after", args: []string{"--init-config", "/etc/dns.yml"}, want: "/etc/dns.yml"},
+		{name: "two paths", args: []string{"--init-config", "a.yml", "b.yml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			var initConfig initConfigFlag
+			fs.Var(&initConfig, "init-config", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if !initConfig.set {
+				t.Fatal("flag not set")
+			}
+			path, err := initConfig.target("config.yml", fs.Args())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != tt.want {
+				t.Errorf("target = %s, want %s", path, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitConfigCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if _, err := runMain(t, "--init-config", path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadConfig(path, true, loadCheck); err != nil {
+		t.Fatalf("written config does not load: %v", err)
+	}
+	if _, err := runMain(t, "--init-config", path); err == nil {
+		t.Error("second run replaced the file without --force")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// RawLogFile sends the log to a file that is rotated once it grows past
+// maxSize megabytes. Rotated files are removed after maxAge days or beyond
+// maxBackups of them, whichever comes first; zero keeps them all.
+type RawLogFile struct {
+	Path       string `yaml:"path,omitempty"`
+	MaxSize    int    `yaml:"maxSize,omitempty"`
+	MaxAge     int    `yaml:"maxAge,omitempty"`
+	MaxBackups int    `yaml:"maxBackups,omitempty"`
+	Compress   bool   `yaml:"compress,omitempty"`
+	Stdout     bool   `yaml:"stdout,omitempty"`
+}
+
+// UnmarshalYAML also accepts a bare path.
+func (l *RawLogFile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		l.Path = short
+		return nil
+	}
+	type plain RawLogFile
+	return unmarshal((*plain)(l))
+}
+
+// openLogFile redirects the standard logger. The file is opened once at
+// startup; changes to logFile take effect on restart.
+func openLogFile(raw RawLogFile) io.Closer {
+	if raw.Path == "" {
+		return nil
+	}
+	file := &lumberjack.Logger{
+		Filename:   raw.Path,
+		MaxSize:    raw.MaxSize,
+		MaxAge:     raw.MaxAge,
+		MaxBackups: raw.MaxBackups,
+		Compress:   raw.Compress,
+		LocalTime:  true,
+	}
+	if raw.Stdout {
+		log.SetOutput(io.MultiWriter(file, os.Stdout))
+	} else {
+		log.SetOutput(file)
+	}
+	return file
+}
+
+// checkLogRotation warns when the log directory is not writable by the
+// account privileges were dropped to: the open log file keeps working, but
+// rotating it needs to create a new one next to it.
+func checkLogRotation(raw RawLogFile) {
+	if raw.Path == "" {
+		return
+	}
+	if err := writableDir(filepath.Dir(raw.Path)); err != nil {
+		log.Printf("[WARN] Log file %s will not rotate: %v\n", raw.Path, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "dns.log")
+	output := log.Writer()
+	file := openLogFile(RawLogFile{Path: path, MaxSize: 1})
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		file.Close()
+	})
+
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+    quiet.home: 192.168.1.6
+matchBy: client
+`)
+	c.Nolog = false
+	useConfig(t, c)
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	handle(t, "10.0.0.1", r)
+
+	// --quiet drops the query lines, not warnings.
+	c.Nolog = true
+	setConfig(c)
+	r.SetQuestion("quiet.home.", dns.TypeA)
+	handle(t, "10.0.0.1", r)
+	log.Printf("[WARN] still logged\n")
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"[10.0.0.1] nas.home.", "[WARN] still logged"} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("log file lacks %q:\n%s", want, contents)
+		}
+	}
+	if strings.Contains(string(contents), "quiet.home.") {
+		t.Errorf("query logged with --quiet:\n%s", contents)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type QueryLog struct {
+	Client  string
+	MatchIP string
+	Name    string
+	Qtype   string
+	Network string
+	Source  string
+	Rcode   string
+	Answers []dns.RR
+	Latency time.Duration
+	Trace   []string
+	// TSIGKey names the key the query was signed with.
+	TSIGKey string
+}
+
+type QueryLogger interface {
+	LogQuery(entry QueryLog)
+}
+
+type textLogger struct{}
+
+// LogQuery prints one line per answer, prefixed with the client address and
+// the address rules were matched on when the two differ.
+func (textLogger) LogQuery(entry QueryLog) {
+	who := entry.Client
+	if entry.MatchIP != "" && entry.MatchIP != entry.Client {
+		who = fmt.Sprintf("%s matched as %s", entry.Client, entry.MatchIP)
+	}
+	for _, rr := range entry.Answers {
+		log.Printf("[%s] %s\n", who, rr.String())
+	}
+}
+
+type jsonLogger struct{}
+
+type jsonQueryLog struct {
+	Time      string   `json:"time"`
+	Client    string   `json:"client"`
+	MatchIP   string   `json:"matchIp,omitempty"`
+	Name      string   `json:"name"`
+	Qtype     string   `json:"qtype"`
+	Network   string   `json:"network,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Rcode     string   `json:"rcode"`
+	TSIGKey   string   `json:"tsigKey,omitempty"`
+	Answer    []string `json:"answer"`
+	LatencyMs float64  `json:"latencyMs"`
+}
+
+func (jsonLogger) LogQuery(entry QueryLog) {
+	record := jsonQueryLog{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Client:    entry.Client,
+		MatchIP:   entry.MatchIP,
+		Name:      entry.Name,
+		Qtype:     entry.Qtype,
+		Network:   entry.Network,
+		Source:    entry.Source,
+		Rcode:     entry.Rcode,
+		TSIGKey:   entry.TSIGKey,
+		Answer:    []string{},
+		LatencyMs: float64(entry.Latency) / float64(time.Millisecond),
+	}
+	for _, rr := range entry.Answers {
+		record.Answer = append(record.Answer, rr.String())
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	log.Writer().Write(append(line, '\n'))
+}
+
+func newQueryLogger(format string) (QueryLogger, error) {
+	switch format {
+	case "", "text":
+		return textLogger{}, nil
+	case "json":
+		return jsonLogger{}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q", format)
+}
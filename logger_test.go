@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestJSONQueryLog(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+logFormat: json
+`)
+	c.Nolog = false
+	useConfig(t, c)
+	logged := captureLog(t)
+	query(t, "10.20.30.40", "nas.home.", dns.TypeA)
+	query(t, "10.20.30.40", "nas.home.", dns.TypeA)
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", len(lines), logged)
+	}
+	for _, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		for _, key := range []string{"time", "client", "name", "qtype", "rcode", "answer", "latencyMs"} {
+			if _, ok := record[key]; !ok {
+				t.Errorf("log line %q has no %q", line, key)
+			}
+		}
+	}
+
+	var record jsonQueryLog
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Client != "10.20.30.40" || record.Name != "nas.home." || record.Qtype != "A" || record.Rcode != "NOERROR" || record.Network != "10.0.0.0/8" {
+		t.Errorf("logged %+v", record)
+	}
+	if len(record.Answer) != 1 || !strings.HasSuffix(record.Answer[0], "192.168.1.5") {
+		t.Errorf("logged answer %v, want 192.168.1.5", record.Answer)
+	}
+}
+
+func TestQueryLogHasClient(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+logFormat: `+format+`
+`)
+			c.Nolog = false
+			useConfig(t, c)
+			logged := captureLog(t)
+			r := new(dns.Msg)
+			r.SetQuestion("nas.home.", dns.TypeA)
+			handle(t, "10.20.30.40", r)
+
+			line := strings.TrimSpace(logged.String())
+			switch format {
+			case "text":
+				if !strings.HasPrefix(line, "[10.20.30.40] nas.home.") {
+					t.Errorf("log line %q does not start with the client", line)
+				}
+			case "json":
+				var record jsonQueryLog
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("log line %q: %v", line, err)
+				}
+				if record.Client != "10.20.30.40" {
+					t.Errorf("client = %q, want 10.20.30.40", record.Client)
+				}
+			}
+		})
+	}
+}
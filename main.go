@@ -1,48 +1,50 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
-	"strings"
-
-	"github.com/yl2chen/cidranger"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
+)
 
-	"gopkg.in/yaml.v2"
+const (
+	shutdownGracePeriod     = 5 * time.Second
+	serverIPRefreshInterval = 30 * time.Second
 )
 
-type RawConfig struct {
-	Networks []struct {
-		CIDR  string            `yaml:"cidr"`
-		Rules map[string]string `yaml:"rules"`
-	} `yaml:"networks"`
-	DefaultAdapter string `yaml:"adapter,omitempty"`
-	Port           int    `yaml:"port,omitempty"`
-	Proto          string `yaml:"protocol,omitempty"`
-}
+var dnsCache = NewCache()
 
-type Network struct {
-	Ranger cidranger.Ranger
-	Rules  map[string]string
-}
+// replyPool recycles reply messages and the backing arrays of their
+// sections between queries.
+var replyPool = sync.Pool{New: func() interface{} { return new(dns.Msg) }}
 
-type Config struct {
-	Networks       []Network
-	DefaultAdapter string
-	Nolog          bool
+func getReply() *dns.Msg {
+	return replyPool.Get().(*dns.Msg)
 }
 
-type Cache map[string](map[string]dns.RR)
+// putReply returns m to the pool once it has been written and logged.
+func putReply(m *dns.Msg) {
+	answer, ns, extra := clearRRs(m.Answer), clearRRs(m.Ns), clearRRs(m.Extra)
+	*m = dns.Msg{Answer: answer, Ns: ns, Extra: extra}
+	replyPool.Put(m)
+}
 
-var dnsCache = Cache{}
-var config = Config{}
+func clearRRs(rrs []dns.RR) []dns.RR {
+	for i := range rrs {
+		rrs[i] = nil
+	}
+	return rrs[:0]
+}
 
 func panicIfErr(e error) {
 	if e != nil {
@@ -56,194 +58,415 @@ func logIfErr(e error) {
 	}
 }
 
-func printAdapters() error {
-	ifaces, err := net.Interfaces()
+func getClientIP(addr net.Addr) (*net.IP, error) {
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		return &v.IP, nil
+	case *net.TCPAddr:
+		return &v.IP, nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, i := range ifaces {
-		addrs, err := i.Addrs()
-		if err != nil {
-			return err
-		}
-		for _, addr := range addrs {
-			switch v := addr.(type) {
-			case *net.IPNet:
-				if v.IP.To4() != nil {
-					fmt.Printf("%s: %s\n", i.Name, addr.String())
-					continue
-				}
-			case *net.IPAddr:
-				if v.IP.To4() != nil {
-					fmt.Printf("%s: %s\n", i.Name, addr.String())
-					continue
-				}
-			}
-		}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Cannot parse client address %s", addr.String())
 	}
-	return nil
+	return &ip, nil
 }
 
-func getIPAddress(config Config) (*net.IP, error) {
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return nil, err
+func getMatchIP(config Config, remoteAddr net.Addr) (*net.IP, error) {
+	// Without a usable adapter address, for example while the interface
+	// is down, match on the client until refreshServerIP finds one.
+	if config.MatchBy == "client" || config.ServerIP == nil {
+		return getClientIP(remoteAddr)
 	}
-	for _, i := range ifaces {
-		if config.DefaultAdapter != "" && config.DefaultAdapter != i.Name {
+	return config.ServerIP, nil
+}
+
+// refreshServerIP re-reads the interface address so that a laptop moving
+// between networks keeps matching the right rules.
+func refreshServerIP(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		looked := currentConfig()
+		if looked.MatchBy != "server" {
 			continue
 		}
-
-		addrs, err := i.Addrs()
+		// The interfaces are walked outside the lock so that queries are
+		// not held up behind it.
+		ip, err := getIPAddress(looked)
 		if err != nil {
-			return nil, err
-		}
-		for _, addr := range addrs {
-			switch v := addr.(type) {
-			case *net.IPNet:
-				if v.IP.To4() != nil {
-					return &v.IP, nil
-				}
-			case *net.IPAddr:
-				if v.IP.To4() != nil {
-					return &v.IP, nil
-				}
-			}
+			log.Printf("[WARN] %v\n", err)
+			continue
 		}
-	}
-	return nil, errors.New("Should not reach here")
-}
-
-func parseQuery(m *dns.Msg, config Config) {
-	ip, err := getIPAddress(config)
-	panicIfErr(err)
-	ipStr := ip.String()
-	for _, q := range m.Question {
-		switch q.Qtype {
-		case dns.TypeA:
-			if dnsCache[ipStr] != nil && dnsCache[ipStr][q.Name] != nil {
-				m.Answer = append(m.Answer, dnsCache[ipStr][q.Name])
-				if !config.Nolog {
-					log.Printf("[%s] %s\n", ipStr, dnsCache[ipStr][q.Name].String())
-				}
-				continue
+		updateConfig(func(c *Config) {
+			// A reload in the meantime may have switched adapters, and
+			// then the address belongs to the old one.
+			if c.MatchBy != "server" || c.DefaultAdapter != looked.DefaultAdapter || c.AdapterFamily != looked.AdapterFamily {
+				return
 			}
-			hit := false
-			for _, network := range config.Networks {
-				contains, err := network.Ranger.Contains(*ip)
-				if err != nil {
-					log.Print(err)
-					continue
-				}
-				if contains && network.Rules[q.Name] != "" {
-					ip := network.Rules[q.Name]
-					recordType := "A"
-					if strings.Contains(ip, ":") {
-						recordType = "AAAA"
-					}
-					rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", q.Name, recordType, ip))
-					if err != nil {
-						log.Print(err)
-						break
-					}
-					m.Answer = append(m.Answer, rr)
-					if !config.Nolog {
-						log.Printf("[%s] %s\n", ipStr, rr.String())
-					}
-					if dnsCache[ipStr] == nil {
-						dnsCache[ipStr] = map[string]dns.RR{}
-					}
-					dnsCache[ipStr][q.Name] = rr
-					hit = true
-					break
-				}
+			if c.ServerIP == nil || !c.ServerIP.Equal(*ip) {
+				log.Printf("Server address is now %s\n", ip)
 			}
-			if !hit {
-				ips, err := net.LookupIP(q.Name)
-				if err != nil {
-					log.Print(err)
-				} else {
-					for _, ip := range ips {
-						recordType := "A"
-						if ip.To4() == nil {
-							recordType = "AAAA"
-						}
-						rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", q.Name, recordType, ip))
-						if err != nil {
-							log.Print(err)
-							break
-						}
-						m.Answer = append(m.Answer, rr)
-						if !config.Nolog {
-							log.Printf("[%s] %s\n", ipStr, rr.String())
-						}
-					}
-				}
-			}
-		}
+			c.ServerIP = ip
+		})
 	}
 }
 
 func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
+	config := currentConfig()
+	// The slot goes back to the pool it came from, even if a reload has
+	// replaced it meanwhile.
+	pool := config.QueryPool
+	if !pool.acquire() {
+		return
+	}
+	defer pool.release()
+	start := time.Now()
+	m := getReply()
+	defer putReply(m)
 	m.SetReply(r)
-	m.Compress = false
+	m.Compress = config.Compress
+	m.RecursionAvailable = config.Recursion
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(config.EDNSUDPSize, opt.Do())
+		if opt.Version() != 0 {
+			m.Rcode = dns.RcodeBadVers
+			w.WriteMsg(m)
+			return
+		}
+	}
+
+	entry := QueryLog{Client: w.RemoteAddr().String()}
+	ctx, span := startRequestSpan()
+	defer endRequestSpan(span, &entry, m)
+	var clientIP net.IP
+	if ip, err := getClientIP(w.RemoteAddr()); err == nil {
+		clientIP = *ip
+		entry.Client = clientIP.String()
+	}
+	if !config.allows(clientIP) {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	if config.RateLimiter != nil && !config.RateLimiter.allow(entry.Client) {
+		if config.RateLimiter.drop {
+			return
+		}
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	tsig := r.IsTsig()
+	if tsig != nil {
+		if err := w.TsigStatus(); err != nil {
+			log.Printf("[WARN] Rejected query from %s signed with key %s: %v\n", entry.Client, tsig.Hdr.Name, err)
+			m.Rcode = dns.RcodeNotAuth
+			w.WriteMsg(m)
+			return
+		}
+		entry.TSIGKey = tsig.Hdr.Name
+	}
 
 	switch r.Opcode {
+	case dns.OpcodeUpdate:
+		m.Rcode = handleUpdate(r, config, clientIP, &entry)
 	case dns.OpcodeQuery:
-		parseQuery(m, config)
+		if err := parseQuery(ctx, m, r, config, w.RemoteAddr(), &entry); err != nil {
+			m.Answer = nil
+			m.Rcode = rcodeForError(err)
+		}
 	}
 
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		// Truncate compresses replies that are too big before dropping
+		// records, but it also turns compression off for replies that fit.
+		if size := udpPayloadSize(r, config); m.Len() > size {
+			m.Truncate(size)
+		}
+	}
+	if tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
 	w.WriteMsg(m)
+
+	entry.Latency = time.Since(start)
+	handlerDuration.Observe(entry.Latency.Seconds())
+	if config.Debug {
+		logDebug(r, m, entry)
+	}
+	if !config.Nolog {
+		entry.Rcode = dns.RcodeToString[m.Rcode]
+		entry.Answers = m.Answer
+		config.Logger.LogQuery(entry)
+	}
+}
+
+// udpPayloadSize is the largest UDP reply both sides accept: the smaller of
+// the client's and our EDNS0 buffer size, or 512 bytes without EDNS0.
+func udpPayloadSize(r *dns.Msg, config Config) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := int(opt.UDPSize())
+	if size > int(config.EDNSUDPSize) {
+		size = int(config.EDNSUDPSize)
+	}
+	if size < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+	return size
 }
 
 func main() {
 	homeDir, err := os.UserHomeDir()
 	panicIfErr(err)
 	defaultConfigPath := path.Join(homeDir, ".config", "selective-dns-query.yml")
-	configPath := flag.String("config", defaultConfigPath, "Path for config file")
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQueryCommand(os.Args[2:], defaultConfigPath))
+	}
+	configPath := flag.String("config", defaultConfigPath, "Path for config file, read as JSON or TOML for .json or .toml, YAML otherwise")
 	nolog := flag.Bool("quiet", false, "Do not print information about query")
 	doPrintAdapters := flag.Bool("adapters", false, "Print all available network adapters and exit")
+	flag.BoolVar(&debugFlag, "debug", false, "Log a decision trace with the question and answer of every query, as with debug: true")
+	doPrintVersion := flag.Bool("version", false, "Print the version and exit")
+	doPrintConfig := flag.Bool("print-config", false, "Print the configuration as the server sees it after defaults and normalization, and exit")
+	dumpZoneNetwork := flag.String("dump-zone", "", "Print the rules of the network with this CIDR or name as a zone file, and exit")
+	doCheck := flag.Bool("check", false, "Validate the config file and exit")
+	pidfile := flag.String("pidfile", "", "Write the process ID to this file and remove it on shutdown; with user set, its directory must be writable by that account")
+	pprofAddr := flag.String("pprof", "", "Serve net/http/pprof at this address, separate from the DNS and metrics listeners (off by default)")
+	noPersist := flag.Bool("no-persist", false, "Do not write rules changed through the admin API back to the config file")
+	flag.IntVar(&flagOverrides.Port, "port", 0, "Listen on this port instead of the one of the config file")
+	flag.StringVar(&flagOverrides.Proto, "proto", "", "Listen with this protocol (udp, tcp or both) instead of the one of the config file")
+	flag.Var(&flagOverrides.Listen, "listen", "Listen at this address:port instead of the listen list of the config file; repeatable")
+	flag.Var(&flagOverrides.Upstream, "upstream", "Forward to this upstream instead of the upstream list of the config file; repeatable or comma-separated")
+	var initConfig initConfigFlag
+	flag.Var(&initConfig, "init-config", "Write a commented sample config to the path given after it, or to the --config path without one, and exit")
+	force := flag.Bool("force", false, "Let --init-config overwrite an existing file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s query [flags] <name> [type]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	if *doPrintVersion {
+		fmt.Println(versionString())
+		return
+	}
 	if *doPrintAdapters {
 		printAdapters()
 		return
 	}
+	if initConfig.set {
+		path, err := initConfig.target(*configPath, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeSampleConfig(path, *force); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote sample config to %s\n", path)
+		return
+	}
 
-	dat, err := ioutil.ReadFile(*configPath)
-	panicIfErr(err)
-	rawConfig := RawConfig{}
-	panicIfErr(yaml.Unmarshal(dat, &rawConfig))
-
-	_config := Config{DefaultAdapter: rawConfig.DefaultAdapter, Nolog: *nolog}
-	for _, network := range rawConfig.Networks {
-		ranger := cidranger.NewPCTrieRanger()
-		_, cidr, _ := net.ParseCIDR(network.CIDR)
-		ranger.Insert(cidranger.NewBasicRangerEntry(*cidr))
-		rules := map[string]string{}
-		for domain, ip := range network.Rules {
-			if strings.HasSuffix(domain, ".") {
-				rules[domain] = ip
+	mode := loadServe
+	if *doCheck || *doPrintConfig || *dumpZoneNetwork != "" {
+		mode = loadCheck
+	}
+	_config, rawConfig, err := loadConfig(*configPath, *nolog, mode)
+	if *doCheck {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: configuration OK\n", *configPath)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *doPrintConfig {
+		if err := printConfig(_config, rawConfig); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *dumpZoneNetwork != "" {
+		if err := dumpZone(_config, *dumpZoneNetwork, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if logFile := openLogFile(rawConfig.LogFile); logFile != nil {
+		defer logFile.Close()
+	}
+	if rawConfig.LogTarget == "syslog" {
+		if writer := openSyslog(rawConfig.Syslog); writer != nil {
+			defer writer.Close()
+		}
+	}
+	if *pidfile != "" {
+		if err := writePidfile(*pidfile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	setConfig(_config)
+	dnsCache.setMaxEntries(_config.CacheMaxEntries)
+	go dnsCache.sweep(time.Minute)
+	go reloadOnSignal(*configPath, *nolog)
+	go watchConfigFile(*configPath, *nolog, configWatchInterval)
+	go refreshBlocklists(time.Minute)
+	go refreshServerIP(serverIPRefreshInterval)
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if len(rawConfig.Etcd.Endpoints) > 0 {
+		etcdSource, err = newEtcdRules(rawConfig.Etcd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer etcdSource.Close()
+		go etcdSource.watch(watchCtx)
+	}
+
+	log.Println(versionString())
+	servers, err := activatedServers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if servers != nil {
+		log.Printf("Server using %d socket(s) passed by systemd\n", len(servers))
+	} else {
+		for _, endpoint := range listenEndpoints(rawConfig) {
+			servers = append(servers, newServers(endpoint.addr(), endpoint.Protocol)...)
+			log.Printf("Server listening at %s with protocol %s\n", endpoint.addr(), endpoint.Protocol)
+		}
+	}
+	if rawConfig.DoT.CertFile != "" {
+		server := newDoTServer(rawConfig.DoT)
+		servers = append(servers, server)
+		log.Printf("DoT listening at %s\n", server.Addr)
+	}
+	if rawConfig.Tracing.Endpoint != "" {
+		stopTracing, err := startTracing(rawConfig.Tracing)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stopTracing(context.Background())
+	}
+	// The HTTP listeners are bound here rather than in their goroutines so
+	// that privileged ports are taken before dropPrivileges.
+	var metricsServer *http.Server
+	if rawConfig.MetricsAddr != "" {
+		metricsServer = newMetricsServer(rawConfig.MetricsAddr)
+		listener, err := net.Listen("tcp", metricsServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveMetrics(metricsServer, listener)
+	}
+	var pprofServer *http.Server
+	if *pprofAddr != "" {
+		pprofServer = newPprofServer(*pprofAddr)
+		listener, err := net.Listen("tcp", pprofServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go servePprof(pprofServer, listener)
+	}
+	var adminServer *http.Server
+	if rawConfig.Admin.Addr != "" {
+		adminServer = newAdminServer(rawConfig.Admin, *configPath, !*noPersist)
+		listener, err := net.Listen("tcp", adminServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveAdmin(adminServer, listener)
+	}
+	var dohServer *http.Server
+	if rawConfig.DoH.Addr != "" {
+		dohServer, err = newDoHServer(rawConfig.DoH)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", dohServer.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveDoH(dohServer, listener)
+	}
+
+	for _, server := range servers {
+		server.TsigProvider = tsigProvider{}
+		server.MsgAcceptFunc = acceptMsg
+	}
+	if err := limitTCP(servers, rawConfig.TCPMaxConns, rawConfig.TCPIdleTimeout); err != nil {
+		log.Fatal(err)
+	}
+	dns.HandleFunc(".", handleDNSRequest)
+	serveErr := make(chan error, len(servers))
+	started := make(chan struct{}, len(servers))
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() { started <- struct{}{} }
+		go func(server *dns.Server) {
+			if server.PacketConn != nil || server.Listener != nil {
+				serveErr <- server.ActivateAndServe()
 			} else {
-				rules[domain+"."] = ip
+				serveErr <- server.ListenAndServe()
+			}
+		}(server)
+	}
+	for range servers {
+		select {
+		case <-started:
+		case err := <-serveErr:
+			log.Fatal(err)
+		}
+	}
+	if err := dropPrivileges(rawConfig.User, rawConfig.Group); err != nil {
+		log.Fatal(err)
+	}
+	if rawConfig.User != "" || rawConfig.Group != "" {
+		checkLogRotation(rawConfig.LogFile)
+		if *pidfile != "" {
+			if err := checkPidfileDir(*pidfile); err != nil {
+				log.Fatal(err)
 			}
 		}
-		_config.Networks = append(config.Networks, Network{Ranger: ranger, Rules: rules})
 	}
-	config = _config
+	setServing(true)
+	sdNotify("READY=1")
 
-	listenPort := 53
-	net := "udp"
-	if rawConfig.Port != 0 {
-		listenPort = rawConfig.Port
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down\n", sig)
 	}
-	if rawConfig.Proto != "" {
-		net = rawConfig.Proto
+	setServing(false)
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	shutdownServers(ctx, servers)
+	if metricsServer != nil {
+		metricsServer.Shutdown(ctx)
+	}
+	if adminServer != nil {
+		adminServer.Shutdown(ctx)
+	}
+	if dohServer != nil {
+		dohServer.Shutdown(ctx)
+	}
+	if pprofServer != nil {
+		pprofServer.Shutdown(ctx)
+	}
+	if *pidfile != "" {
+		removePidfile(*pidfile)
 	}
-	log.Printf("Server listening at port %d with protocol %s\n", listenPort, net)
-	server := &dns.Server{Addr: fmt.Sprintf(":%d", listenPort), Net: net}
-	dns.HandleFunc(".", handleDNSRequest)
-	panicIfErr(server.ListenAndServe())
-	defer server.Shutdown()
 }
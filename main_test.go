@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordingWriter keeps the reply handleDNSRequest writes, packed as it
+// would go on the wire.
+type recordingWriter struct {
+	remote net.Addr
+	packed []byte
+	tsig   error
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recordingWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	w.packed = packed
+	return err
+}
+func (w *recordingWriter) Write(b []byte) (int, error) { w.packed = b; return len(b), nil }
+func (w *recordingWriter) Close() error                { return nil }
+func (w *recordingWriter) TsigStatus() error           { return w.tsig }
+func (w *recordingWriter) TsigTimersOnly(bool)         {}
+func (w *recordingWriter) Hijack()                     {}
+
+// reply unpacks what was written, or returns nil when nothing was.
+func (w *recordingWriter) reply(t *testing.T) *dns.Msg {
+	t.Helper()
+	if w.packed == nil {
+		return nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(w.packed); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// handle runs r through handleDNSRequest with the running config as if it
+// came over UDP from client.
+func handle(t *testing.T, client string, r *dns.Msg) *recordingWriter {
+	t.Helper()
+	w := &recordingWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 40000}}
+	handleDNSRequest(w, r)
+	return w
+}
+
+// query sends a question for name and qtype from client and returns the
+// reply.
+func query(t *testing.T, client, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return handle(t, client, r).reply(t)
+}
+
+func TestMatchByClient(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+- cidr: 192.168.0.0/16
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+`))
+	for client, want := range map[string]string{"10.1.2.3": "10.0.0.5", "192.168.1.20": "192.168.1.5"} {
+		if got := answerValues(query(t, client, "nas.home.", dns.TypeA)); len(got) != 1 || got[0] != want {
+			t.Errorf("client %s answered %v, want %s", client, got, want)
+		}
+	}
+}
+
+func TestNetworkWithTwoCIDRs(t *testing.T) {
+	if conn, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	} else {
+		conn.Close()
+	}
+	port := freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(`networks:
+- cidr: [127.0.0.1/32, 127.0.0.2/32]
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+port: %d
+`, port))
+	startMain(t, "--config", path)
+	server := fmt.Sprintf("127.0.0.1:%d", port)
+	exchangeUntilAnswered(t, "udp", server, "nas.home.")
+
+	for _, client := range []string{"127.0.0.1", "127.0.0.2"} {
+		c := &dns.Client{Timeout: time.Second, Dialer: &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(client)}}}
+		r := new(dns.Msg)
+		r.SetQuestion("nas.home.", dns.TypeA)
+		m, _, err := c.Exchange(r, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.168.1.5" {
+			t.Errorf("client %s answered %v", client, m.Answer)
+		}
+	}
+}
+
+func TestInvalidCIDRIsNamed(t *testing.T) {
+	path := writeTestFile(t, "config.yml", `networks:
+- cidr: [10.0.0.0/8, 10.0.0.0/33]
+  rules:
+    nas.home: 10.0.0.5
+`)
+	_, err := runMain(t, "--config", path)
+	if err == nil || !strings.Contains(err.Error(), `"10.0.0.0/33"`) {
+		t.Errorf("err = %v, want the bad CIDR named", err)
+	}
+}
+
+func TestEveryNetworkIsLoaded(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(`networks:
+- cidr: 127.0.0.0/8
+  rules:
+    one.home: 10.0.0.1
+- cidr: 127.0.0.0/8
+  rules:
+    two.home: 10.0.0.2
+- cidr: 127.0.0.0/8
+  rules:
+    three.home: 10.0.0.3
+matchBy: client
+port: %d
+`, port))
+	startMain(t, "--config", path)
+
+	server := fmt.Sprintf("127.0.0.1:%d", port)
+	for name, want := range map[string]string{"one.home.": "10.0.0.1", "two.home.": "10.0.0.2", "three.home.": "10.0.0.3"} {
+		m := exchangeUntilAnswered(t, "udp", server, name)
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != want {
+			t.Errorf("%s answered %v, want %s", name, m.Answer, want)
+		}
+	}
+}
+
+func TestAddressFamilies(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    v4.home: 10.0.0.5
+    v6.home: "::1"
+    dual.home: [10.0.0.6, "fd00::6"]
+matchBy: client
+`))
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"v4.home.", dns.TypeA, "10.0.0.5"},
+		{"v4.home.", dns.TypeAAAA, ""},
+		{"v6.home.", dns.TypeAAAA, "::1"},
+		{"v6.home.", dns.TypeA, ""},
+		{"dual.home.", dns.TypeA, "10.0.0.6"},
+		{"dual.home.", dns.TypeAAAA, "fd00::6"},
+	}
+	for _, test := range tests {
+		m := query(t, "10.1.2.3", test.name, test.qtype)
+		if m.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s %s rcode = %d", test.name, dns.TypeToString[test.qtype], m.Rcode)
+		}
+		if got := strings.Join(answerValues(m), " "); got != test.want {
+			t.Errorf("%s %s answered %q, want %q", test.name, dns.TypeToString[test.qtype], got, test.want)
+		}
+	}
+}
+
+func TestResolverFailureIsServfail(t *testing.T) {
+	useConfig(t, loadTestConfig(t, "matchBy: client\n"))
+	previous := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("resolver down")
+	}}
+	t.Cleanup(func() { net.DefaultResolver = previous })
+
+	if m := query(t, "10.1.2.3", "nowhere.test.", dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %d, want SERVFAIL", m.Rcode)
+	}
+}
+
+func TestRuleTTLs(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(`networks:
+- cidr: 127.0.0.0/8
+  rules:
+    a.home: 10.0.0.1
+    b.home: {ip: 10.0.0.2, ttl: 30}
+matchBy: client
+defaultTtl: 120
+port: %d
+`, port))
+	startMain(t, "--config", path)
+
+	server := fmt.Sprintf("127.0.0.1:%d", port)
+	for name, want := range map[string]uint32{"a.home.": 120, "b.home.": 30} {
+		m := exchangeUntilAnswered(t, "udp", server, name)
+		if len(m.Answer) != 1 || m.Answer[0].Header().Ttl != want {
+			t.Errorf("%s answered %v, want a TTL of %d", name, m.Answer, want)
+		}
+	}
+}
+
+func TestMXAndTXTRules(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(`networks:
+- cidr: 127.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+    example.home:
+      txt: ["v=spf1 -all"]
+      mx: ["10 mail.example.home.", "20 backup.example.home"]
+matchBy: client
+port: %d
+`, port))
+	startMain(t, "--config", path)
+	server := fmt.Sprintf("127.0.0.1:%d", port)
+	exchangeUntilAnswered(t, "udp", server, "nas.home.")
+
+	tests := map[uint16][]string{
+		dns.TypeTXT: {`"v=spf1 -all"`},
+		dns.TypeMX:  {"10 mail.example.home.", "20 backup.example.home."},
+	}
+	for qtype, want := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("example.home.", qtype)
+		m, _, err := new(dns.Client).Exchange(r, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := answerValues(m); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s answered %v, want %v", dns.TypeToString[qtype], got, want)
+		}
+	}
+}
+
+func TestInvalidMXRule(t *testing.T) {
+	path := writeTestFile(t, "config.yml", `networks:
+- cidr: 127.0.0.0/8
+  rules:
+    example.home:
+      mx: ["mail.example.home."]
+`)
+	_, err := runMain(t, "--config", path)
+	if err == nil || !strings.Contains(err.Error(), "mail.example.home.") {
+		t.Errorf("err = %v, want the bad MX record named", err)
+	}
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	for _, sig := range []os.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		port := freePort(t, "127.0.0.1")
+		path := writeTestFile(t, "config.yml", fmt.Sprintf("networks:\n- cidr: 127.0.0.0/8\n  rules:\n    nas.home: 10.0.0.5\nmatchBy: client\nport: %d\n", port))
+		server := startMain(t, "--config", path)
+		exchangeUntilAnswered(t, "udp", fmt.Sprintf("127.0.0.1:%d", port), "nas.home.")
+
+		if err := server.Signal(sig); err != nil {
+			t.Fatal(err)
+		}
+		exited := make(chan *os.ProcessState, 1)
+		go func() {
+			state, _ := server.Wait()
+			exited <- state
+		}()
+		select {
+		case state := <-exited:
+			// A listener left serving would keep main from returning.
+			if state == nil || !state.Success() {
+				t.Errorf("%s: exited with %v, want status 0", sig, state)
+			}
+		case <-time.After(shutdownGracePeriod + time.Second):
+			t.Fatalf("%s: still running after the grace period", sig)
+		}
+	}
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 0.0.0.0/0
+  rules:
+    nas.home: 10.0.0.5
+matchBy: client
+allowedNetworks: [10.0.0.0/8]
+`))
+	if m := query(t, "10.1.2.3", "nas.home.", dns.TypeA); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("allowed client got %s with %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if m := query(t, "192.168.1.1", "nas.home.", dns.TypeA); m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+		t.Errorf("denied client got %s with %d answers, want REFUSED", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+}
+
+func TestAdapterAddressIsStable(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tested := false
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil || len(addrs) < 2 {
+			continue
+		}
+		config := Config{DefaultAdapter: iface.Name}
+		first, err := getIPAddress(config)
+		if err != nil {
+			continue
+		}
+		tested = true
+		want := first.String()
+		// The caller owns the returned address.
+		(*first)[len(*first)-1]++
+		for i := 0; i < 10; i++ {
+			ip, err := getIPAddress(config)
+			if err != nil || ip.String() != want {
+				t.Fatalf("%s: lookup %d got %v, %v, want %s", iface.Name, i, ip, err, want)
+			}
+		}
+	}
+	if !tested {
+		t.Skip("no interface with several addresses including IPv4")
+	}
+}
+
+func TestUnknownAdapterIsNamed(t *testing.T) {
+	_, err := getIPAddress(Config{DefaultAdapter: "no-such-adapter0"})
+	if err == nil || !strings.Contains(err.Error(), "no-such-adapter0") {
+		t.Errorf("got %v, want an error naming the adapter", err)
+	}
+}
+
+// TestRunMain stands in for the binary in child processes started by
+// runMain; on its own it does nothing.
+func TestRunMain(t *testing.T) {
+	args := os.Getenv("RUN_MAIN_ARGS")
+	if args == "" {
+		return
+	}
+	os.Args = append([]string{"dynamic-name-server"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// runMain runs main with args in a child process and returns its standard
+// output. The child is killed if it does not exit within ten seconds, as a
+// server that started listening would not.
+func runMain(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run", "^TestRunMain$")
+	cmd.Env = append(os.Environ(), "RUN_MAIN_ARGS="+strings.Join(args, "\n"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		t.Fatalf("%v did not exit", args)
+	}
+	if err != nil {
+		return string(out), fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// startMain runs main with args in a child process until the test ends
+// and returns the process.
+func startMain(t *testing.T, args ...string) *os.Process {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestRunMain$")
+	cmd.Env = append(os.Environ(), "RUN_MAIN_ARGS="+strings.Join(args, "\n"))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("server output:\n%s", output.String())
+		}
+	})
+	return cmd.Process
+}
+
+// freePort returns a port that is free for both UDP and TCP on host.
+func freePort(t *testing.T, host string) int {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		l.Close()
+		if err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatal("no port free for both UDP and TCP")
+	return 0
+}
+
+// exchangeUntilAnswered queries name at addr until an answer comes back,
+// for up to five seconds.
+func exchangeUntilAnswered(t *testing.T, proto, addr, name string) *dns.Msg {
+	t.Helper()
+	client := &dns.Client{Net: proto, Timeout: 200 * time.Millisecond}
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, _, err := client.Exchange(r, addr)
+		if err == nil {
+			return m
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no answer from %s over %s: %v", addr, proto, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	// The config file does not exist, so reaching the server would fail.
+	out, err := runMain(t, "--version", "--config", filepath.Join(t.TempDir(), "missing.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := versionString() + "\n"; out != want {
+		t.Errorf("--version printed %q, want %q", out, want)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	const config = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    a-rather-long-name.with-several-labels.example.test:
+    - 10.0.0.1
+    - 10.0.0.2
+    - 10.0.0.3
+    - 10.0.0.4
+    - 10.0.0.5
+matchBy: client
+`
+	sizes := map[bool]int{}
+	for _, compress := range []bool{false, true} {
+		text := config
+		if compress {
+			text += "compress: true\n"
+		}
+		useConfig(t, loadTestConfig(t, text))
+		r := new(dns.Msg)
+		r.SetQuestion("a-rather-long-name.with-several-labels.example.test.", dns.TypeA)
+		w := handle(t, "10.0.0.9", r)
+		if m := w.reply(t); m == nil || len(m.Answer) != 5 {
+			t.Fatalf("compress %v: reply %v", compress, m)
+		}
+		sizes[compress] = len(w.packed)
+	}
+	// Four of the five owner names shrink to two-byte pointers.
+	if saved := sizes[false] - sizes[true]; saved < 4*50 {
+		t.Errorf("compression saved %d bytes (%d vs %d), want at least 200", saved, sizes[false], sizes[true])
+	}
+}
+
+func TestRecursionFlags(t *testing.T) {
+	var forwarded int32
+	upstream := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&forwarded, 1)
+		stubAnswering("10.30.30.30")(w, r)
+	})
+	query := func(name string, rd bool) *dns.Msg {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		r.RecursionDesired = rd
+		return handle(t, "10.0.0.1", r).reply(t)
+	}
+	const config = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+upstream: [%s]
+recursion: %v
+`
+	useConfig(t, loadTestConfig(t, fmt.Sprintf(config, upstream, true)))
+	if m := query("nas.home.", true); !m.RecursionAvailable {
+		t.Error("RA not set with recursion on")
+	}
+
+	// RD=0 is answered from rules and the cache, never by forwarding.
+	if m := query("nas.home.", false); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("rule with RD=0 = %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if m := query("example.com.", false); m.Rcode != dns.RcodeRefused || atomic.LoadInt32(&forwarded) != 0 {
+		t.Errorf("miss with RD=0 = %s after %d forwarded queries, want REFUSED and none", dns.RcodeToString[m.Rcode], atomic.LoadInt32(&forwarded))
+	}
+	if m := query("example.com.", true); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatalf("miss with RD=1 = %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if m := query("example.com.", false); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || atomic.LoadInt32(&forwarded) != 1 {
+		t.Errorf("cached name with RD=0 = %s %v after %d forwarded queries", dns.RcodeToString[m.Rcode], m.Answer, atomic.LoadInt32(&forwarded))
+	}
+
+	useConfig(t, loadTestConfig(t, fmt.Sprintf(config, upstream, false)))
+	if m := query("nas.home.", true); m.RecursionAvailable {
+		t.Error("RA set with recursion off")
+	}
+	if m := query("example.org.", true); m.Rcode != dns.RcodeRefused {
+		t.Errorf("miss with recursion off = %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestEDNS0(t *testing.T) {
+	ips := make([]string, 60)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.1.0.%d", i+1)
+	}
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    big.home: [`+strings.Join(ips, ", ")+`]
+    nas.home: 192.168.1.5
+matchBy: client
+ednsUdpSize: 1232
+`))
+	query := func(name string, bufsize uint16) (*dns.Msg, int) {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		if bufsize > 0 {
+			r.SetEdns0(bufsize, false)
+		}
+		w := handle(t, "10.0.0.1", r)
+		return w.reply(t), len(w.packed)
+	}
+
+	if m, _ := query("nas.home.", 0); m.IsEdns0() != nil {
+		t.Error("OPT record in the reply to a query without one")
+	}
+	m, size := query("big.home.", 0)
+	if !m.Truncated || size > dns.MinMsgSize || m.IsEdns0() != nil {
+		t.Errorf("without EDNS0: %d bytes, truncated %v, OPT %v; want at most 512 bytes, truncated, no OPT", size, m.Truncated, m.IsEdns0())
+	}
+
+	m, size = query("big.home.", 4096)
+	opt := m.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1232 {
+		t.Fatalf("OPT of the reply = %v, want one advertising 1232", opt)
+	}
+	if m.Truncated || len(m.Answer) != len(ips) || size > 1232 {
+		t.Errorf("with EDNS0: %d bytes, truncated %v, %d answers; want all %d within 1232 bytes", size, m.Truncated, len(m.Answer), len(ips))
+	}
+
+	// The smaller of the two sizes decides.
+	m, size = query("big.home.", 700)
+	if !m.Truncated || size > 700 {
+		t.Errorf("with a 700 byte buffer: %d bytes, truncated %v", size, m.Truncated)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().SetVersion(1)
+	if m := handle(t, "10.0.0.1", r).reply(t); m.Rcode != dns.RcodeBadVers {
+		t.Errorf("EDNS version 1 = %s, want BADVERS", dns.RcodeToString[m.Rcode])
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_queries_total",
+		Help: "Number of questions received, by query type.",
+	}, []string{"qtype"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_cache_lookups_total",
+		Help: "Number of cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+	cachePrefetches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_prefetches_total",
+		Help: "Number of cache entries refreshed ahead of their expiry.",
+	})
+	ruleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_rule_matches_total",
+		Help: "Number of questions answered from rules, by network.",
+	}, []string{"network"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstream_errors_total",
+		Help: "Number of failed upstream exchanges, by upstream.",
+	}, []string{"upstream"})
+	tcpConnectionsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_tcp_connections_rejected_total",
+		Help: "Number of TCP connections closed because tcpMaxConnections was reached.",
+	})
+	queriesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_queries_dropped_total",
+		Help: "Number of queries dropped because maxConcurrentQueries and queueSize were reached.",
+	})
+	handlerDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dns_handler_duration_seconds",
+		Help:    "Time spent handling a DNS request.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queriesTotal, cacheLookups, cachePrefetches, ruleMatches, upstreamErrors, tcpConnectionsRejected, queriesDropped, handlerDuration)
+}
+
+func qtypeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "OTHER"
+}
+
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func serveMetrics(server *http.Server, listener net.Listener) {
+	log.Printf("Metrics listening at %s\n", server.Addr)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("Metrics listener failed: %v\n", err)
+	}
+}
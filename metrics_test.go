@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsCountQueries(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+matchBy: client
+`))
+	queries := testutil.ToFloat64(queriesTotal.WithLabelValues("A"))
+	matches := testutil.ToFloat64(ruleMatches.WithLabelValues("10.0.0.0/8"))
+	hits := testutil.ToFloat64(cacheLookups.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(cacheLookups.WithLabelValues("miss"))
+
+	query(t, "10.1.2.3", "nas.home.", dns.TypeA)
+	query(t, "10.1.2.3", "nas.home.", dns.TypeA)
+
+	if got := testutil.ToFloat64(queriesTotal.WithLabelValues("A")) - queries; got != 2 {
+		t.Errorf("dns_queries_total{qtype=\"A\"} moved by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(ruleMatches.WithLabelValues("10.0.0.0/8")) - matches; got != 1 {
+		t.Errorf("dns_rule_matches_total moved by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("miss")) - misses; got != 1 {
+		t.Errorf("cache misses moved by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("hit")) - hits; got != 1 {
+		t.Errorf("cache hits moved by %v, want 1", got)
+	}
+
+	w := httptest.NewRecorder()
+	newMetricsServer("127.0.0.1:0").Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	for _, name := range []string{"dns_queries_total", "dns_cache_lookups_total", "dns_rule_matches_total", "dns_handler_duration_seconds"} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("/metrics does not expose %s", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+)
+
+// flagOverrides holds the --port, --proto, --listen and --upstream flags.
+// They are applied to every load of the config file, reloads included, and
+// only where they were given.
+var flagOverrides struct {
+	Port     int
+	Proto    string
+	Listen   listenFlag
+	Upstream StringList
+}
+
+// listenFlag collects repeated --listen address:port flags.
+type listenFlag []RawListen
+
+func (l *listenFlag) String() string {
+	addrs := make([]string, len(*l))
+	for i, endpoint := range *l {
+		addrs[i] = endpoint.addr()
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (l *listenFlag) Set(value string) error {
+	endpoint, err := parseListen(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, endpoint)
+	return nil
+}
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends a flag value, which may itself be a comma-separated list.
+func (l *StringList) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
+// applyFlagOverrides puts the flags over the values of the file. --listen
+// replaces the listen list and bindAddress; --port and --proto replace the
+// top-level settings, and those of the listen list of the file as well.
+func applyFlagOverrides(rawConfig *RawConfig) {
+	if len(flagOverrides.Listen) > 0 {
+		rawConfig.Listen = append([]RawListen(nil), flagOverrides.Listen...)
+		rawConfig.BindAddress = ""
+	} else {
+		for i := range rawConfig.Listen {
+			if flagOverrides.Port != 0 {
+				rawConfig.Listen[i].Port = flagOverrides.Port
+			}
+			if flagOverrides.Proto != "" {
+				rawConfig.Listen[i].Protocol = flagOverrides.Proto
+			}
+		}
+	}
+	if flagOverrides.Port != 0 {
+		rawConfig.Port = flagOverrides.Port
+	}
+	if flagOverrides.Proto != "" {
+		rawConfig.Proto = flagOverrides.Proto
+	}
+	if len(flagOverrides.Upstream) > 0 {
+		rawConfig.Upstream = nil
+		for _, addr := range flagOverrides.Upstream {
+			rawConfig.Upstream = append(rawConfig.Upstream, RawUpstream{Addr: addr})
+		}
+	}
+}
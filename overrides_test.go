@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// setFlagOverrides stands in for the flags for the rest of the test.
+func setFlagOverrides(t *testing.T, port int, proto string, listen listenFlag, upstream StringList) {
+	t.Helper()
+	previous := flagOverrides
+	flagOverrides.Port, flagOverrides.Proto, flagOverrides.Listen, flagOverrides.Upstream = port, proto, listen, upstream
+	t.Cleanup(func() { flagOverrides = previous })
+}
+
+func TestApplyFlagOverrides(t *testing.T) {
+	file := func() RawConfig {
+		return RawConfig{
+			Port:        53,
+			Proto:       "both",
+			BindAddress: "0.0.0.0",
+			Listen:      []RawListen{{Address: "127.0.0.1"}, {Address: "::1", Port: 5300, Protocol: "udp"}},
+			Upstream:    []RawUpstream{{Addr: "8.8.8.8"}},
+		}
+	}
+	tests := []struct {
+		name     string
+		port     int
+		proto    string
+		listen   listenFlag
+		upstream StringList
+		want     func(c *RawConfig)
+	}{
+		{name: "no flags", want: func(c *RawConfig) {}},
+		{name: "port and proto", port: 5353, proto: "tcp", want: func(c *RawConfig) {
+			c.Port, c.Proto = 5353, "tcp"
+			c.Listen = []RawListen{{Address: "127.0.0.1", Port: 5353, Protocol: "tcp"}, {Address: "::1", Port: 5353, Protocol: "tcp"}}
+		}},
+		{name: "listen", port: 5353, listen: listenFlag{{Address: "10.0.0.1", Port: 53}}, want: func(c *RawConfig) {
+			c.Port, c.BindAddress = 5353, ""
+			c.Listen = []RawListen{{Address: "10.0.0.1", Port: 53}}
+		}},
+		{name: "upstream", upstream: StringList{"9.9.9.9", "1.1.1.1"}, want: func(c *RawConfig) {
+			c.Upstream = []RawUpstream{{Addr: "9.9.9.9"}, {Addr: "1.1.1.1"}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlagOverrides(t, tt.port, tt.proto, tt.listen, tt.upstream)
+			got, want := file(), file()
+			applyFlagOverrides(&got)
+			tt.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("config = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFlagsOverConfigFile(t *testing.T) {
+	path := writeTestFile(t, "config.yml", `
+networks: []
+port: 53
+protocol: udp
+upstream:
+- 8.8.8.8
+`)
+	out, err := runMain(t, "--print-config", "--config", path, "--port", "5353", "--upstream", "9.9.9.9,1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var printed effectiveConfig
+	if err := yaml.Unmarshal([]byte(out), &printed); err != nil {
+		t.Fatalf("printed config does not parse: %v\n%s", err, out)
+	}
+	if want := []RawListen{{Port: 5353, Protocol: "udp"}}; !reflect.DeepEqual(printed.Listen, want) {
+		t.Errorf("listen = %+v, want %+v", printed.Listen, want)
+	}
+	if want := []string{"9.9.9.9:53", "1.1.1.1:53"}; !reflect.DeepEqual(printed.Upstream, want) {
+		t.Errorf("upstream = %v, want %v", printed.Upstream, want)
+	}
+}
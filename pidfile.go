@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// writePidfile records the process ID for init scripts. It refuses while the
+// process named in an existing file still runs; a file left behind by one
+// that did not shut down cleanly is overwritten.
+func writePidfile(path string) error {
+	if old, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(old)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("Pidfile %s belongs to running process %d", path, pid)
+		}
+		log.Printf("[WARN] Overwriting pidfile %s left by process %s\n", path, strings.TrimSpace(string(old)))
+	}
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// checkPidfileDir makes sure the pidfile can still be removed on shutdown
+// once privileges are dropped, which takes write access to its directory.
+func checkPidfileDir(path string) error {
+	if err := writableDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("Pidfile %s could not be removed on shutdown: %v; put it in a directory owned by the user setting, such as /run/dynamic-name-server", path, err)
+	}
+	return nil
+}
+
+func removePidfile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[WARN] Failed to remove pidfile %s: %v\n", path, err)
+	}
+}
+
+// writableDir creates and removes a file in dir to find out whether the
+// current account may add and remove entries there.
+func writableDir(dir string) error {
+	probe, err := os.CreateTemp(dir, ".probe-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
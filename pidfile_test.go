@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPidfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.pid")
+	if err := writePidfile(path); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%d\n", os.Getpid()); string(contents) != want {
+		t.Errorf("pidfile holds %q, want %q", contents, want)
+	}
+	// Writing again from the same process is not a conflict.
+	if err := writePidfile(path); err != nil {
+		t.Errorf("rewriting own pidfile: %v", err)
+	}
+	removePidfile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pidfile still there after removal: %v", err)
+	}
+	removePidfile(path)
+}
+
+func TestPidfileOfRunningProcess(t *testing.T) {
+	path := writeTestFile(t, "dns.pid", fmt.Sprintf("%d\n", os.Getppid()))
+	err := writePidfile(path)
+	if err == nil || !strings.Contains(err.Error(), "running process") {
+		t.Fatalf("got %v, want a refusal", err)
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != fmt.Sprintf("%d\n", os.Getppid()) {
+		t.Errorf("pidfile of the running process was changed to %q", contents)
+	}
+}
+
+func TestPidfileLeftBehind(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(self, "-test.run", "^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, "dns.pid", fmt.Sprintf("%d\n", cmd.Process.Pid))
+	if err := writePidfile(path); err != nil {
+		t.Fatalf("stale pidfile not overwritten: %v", err)
+	}
+	if contents, _ := os.ReadFile(path); string(contents) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("pidfile holds %q after overwriting", contents)
+	}
+}
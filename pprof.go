@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newPprofServer exposes the runtime profiles on their own listener, apart
+// from both the DNS and the metrics ports, so that they are only reachable
+// where --pprof explicitly binds them.
+func newPprofServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func servePprof(server *http.Server, listener net.Listener) {
+	log.Printf("pprof listening at %s\n", server.Addr)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("pprof listener failed: %v\n", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newPprofServer(listener.Addr().String())
+	go servePprof(server, listener)
+	defer server.Close()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/debug/pprof/ returned HTTP %d", resp.StatusCode)
+	}
+}
+
+func TestPprofAbsentElsewhere(t *testing.T) {
+	for name, handler := range map[string]http.Handler{
+		"metrics": newMetricsServer("").Handler,
+		"doh":     mustDoHServer(t).Handler,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s listener answered /debug/pprof/ with HTTP %d", name, rec.Code)
+		}
+	}
+}
+
+func mustDoHServer(t *testing.T) *http.Server {
+	server, err := newDoHServer(RawDoH{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// prefetching holds the cache keys being refreshed, so that a hot name is
+// re-resolved once however many clients ask for it meanwhile.
+var prefetching sync.Map
+
+// prefetch re-resolves q in the background once its cache entry is within
+// prefetchThreshold of expiring, so that the next client still gets a cache
+// hit. The refresh bypasses the cache and stores its answer the usual way.
+func prefetch(q dns.Question, state *queryState) {
+	key := newCacheKey(state.ipStr, q.Name, q.Qtype)
+	if _, busy := prefetching.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	state.tracef("prefetching %s %s", q.Name, dns.TypeToString[q.Qtype])
+	refresh := &queryState{ctx: context.Background(), config: state.config, ip: state.ip, ipStr: state.ipStr, entry: &QueryLog{}, recurse: state.config.Recursion, refresh: true}
+	go func() {
+		defer prefetching.Delete(key)
+		cachePrefetches.Inc()
+		resolve(q, refresh, 0)
+	}()
+}
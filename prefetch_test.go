@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// askShortTTL asks for a name whose upstream answer lives one second, ten
+// times a second for three seconds, and returns how often the cache missed
+// and how often the upstream was asked.
+func askShortTTL(t *testing.T, threshold float64) (misses float64, exchanges int32) {
+	var asked int32
+	upstream := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}, A: net.ParseIP("10.30.30.30")})
+		w.WriteMsg(m)
+	})
+	c := loadTestConfig(t, fmt.Sprintf(`
+networks:
+- cidr: 10.0.0.0/8
+matchBy: client
+upstream:
+- %s
+prefetchThreshold: %v
+`, upstream, threshold))
+	useConfig(t, c)
+
+	before := testutil.ToFloat64(cacheLookups.WithLabelValues("miss"))
+	for i := 0; i < 30; i++ {
+		m := ask(t, c, "10.0.0.1", "hot.example", dns.TypeA)
+		if got := answerValues(m); len(got) != 1 || got[0] != "10.30.30.30" {
+			t.Fatalf("answer %d = %v, want 10.30.30.30", i, got)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return testutil.ToFloat64(cacheLookups.WithLabelValues("miss")) - before, atomic.LoadInt32(&asked)
+}
+
+func TestPrefetchKeepsNameCached(t *testing.T) {
+	misses, exchanges := askShortTTL(t, 0.5)
+	// Only the first query misses; every later one finds the entry a
+	// prefetch refreshed.
+	if misses != 1 {
+		t.Errorf("cache missed %v times, want 1", misses)
+	}
+	if exchanges < 3 {
+		t.Errorf("upstream was asked %d times over three TTLs, want a prefetch per TTL", exchanges)
+	}
+}
+
+func TestWithoutPrefetchNameExpires(t *testing.T) {
+	if misses, _ := askShortTTL(t, 0); misses < 2 {
+		t.Errorf("cache missed %v times, want one per TTL", misses)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// effectiveConfig is the YAML view of a built Config, after names got their
+// trailing dot, CIDRs were parsed and defaults were filled in.
+type effectiveConfig struct {
+	Listen           []RawListen         `yaml:"listen"`
+	MatchBy          string              `yaml:"matchBy"`
+	Adapter          string              `yaml:"adapter,omitempty"`
+	AdapterFamily    string              `yaml:"adapterFamily,omitempty"`
+	ServerIP         string              `yaml:"serverIp,omitempty"`
+	DefaultTTL       uint32              `yaml:"defaultTtl"`
+	ECS              bool                `yaml:"ecs"`
+	RoundRobin       bool                `yaml:"roundRobin"`
+	Compress         bool                `yaml:"compress"`
+	Debug            bool                `yaml:"debug"`
+	Recursion        bool                `yaml:"recursion"`
+	NegativeTTL      uint32              `yaml:"negativeTtl"`
+	CacheMaxEntries  int                 `yaml:"cacheMaxEntries"`
+	ServeStale       bool                `yaml:"serveStale"`
+	StaleWindow      string              `yaml:"staleWindow,omitempty"`
+	Prefetch         float64             `yaml:"prefetchThreshold,omitempty"`
+	BlockMode        string              `yaml:"blockMode,omitempty"`
+	AnyMode          string              `yaml:"anyMode"`
+	EDNSUDPSize      uint16              `yaml:"ednsUdpSize"`
+	WatchConfig      bool                `yaml:"watchConfig"`
+	Upstream         []string            `yaml:"upstream,omitempty"`
+	UpstreamStrategy string              `yaml:"upstreamStrategy,omitempty"`
+	ForwardZones     map[string][]string `yaml:"forwardZones,omitempty"`
+	Networks         []effectiveNetwork  `yaml:"networks"`
+}
+
+type effectiveNetwork struct {
+	CIDR          []string                 `yaml:"cidr"`
+	Authoritative bool                     `yaml:"authoritative,omitempty"`
+	RequireTSIG   bool                     `yaml:"requireTsig,omitempty"`
+	AllowUpdate   bool                     `yaml:"allowUpdate,omitempty"`
+	SOA           string                   `yaml:"soa,omitempty"`
+	NS            []string                 `yaml:"ns,omitempty"`
+	Upstream      []string                 `yaml:"upstream,omitempty"`
+	Default       *effectiveRule           `yaml:"default,omitempty"`
+	Rules         map[string]effectiveRule `yaml:"rules,omitempty"`
+	RegexRules    yaml.MapSlice            `yaml:"regexRules,omitempty"`
+}
+
+type effectiveRule struct {
+	IP       []string `yaml:"ip,omitempty"`
+	Weights  []int    `yaml:"weights,omitempty"`
+	CNAME    string   `yaml:"cname,omitempty"`
+	TXT      []string `yaml:"txt,omitempty"`
+	MX       []string `yaml:"mx,omitempty"`
+	HTTPS    []string `yaml:"https,omitempty"`
+	SVCB     []string `yaml:"svcb,omitempty"`
+	SRV      []string `yaml:"srv,omitempty"`
+	TTL      uint32   `yaml:"ttl"`
+	Schedule string   `yaml:"schedule,omitempty"`
+}
+
+func printConfig(c Config, rawConfig RawConfig) error {
+	out := effectiveConfig{
+		Listen:          listenEndpoints(rawConfig),
+		MatchBy:         c.MatchBy,
+		Adapter:         c.DefaultAdapter,
+		AdapterFamily:   c.AdapterFamily,
+		DefaultTTL:      c.DefaultTTL,
+		ECS:             c.ECS,
+		RoundRobin:      c.RoundRobin,
+		Compress:        c.Compress,
+		Debug:           c.Debug,
+		Recursion:       c.Recursion,
+		NegativeTTL:     c.NegativeTTL,
+		CacheMaxEntries: c.CacheMaxEntries,
+		ServeStale:      c.StaleWindow > 0,
+		Prefetch:        c.PrefetchThreshold,
+		BlockMode:       c.BlockMode,
+		AnyMode:         c.AnyMode,
+		EDNSUDPSize:     c.EDNSUDPSize,
+		WatchConfig:     c.WatchConfig,
+	}
+	if out.CacheMaxEntries <= 0 {
+		out.CacheMaxEntries = defaultCacheMaxEntries
+	}
+	if c.StaleWindow > 0 {
+		out.StaleWindow = c.StaleWindow.String()
+	}
+	// Configs built for printing skip the interface lookup, so do it here.
+	if c.MatchBy == "server" {
+		if ip, err := getIPAddress(c); err == nil {
+			out.ServerIP = ip.String()
+		}
+	}
+	if c.Forwarder != nil {
+		out.Upstream = upstreamNames(c.Forwarder)
+		out.UpstreamStrategy = c.Forwarder.Strategy
+	}
+	if len(c.ForwardZones) > 0 {
+		out.ForwardZones = map[string][]string{}
+		for zone, forwarder := range c.ForwardZones {
+			out.ForwardZones[zone] = upstreamNames(forwarder)
+		}
+	}
+	for _, network := range c.Networks {
+		out.Networks = append(out.Networks, toEffectiveNetwork(network))
+	}
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
+
+func upstreamNames(f *Forwarder) []string {
+	names := make([]string, len(f.Upstreams))
+	for i, upstream := range f.Upstreams {
+		names[i] = upstream.String()
+	}
+	return names
+}
+
+func toEffectiveNetwork(network Network) effectiveNetwork {
+	out := effectiveNetwork{Authoritative: network.Authoritative, RequireTSIG: network.RequireTSIG, AllowUpdate: network.AllowUpdate}
+	for _, all := range []string{"0.0.0.0/0", "::/0"} {
+		_, ipNet, _ := net.ParseCIDR(all)
+		entries, err := network.Ranger.CoveredNetworks(*ipNet)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			ipNet := entry.Network()
+			out.CIDR = append(out.CIDR, ipNet.String())
+		}
+	}
+	sort.Strings(out.CIDR)
+	if network.Forwarder != nil {
+		out.Upstream = upstreamNames(network.Forwarder)
+	}
+	if network.Zone != nil {
+		out.SOA = network.Zone.Name + " " + rdata(&network.Zone.SOA)
+		out.NS = network.Zone.NS
+	}
+	for _, regexRule := range network.RegexRules {
+		out.RegexRules = append(out.RegexRules, yaml.MapItem{Key: regexRule.Pattern.String(), Value: toEffectiveRule(regexRule.Rule)})
+	}
+	if network.Default != nil {
+		rule := toEffectiveRule(*network.Default)
+		out.Default = &rule
+	}
+	if len(network.Rules) > 0 {
+		out.Rules = map[string]effectiveRule{}
+		for name, rule := range network.Rules {
+			out.Rules[name] = toEffectiveRule(rule)
+		}
+	}
+	return out
+}
+
+func toEffectiveRule(rule Rule) effectiveRule {
+	out := effectiveRule{IP: rule.IPs, Weights: rule.Weights, CNAME: rule.CNAME, TXT: rule.TXT, TTL: rule.TTL}
+	if rule.Schedule != nil {
+		out.Schedule = rule.Schedule.String()
+	}
+	for _, mx := range rule.MX {
+		out.MX = append(out.MX, fmt.Sprintf("%d %s", mx.Preference, mx.Host))
+	}
+	for i := range rule.HTTPS {
+		out.HTTPS = append(out.HTTPS, rdata(&rule.HTTPS[i]))
+	}
+	for i := range rule.SVCB {
+		out.SVCB = append(out.SVCB, rdata(&rule.SVCB[i]))
+	}
+	for i := range rule.SRV {
+		out.SRV = append(out.SRV, rdata(&rule.SRV[i]))
+	}
+	return out
+}
+
+// rdata formats a record the way it is written in the config file, without
+// the owner, TTL, class and type.
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
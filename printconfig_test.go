@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestPrintConfig(t *testing.T) {
+	path := writeTestFile(t, "config.yml", `
+networks:
+- cidr: 10.1.2.3/8
+  rules:
+    nas.home: 192.168.1.5
+    files.home: nas.home
+    mail.home:
+      ip: 192.168.1.25
+      mx:
+      - 10 mail.home
+matchBy: client
+`)
+	out, err := runMain(t, "--print-config", "--config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var printed effectiveConfig
+	if err := yaml.Unmarshal([]byte(out), &printed); err != nil {
+		t.Fatalf("printed config does not parse: %v\n%s", err, out)
+	}
+
+	if want := []RawListen{{Port: 53, Protocol: "both"}}; !reflect.DeepEqual(printed.Listen, want) {
+		t.Errorf("listen = %+v, want %+v", printed.Listen, want)
+	}
+	if printed.DefaultTTL != defaultTTL {
+		t.Errorf("defaultTtl = %d, want %d", printed.DefaultTTL, defaultTTL)
+	}
+	if len(printed.Networks) != 1 {
+		t.Fatalf("printed %d networks, want 1", len(printed.Networks))
+	}
+	network := printed.Networks[0]
+	if want := []string{"10.0.0.0/8"}; !reflect.DeepEqual(network.CIDR, want) {
+		t.Errorf("cidr = %v, want %v", network.CIDR, want)
+	}
+	want := map[string]effectiveRule{
+		"nas.home.":   {IP: []string{"192.168.1.5"}, TTL: defaultTTL},
+		"files.home.": {CNAME: "nas.home.", TTL: defaultTTL},
+		"mail.home.":  {IP: []string{"192.168.1.25"}, MX: []string{"10 mail.home."}, TTL: defaultTTL},
+	}
+	if !reflect.DeepEqual(network.Rules, want) {
+		t.Errorf("rules = %+v, want %+v", network.Rules, want)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import "log"
+
+// dropPrivileges is only supported on Unix; elsewhere user and group are
+// ignored.
+func dropPrivileges(userName, groupName string) error {
+	if userName != "" || groupName != "" {
+		log.Println("[WARN] user and group are not supported on this platform")
+	}
+	return nil
+}
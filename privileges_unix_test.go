@@ -0,0 +1,81 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+// listenPrivileged binds the first free port below 1024 on the loopback
+// address.
+func listenPrivileged() (net.Listener, error) {
+	var err error
+	for port := 1000; port > 900; port-- {
+		var l net.Listener
+		if l, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			return l, nil
+		}
+	}
+	return nil, err
+}
+
+// TestDropPrivileges binds a privileged port as root and drops to nobody in
+// a child process, since the switch cannot be undone for the rest of the
+// tests.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("DROP_PRIVILEGES_CHILD") == "1" {
+		dropPrivilegesChild(t)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestDropPrivileges$", "-test.v")
+	// The parent creates and removes the directory the child checks, which
+	// it can no longer clean up itself.
+	cmd.Env = append(os.Environ(), "DROP_PRIVILEGES_CHILD=1", "DROP_PRIVILEGES_DIR="+t.TempDir())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
+
+func dropPrivilegesChild(t *testing.T) {
+	l, err := listenPrivileged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := dropPrivileges("nobody", ""); err != nil {
+		t.Fatal(err)
+	}
+	if syscall.Getuid() == 0 || syscall.Getgid() == 0 {
+		t.Fatalf("still uid %d, gid %d", syscall.Getuid(), syscall.Getgid())
+	}
+	if again, err := listenPrivileged(); err == nil {
+		again.Close()
+		t.Fatal("bound a privileged port after dropping privileges")
+	}
+
+	// The listener bound before the drop keeps accepting.
+	go func() {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A log directory created by root is no longer writable.
+	if dir := os.Getenv("DROP_PRIVILEGES_DIR"); writableDir(dir) == nil {
+		t.Errorf("%s still writable after dropping privileges", dir)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const maxCNAMEDepth = 8
+
+// net.LookupIP does not expose record TTLs, so its answers are served and
+// cached with a short fixed lifetime.
+const systemLookupTTL = 60
+
+// addressRecord returns an A or AAAA record depending on the family of ip.
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip4}
+	}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip}
+}
+
+func recordType(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+func rcodeForError(err error) int {
+	log.Printf("[WARN] %v\n", err)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return dns.RcodeNameError
+	}
+	return dns.RcodeServerFailure
+}
+
+type queryState struct {
+	// ctx carries the request span to upstream exchanges.
+	ctx    context.Context
+	config Config
+	ip     net.IP
+	ipStr  string
+	entry  *QueryLog
+	// recurse is false when the client sent RD=0 or recursion is off;
+	// misses are then answered without asking an upstream.
+	recurse bool
+	// ttlCap is the most seconds the answer may be cached for, or 0.
+	ttlCap uint32
+	// refresh skips the cache lookup, for prefetches.
+	refresh bool
+	// authority goes in the authority section, the SOA of a negative
+	// answer from a zone.
+	authority []dns.RR
+}
+
+func (state *queryState) capTTL(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	seconds := uint32((d + time.Second - 1) / time.Second)
+	if state.ttlCap == 0 || seconds < state.ttlCap {
+		state.ttlCap = seconds
+	}
+}
+
+// clampTTL lowers the TTLs of rrs to ttlCap so that neither the cache nor
+// the client keeps an answer past the switch of a scheduled rule.
+func (state *queryState) clampTTL(rrs []dns.RR) []dns.RR {
+	if state.ttlCap == 0 {
+		return rrs
+	}
+	for _, rr := range rrs {
+		if rr.Header().Ttl > state.ttlCap {
+			rr.Header().Ttl = state.ttlCap
+		}
+	}
+	return rrs
+}
+
+func (state *queryState) cache(q dns.Question, rrs []dns.RR) {
+	dnsCache.set(state.config.cacheEpoch, state.ipStr, q.Name, q.Qtype, state.clampTTL(rrs))
+}
+
+func (state *queryState) setSource(source, network string) {
+	if state.entry.Source == "" {
+		state.entry.Source = source
+		state.entry.Network = network
+	}
+}
+
+func parseQuery(ctx context.Context, m, r *dns.Msg, config Config, remoteAddr net.Addr, entry *QueryLog) error {
+	ip, err := getMatchIP(config, remoteAddr)
+	if err != nil {
+		return err
+	}
+	subnet := clientSubnet(config, r)
+	if subnet != nil {
+		ip = &subnet.Address
+		echoClientSubnet(m, subnet)
+	}
+	state := &queryState{ctx: ctx, config: config, ip: *ip, ipStr: ip.String(), entry: entry, recurse: config.Recursion && r.RecursionDesired}
+	entry.MatchIP = state.ipStr
+	if subnet != nil {
+		state.tracef("matching on client subnet %s/%d", state.ipStr, subnet.SourceNetmask)
+	} else {
+		state.tracef("matching on %s address %s", config.MatchBy, state.ipStr)
+	}
+	state.traceNetworks()
+	if entry.TSIGKey == "" && requiresTSIG(config, state.ip) {
+		state.tracef("network requires TSIG, refusing unsigned query")
+		m.Rcode = dns.RcodeRefused
+		return nil
+	}
+	for _, q := range m.Question {
+		queriesTotal.WithLabelValues(qtypeLabel(q.Qtype)).Inc()
+		if entry.Name == "" {
+			entry.Name = q.Name
+			entry.Qtype = qtypeLabel(q.Qtype)
+		}
+		if q.Qclass == dns.ClassCHAOS {
+			state.setSource("chaos", "")
+			answers, rcode := chaosAnswer(q, config)
+			m.Rcode = rcode
+			m.Answer = append(m.Answer, answers...)
+			continue
+		}
+		if q.Qtype == dns.TypeANY && config.AnyMode != "forward" {
+			state.setSource("any", "")
+			state.tracef("answering ANY with anyMode %s", config.AnyMode)
+			answers, rcode := anyAnswer(q, config)
+			m.Rcode = rcode
+			m.Answer = append(m.Answer, answers...)
+			continue
+		}
+		answers, rcode, err := resolve(q, state, 0)
+		if err != nil {
+			return err
+		}
+		m.Rcode = rcode
+		m.Answer = append(m.Answer, state.clampTTL(answers)...)
+		m.Ns = append(m.Ns, state.authority...)
+	}
+	return nil
+}
+
+// clientSubnet returns the EDNS0 CLIENT-SUBNET option of r with its address
+// masked to the source prefix, when ecs is enabled and the option is usable.
+func clientSubnet(config Config, r *dns.Msg) *dns.EDNS0_SUBNET {
+	if !config.ECS || config.MatchBy != "client" {
+		return nil
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok || subnet.SourceNetmask == 0 {
+			continue
+		}
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+		if int(subnet.SourceNetmask) > bits {
+			return nil
+		}
+		masked := *subnet
+		masked.Address = subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits))
+		if masked.Address == nil {
+			return nil
+		}
+		return &masked
+	}
+	return nil
+}
+
+// echoClientSubnet adds the option back to the OPT record of the reply.
+// Rules match on the whole source prefix, so the scope is the same as the
+// source netmask.
+func echoClientSubnet(m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	reply := *subnet
+	reply.SourceScope = subnet.SourceNetmask
+	opt.Option = append(opt.Option, &reply)
+}
+
+// matchNetworks returns the networks containing ip, most specific first.
+// Networks with equally long prefixes keep their order from the config file.
+func matchNetworks(config Config, ip net.IP) []Network {
+	type candidate struct {
+		network Network
+		prefix  int
+	}
+	candidates := []candidate{}
+	for _, network := range config.Networks {
+		entries, err := network.Ranger.ContainingNetworks(ip)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		prefix := -1
+		for _, entry := range entries {
+			ipNet := entry.Network()
+			if ones, _ := ipNet.Mask.Size(); ones > prefix {
+				prefix = ones
+			}
+		}
+		if prefix >= 0 {
+			candidates = append(candidates, candidate{network, prefix})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].prefix > candidates[j].prefix
+	})
+	networks := make([]Network, len(candidates))
+	for i, c := range candidates {
+		networks[i] = c.network
+	}
+	return networks
+}
+
+// matchRule looks for an exact or wildcard rule in every network containing
+// the address before falling back to the most specific network's catch-all
+// rule. Rules outside their schedule are passed over, and every scheduled
+// rule on the way caps the TTL at the time until its next switch.
+func matchRule(state *queryState, name string) (Rule, string, bool) {
+	now := clock().In(state.config.Location)
+	applies := func(rule Rule) bool {
+		if rule.Schedule == nil {
+			return true
+		}
+		state.capTTL(rule.Schedule.untilChange(now))
+		return rule.Schedule.active(now)
+	}
+	networks := matchNetworks(state.config, state.ip)
+	for _, network := range networks {
+		for _, rule := range network.candidates(name) {
+			if applies(rule) {
+				ruleMatches.WithLabelValues(network.Name).Inc()
+				return rule, network.Name, true
+			}
+		}
+	}
+	for _, network := range networks {
+		if network.Default != nil && applies(*network.Default) {
+			ruleMatches.WithLabelValues(network.Name).Inc()
+			return *network.Default, network.Name, true
+		}
+	}
+	return Rule{}, "", false
+}
+
+// authoritativeNetwork reports the first network containing ip that answers
+// only from its own rules and must never forward.
+func authoritativeNetwork(config Config, ip net.IP) (string, bool) {
+	for _, network := range matchNetworks(config, ip) {
+		if network.Authoritative {
+			return network.Name, true
+		}
+	}
+	return "", false
+}
+
+// reverseLookup finds the names whose address rules point at the address
+// of an in-addr.arpa or ip6.arpa name, in the most specific network first.
+func reverseLookup(config Config, ip net.IP, name string) ([]reverseEntry, string, bool) {
+	key := strings.ToLower(name)
+	for _, network := range matchNetworks(config, ip) {
+		if entries, ok := network.Reverse[key]; ok {
+			return entries, network.Name, true
+		}
+	}
+	return nil, "", false
+}
+
+func resolve(q dns.Question, state *queryState, depth int) ([]dns.RR, int, error) {
+	config := state.config
+	if config.Blocklist.blocked(q.Name) {
+		state.setSource("blocklist", "")
+		state.tracef("%s is blocked, answering with %s", q.Name, config.BlockMode)
+		answers, rcode := blockedAnswer(q, config.BlockMode)
+		return answers, rcode, nil
+	}
+	if rrs, rcode, ok := dnsCache.get(state.ipStr, q.Name, q.Qtype); ok && !state.refresh {
+		cacheLookups.WithLabelValues("hit").Inc()
+		state.setSource("cache", "")
+		state.tracef("cache hit for %s %s (%s)", q.Name, dns.TypeToString[q.Qtype], dns.RcodeToString[rcode])
+		if config.PrefetchThreshold > 0 && dnsCache.expiresSoon(state.ipStr, q.Name, q.Qtype, config.PrefetchThreshold) {
+			prefetch(q, state)
+		}
+		return rotate(rrs, config), rcode, nil
+	}
+	if !state.refresh {
+		cacheLookups.WithLabelValues("miss").Inc()
+		state.tracef("cache miss for %s %s", q.Name, dns.TypeToString[q.Qtype])
+	}
+
+	rule, network, hit := matchRule(state, strings.ToLower(q.Name))
+	if hit {
+		state.tracef("rule for %s found in network %s", q.Name, network)
+	} else {
+		state.tracef("no rule for %s", q.Name)
+	}
+	if hit && rule.CNAME != "" {
+		state.setSource("rule", network)
+		cname := &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rule.TTL},
+			Target: rule.CNAME,
+		}
+		if q.Qtype == dns.TypeCNAME {
+			return []dns.RR{cname}, dns.RcodeSuccess, nil
+		}
+		if depth >= maxCNAMEDepth {
+			return nil, dns.RcodeServerFailure, fmt.Errorf("CNAME chain for %s exceeds %d hops", q.Name, maxCNAMEDepth)
+		}
+		target := q
+		target.Name = rule.CNAME
+		state.tracef("following CNAME %s to %s", q.Name, rule.CNAME)
+		answers, rcode, err := resolve(target, state, depth+1)
+		return append([]dns.RR{cname}, answers...), rcode, err
+	}
+
+	switch q.Qtype {
+	case dns.TypeSOA, dns.TypeNS:
+		if answers, network, ok := apexAnswer(config, state.ip, q); ok {
+			state.setSource("rule", network)
+			state.tracef("%s is the apex of the zone of network %s", q.Name, network)
+			if zone := zoneOf(config, state.ip, q.Name); zone != nil && len(answers) == 0 {
+				state.authority = zone.negative(config.Generation)
+			}
+			return answers, dns.RcodeSuccess, nil
+		}
+	case dns.TypeTXT, dns.TypeSRV, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeMX:
+		if hit && len(rule.records[q.Qtype]) > 0 {
+			state.setSource("rule", network)
+			return rule.answer(q.Name, q.Qtype), dns.RcodeSuccess, nil
+		}
+	case dns.TypePTR:
+		if names, network, ok := reverseLookup(config, state.ip, q.Name); ok {
+			state.setSource("rule", network)
+			state.tracef("PTR for %s found in network %s", q.Name, network)
+			answers := []dns.RR{}
+			for _, entry := range names {
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: entry.TTL}
+				answers = append(answers, &dns.PTR{Hdr: hdr, Ptr: entry.Name})
+			}
+			return answers, dns.RcodeSuccess, nil
+		}
+	}
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		if hit && len(rule.records[dns.TypeA])+len(rule.records[dns.TypeAAAA]) > 0 {
+			answers := rule.answer(q.Name, q.Qtype)
+			state.setSource("rule", network)
+			if zone := zoneOf(config, state.ip, q.Name); zone != nil && len(answers) == 0 {
+				// NODATA for the other address family.
+				state.authority = zone.negative(config.Generation)
+			}
+			// A weighted pick is made per query; caching it would hand one
+			// pick to every client sharing the cache key.
+			if _, weighted := rule.balancers[q.Qtype]; !weighted {
+				state.cache(q, answers)
+			}
+			return rotate(answers, config), dns.RcodeSuccess, nil
+		}
+		if name, ok := authoritativeNetwork(config, state.ip); ok {
+			return authoritativeMiss(state, q, hit, name)
+		}
+		if !state.recurse {
+			return noRecursion(state)
+		}
+		state.setSource("upstream", "")
+		var answers []dns.RR
+		var rcode int
+		var err error
+		if forwarder := config.forwarderFor(state.ip, q.Name); forwarder != nil {
+			answers, rcode, err = resolveUpstream(q, state, forwarder)
+		} else {
+			state.tracef("looking up %s with the system resolver", q.Name)
+			answers, rcode, err = lookupIP(q)
+			answers = filterPrivate(q, state, answers)
+			if err == nil && hasType(answers, q.Qtype) {
+				state.cache(q, answers)
+			}
+		}
+		return serveStale(q, state, answers, rcode, err)
+	default:
+		if name, ok := authoritativeNetwork(config, state.ip); ok {
+			return authoritativeMiss(state, q, hit, name)
+		}
+		if !state.recurse {
+			return noRecursion(state)
+		}
+		forwarder := config.forwarderFor(state.ip, q.Name)
+		if forwarder == nil {
+			forwarder = config.SystemForwarder
+		}
+		if forwarder == nil {
+			state.tracef("no upstream for %s, answering empty", dns.TypeToString[q.Qtype])
+			return nil, dns.RcodeSuccess, nil
+		}
+		state.setSource("upstream", "")
+		answers, rcode, err := resolveUpstream(q, state, forwarder)
+		return serveStale(q, state, answers, rcode, err)
+	}
+}
+
+// authoritativeMiss answers NODATA for a name that has a rule but no records
+// of the asked type or is the zone apex, and NXDOMAIN for a name without any
+// rule. Names in the zone get its SOA in the authority section.
+func authoritativeMiss(state *queryState, q dns.Question, hit bool, network string) ([]dns.RR, int, error) {
+	state.setSource("rule", network)
+	state.tracef("network %s is authoritative and has no matching record", network)
+	zone := zoneOf(state.config, state.ip, q.Name)
+	if zone != nil {
+		state.authority = zone.negative(state.config.Generation)
+	}
+	if hit || (zone != nil && strings.EqualFold(zone.Name, q.Name)) {
+		return nil, dns.RcodeSuccess, nil
+	}
+	return nil, dns.RcodeNameError, nil
+}
+
+// noRecursion answers a miss that may not be forwarded with REFUSED, both
+// when recursion is off and for a client that sent RD=0. An empty NOERROR
+// would claim the name exists without records of the asked type.
+func noRecursion(state *queryState) ([]dns.RR, int, error) {
+	if !state.config.Recursion {
+		state.tracef("recursion is off, refusing")
+	} else {
+		state.tracef("recursion not desired, refusing")
+	}
+	return nil, dns.RcodeRefused, nil
+}
+
+// serveStale swaps a failed upstream answer for a recently expired cache
+// entry when serveStale is enabled.
+func serveStale(q dns.Question, state *queryState, answers []dns.RR, rcode int, err error) ([]dns.RR, int, error) {
+	if state.config.StaleWindow == 0 || (err == nil && rcode != dns.RcodeServerFailure) {
+		return answers, rcode, err
+	}
+	rrs := dnsCache.getStale(state.ipStr, q.Name, q.Qtype, state.config.StaleWindow)
+	if rrs == nil {
+		return answers, rcode, err
+	}
+	if err != nil {
+		log.Printf("[WARN] %v; serving stale answer for %s\n", err, q.Name)
+	}
+	state.entry.Source = "stale"
+	state.tracef("upstream failed, serving stale answer")
+	return rrs, dns.RcodeSuccess, nil
+}
+
+func hasType(rrs []dns.RR, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+var rotation uint64
+
+// rotate shifts the record set by one position per response so that
+// clients spread across the addresses of a multi-IP rule.
+func rotate(rrs []dns.RR, config Config) []dns.RR {
+	if !config.RoundRobin || len(rrs) < 2 {
+		return rrs
+	}
+	for _, rr := range rrs[1:] {
+		if rr.Header().Rrtype != rrs[0].Header().Rrtype {
+			return rrs
+		}
+	}
+	offset := int(atomic.AddUint64(&rotation, 1) % uint64(len(rrs)))
+	return append(rrs[offset:len(rrs):len(rrs)], rrs[:offset]...)
+}
+
+// forwarderFor picks the forwardZones entry with the longest suffix of name,
+// then the upstreams of the most specific network containing ip that has
+// its own, and finally the global upstreams.
+func (c Config) forwarderFor(ip net.IP, name string) *Forwarder {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := range labels {
+		if forwarder, ok := c.ForwardZones[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			return forwarder
+		}
+	}
+	for _, network := range matchNetworks(c, ip) {
+		if network.Forwarder != nil {
+			return network.Forwarder
+		}
+	}
+	return c.Forwarder
+}
+
+// resolveUpstream forwards q and caches the reply, including NXDOMAIN and
+// empty answers so that missing names do not hit the upstream every time.
+func resolveUpstream(q dns.Question, state *queryState, forwarder *Forwarder) ([]dns.RR, int, error) {
+	state.tracef("forwarding %s %s to %s", q.Name, dns.TypeToString[q.Qtype], strings.Join(upstreamNames(forwarder), ", "))
+	resp, err := forwarder.forward(state.ctx, q)
+	if err != nil {
+		state.tracef("upstream failed: %v", err)
+		return nil, dns.RcodeServerFailure, err
+	}
+	state.tracef("upstream answered %s with %d record(s)", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	resp.Answer = filterPrivate(q, state, resp.Answer)
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && hasType(resp.Answer, q.Qtype):
+		state.cache(q, resp.Answer)
+	case resp.Rcode == dns.RcodeNameError, resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0:
+		ttl := negativeTTL(resp, state.config.NegativeTTL)
+		if state.ttlCap != 0 && ttl > state.ttlCap {
+			ttl = state.ttlCap
+		}
+		dnsCache.setNegative(state.config.cacheEpoch, state.ipStr, q.Name, q.Qtype, resp.Rcode, ttl)
+	}
+	return resp.Answer, resp.Rcode, nil
+}
+
+// negativeTTL follows RFC 2308: the lower of the SOA record's TTL and its
+// minimum field, capped at limit. Replies without a SOA use limit as is.
+func negativeTTL(resp *dns.Msg, limit uint32) uint32 {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if ttl < limit {
+			return ttl
+		}
+		break
+	}
+	return limit
+}
+
+func lookupIP(q dns.Question) ([]dns.RR, int, error) {
+	ips, err := net.LookupIP(q.Name)
+	if err != nil {
+		return nil, dns.RcodeServerFailure, err
+	}
+	answers := []dns.RR{}
+	for _, ip := range ips {
+		if recordType(ip) != q.Qtype {
+			continue
+		}
+		answers = append(answers, addressRecord(q.Name, ip, systemLookupTTL))
+	}
+	return answers, dns.RcodeSuccess, nil
+}
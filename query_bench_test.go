@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const benchConfig = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    rule.bench.test: 10.1.1.1
+    "*.wild.bench.test": 10.1.1.2
+matchBy: client
+`
+
+// benchQuery runs parseQuery the way handleDNSRequest does, without the
+// socket.
+func benchQuery(b *testing.B, c Config, client net.Addr, name string) {
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if err := parseQuery(context.Background(), m, r, c, client, &QueryLog{}); err != nil {
+		b.Error(err)
+	} else if len(m.Answer) == 0 {
+		b.Errorf("no answer for %s", name)
+	}
+}
+
+func BenchmarkParseQuery(b *testing.B) {
+	upstream := startStub(b, stubAnswering("10.9.9.9"))
+	c := loadTestConfig(b, benchConfig+"upstream: ["+upstream+"]\n")
+	useConfig(b, c)
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	b.Run("CacheHit", func(b *testing.B) {
+		dnsCache.flush()
+		benchQuery(b, c, client, "cached.bench.test.")
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			benchQuery(b, c, client, "cached.bench.test.")
+		}
+	})
+	// Rule answers are cached as well, so the cache is flushed outside the
+	// timer to make every query a miss.
+	b.Run("RuleMatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dnsCache.flush()
+			b.StartTimer()
+			benchQuery(b, c, client, "rule.bench.test.")
+		}
+	})
+	b.Run("UpstreamMiss", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dnsCache.flush()
+			b.StartTimer()
+			benchQuery(b, c, client, "miss.bench.test.")
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		dnsCache.flush()
+		benchQuery(b, c, client, "cached.bench.test.")
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				benchQuery(b, c, client, "cached.bench.test.")
+				benchQuery(b, c, client, "x.wild.bench.test.")
+			}
+		})
+	})
+}
+
+// BenchmarkRuleAnswer compares parsing the record of a rule on every query,
+// as before the records were built at load time, with copying the prepared
+// one.
+func BenchmarkRuleAnswer(b *testing.B) {
+	rule, err := buildRule(RawRule{IP: addresses("10.1.1.1", "10.1.1.2")}, 60)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("NewRR", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, ip := range rule.IPs {
+				if _, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", "rule.bench.test.", rule.TTL, ip)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Prepared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rule.answer("rule.bench.test.", dns.TypeA)
+		}
+	})
+}
+
+// BenchmarkReply compares allocating the reply for every query with taking
+// it from replyPool.
+func BenchmarkReply(b *testing.B) {
+	r := new(dns.Msg)
+	r.SetQuestion("rule.bench.test.", dns.TypeA)
+	answer := testA("rule.bench.test.", "10.1.1.1", 60)
+	buf := make([]byte, dns.MinMsgSize)
+	b.Run("New", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, answer...)
+			if _, err := m.PackBuffer(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m := getReply()
+			m.SetReply(r)
+			m.Answer = append(m.Answer, answer...)
+			if _, err := m.PackBuffer(buf); err != nil {
+				b.Fatal(err)
+			}
+			putReply(m)
+		}
+	})
+}
+
+// BenchmarkMatchIP compares walking the interfaces on every query with
+// reading the address refreshServerIP keeps on the config.
+func BenchmarkMatchIP(b *testing.B) {
+	c := loadTestConfig(b, benchConfig)
+	c.MatchBy = "server"
+	ip, err := getIPAddress(c)
+	if err != nil {
+		b.Skipf("no adapter address: %v", err)
+	}
+	c.ServerIP = ip
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	b.Run("Lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := getIPAddress(c); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := getMatchIP(c, client); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// ask resolves name for a client at the given address with c, the way
+// handleDNSRequest does for a UDP query with RD set.
+func ask(t *testing.T, c Config, client, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if err := parseQuery(context.Background(), m, r, c, &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, &QueryLog{}); err != nil {
+		m.Answer = nil
+		m.Rcode = rcodeForError(err)
+	}
+	return m
+}
+
+// answerValues returns the data of each answer record, such as the address
+// of an A record, in order.
+func answerValues(m *dns.Msg) []string {
+	values := []string{}
+	for _, rr := range m.Answer {
+		hdr := rr.Header().String()
+		values = append(values, rr.String()[len(hdr):])
+	}
+	return values
+}
+
+func TestCNAMEChains(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    app.home: 10.0.0.5
+    www.home: app.home
+    alias.home: www.home
+    loop1.home: loop2.home
+    loop2.home: loop1.home
+matchBy: client
+`))
+	tests := map[string][]string{
+		"www.home.":   {"app.home.", "10.0.0.5"},
+		"alias.home.": {"www.home.", "app.home.", "10.0.0.5"},
+	}
+	for name, want := range tests {
+		if got := answerValues(query(t, "10.1.2.3", name, dns.TypeA)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s answered %v, want %v", name, got, want)
+		}
+	}
+	if m := query(t, "10.1.2.3", "loop1.home.", dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("CNAME loop rcode = %d, want SERVFAIL", m.Rcode)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	for _, roundRobin := range []bool{false, true} {
+		useConfig(t, loadTestConfig(t, fmt.Sprintf(`
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    pool.home: [10.0.0.1, 10.0.0.2, 10.0.0.3]
+matchBy: client
+roundRobin: %v
+`, roundRobin)))
+		orders := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			got := answerValues(query(t, "10.1.2.3", "pool.home.", dns.TypeA))
+			if len(got) != 3 {
+				t.Fatalf("answered %v, want all three addresses", got)
+			}
+			orders[strings.Join(got, " ")] = true
+		}
+		if want := map[bool]int{false: 1, true: 3}[roundRobin]; len(orders) != want {
+			t.Errorf("roundRobin %v gave %d orders in three queries, want %d: %v", roundRobin, len(orders), want, orders)
+		}
+	}
+}
+
+func TestWildcardRules(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    "*.a.b.c": 10.0.0.9
+    exact.a.b.c: 10.0.0.8
+`)
+	for name, want := range map[string]string{
+		"x.a.b.c.":     "10.0.0.9",
+		"y.x.a.b.c.":   "10.0.0.9",
+		"exact.a.b.c.": "10.0.0.8",
+		"a.b.c.":       "",
+		"x.b.c.":       "",
+	} {
+		rules := c.Networks[0].candidates(name)
+		switch {
+		case want == "" && len(rules) > 0:
+			t.Errorf("%s matched %v, want no match", name, rules[0].IPs)
+		case want != "" && (len(rules) == 0 || len(rules[0].IPs) != 1 || rules[0].IPs[0] != want):
+			t.Errorf("%s matched %v, want %s", name, rules, want)
+		}
+	}
+}
+
+func TestMostSpecificNetworkWins(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+- cidr: 10.1.2.0/24
+  rules:
+    nas.home: 10.1.2.5
+matchBy: client
+`))
+	for client, want := range map[string]string{
+		"10.1.2.3": "10.1.2.5",
+		"10.9.9.9": "10.0.0.5",
+	} {
+		if got := answerValues(query(t, client, "nas.home.", dns.TypeA)); len(got) != 1 || got[0] != want {
+			t.Errorf("client %s got %v, want %s", client, got, want)
+		}
+	}
+}
+
+func TestDefaultRuleStaysInItsNetwork(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  default: 10.0.0.1
+  rules:
+    nas.home: 10.0.0.5
+- cidr: 192.168.0.0/16
+  rules:
+    nas.home: 192.168.1.5
+`)
+	for _, tc := range []struct{ client, name, want string }{
+		{"10.1.2.3", "nas.home.", "10.0.0.5"},
+		{"10.1.2.3", "anything.example.", "10.0.0.1"},
+		{"192.168.1.1", "nas.home.", "192.168.1.5"},
+		{"192.168.1.1", "anything.example.", ""},
+	} {
+		rule, _, ok := matchRule(&queryState{config: c, ip: net.ParseIP(tc.client)}, tc.name)
+		switch {
+		case tc.want == "" && ok:
+			t.Errorf("%s from %s matched %v, want no match", tc.name, tc.client, rule.IPs)
+		case tc.want != "" && (!ok || len(rule.IPs) != 1 || rule.IPs[0] != tc.want):
+			t.Errorf("%s from %s matched %v (%v), want %s", tc.name, tc.client, rule.IPs, ok, tc.want)
+		}
+	}
+}
+
+func TestAuthoritativeNetwork(t *testing.T) {
+	var asked int32
+	answer := stubAnswering("10.5.5.5")
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+		answer(w, r)
+	})
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.99.0.0/16
+  authoritative: true
+  rules:
+    vault.lab.: 10.99.0.10
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+upstream: [`+addr+`]
+matchBy: client
+`))
+	if m := query(t, "10.99.1.1", "unknown.lab.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+		t.Errorf("unknown name in the authoritative network got %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+	if m := query(t, "10.99.1.1", "vault.lab.", dns.TypeTXT); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("TXT for an A rule got %s with %d answers, want NODATA", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if got := atomic.LoadInt32(&asked); got != 0 {
+		t.Errorf("the authoritative network forwarded %d queries", got)
+	}
+	if got := answerValues(query(t, "10.1.1.1", "unknown.lab.", dns.TypeA)); len(got) != 1 || got[0] != "10.5.5.5" {
+		t.Errorf("unknown name in a normal network answered %v, want it forwarded", got)
+	}
+}
+
+func TestClientSubnetSelectsNetwork(t *testing.T) {
+	const rules = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+- cidr: 192.168.0.0/16
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+ecs: %v
+`
+	withSubnet := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("nas.home.", dns.TypeA)
+		r.SetEdns0(1232, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.168.1.77").To4()})
+		return r
+	}
+
+	useConfig(t, loadTestConfig(t, fmt.Sprintf(rules, true)))
+	m := handle(t, "10.0.0.1", withSubnet()).reply(t)
+	if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("query with a client subnet answered %v, want 192.168.1.5", got)
+	}
+	var scope uint8
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				scope = subnet.SourceScope
+			}
+		}
+	}
+	if scope != 24 {
+		t.Errorf("reply scope is /%d, want /24", scope)
+	}
+	if got := answerValues(query(t, "10.0.0.1", "nas.home.", dns.TypeA)); len(got) != 1 || got[0] != "10.0.0.5" {
+		t.Errorf("query without a client subnet answered %v, want 10.0.0.5", got)
+	}
+
+	useConfig(t, loadTestConfig(t, fmt.Sprintf(rules, false)))
+	if got := answerValues(handle(t, "10.0.0.1", withSubnet()).reply(t)); len(got) != 1 || got[0] != "10.0.0.5" {
+		t.Errorf("with ecs off the query answered %v, want 10.0.0.5", got)
+	}
+}
+
+func TestReverseLookup(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  authoritative: true
+  rules:
+    nas.home: 192.168.1.5
+    alias.home: 192.168.1.5
+    v6.home: fd00::5
+    "*.wild.home": 192.168.1.9
+matchBy: client
+recursion: false
+`)
+	tests := []struct {
+		addr  string
+		rcode int
+		want  []string
+	}{
+		{"192.168.1.5", dns.RcodeSuccess, []string{"alias.home.", "nas.home."}},
+		{"fd00::5", dns.RcodeSuccess, []string{"v6.home."}},
+		// Wildcards have no single name to point back at.
+		{"192.168.1.9", dns.RcodeNameError, []string{}},
+	}
+	for _, tt := range tests {
+		ptr, err := dns.ReverseAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := ask(t, c, "10.0.0.1", ptr, dns.TypePTR)
+		if m.Rcode != tt.rcode || !reflect.DeepEqual(answerValues(m), tt.want) {
+			t.Errorf("PTR %s = %s %v, want %s %v", tt.addr, dns.RcodeToString[m.Rcode], answerValues(m), dns.RcodeToString[tt.rcode], tt.want)
+		}
+	}
+	if m := ask(t, c, "172.16.0.1", "5.1.168.192.in-addr.arpa.", dns.TypePTR); len(m.Answer) != 0 {
+		t.Errorf("PTR answered for a client outside the network: %v", m.Answer)
+	}
+}
+
+func TestHTTPSRecords(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    web.home:
+      ip: 192.168.1.30
+      https:
+      - 1 . alpn=h3,h2 ipv4hint=192.168.1.30 ipv6hint=fd00::30
+      svcb:
+      - 2 svc.home. port=8443
+matchBy: client
+recursion: false
+`)
+	m := ask(t, c, "10.0.0.1", "web.home", dns.TypeHTTPS)
+	if len(m.Answer) != 1 {
+		t.Fatalf("HTTPS answer = %v, want one record", m.Answer)
+	}
+	https, ok := m.Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatalf("answer is a %T, want *dns.HTTPS", m.Answer[0])
+	}
+	if https.Priority != 1 || https.Target != "." || https.Hdr.Name != "web.home." {
+		t.Errorf("HTTPS = %s, want priority 1 and target . for web.home.", https)
+	}
+	params := map[string]string{}
+	for _, kv := range https.Value {
+		params[kv.Key().String()] = kv.String()
+	}
+	want := map[string]string{"alpn": "h3,h2", "ipv4hint": "192.168.1.30", "ipv6hint": "fd00::30"}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("SvcParams = %v, want %v", params, want)
+	}
+
+	if got := answerValues(ask(t, c, "10.0.0.1", "web.home", dns.TypeSVCB)); !reflect.DeepEqual(got, []string{`2 svc.home. port="8443"`}) {
+		t.Errorf("SVCB answer = %q", got)
+	}
+}
+
+func TestInvalidServiceBinding(t *testing.T) {
+	for _, value := range []string{"1", "x . alpn=h2", "1 . ipv4hint=fd00::1", "1 . bogus=1"} {
+		if _, err := buildRule(RawRule{HTTPS: []string{value}}, 60); err == nil {
+			t.Errorf("https %q accepted", value)
+		}
+	}
+}
+
+func TestSRVRecords(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    _ldap._tcp.home:
+    - {priority: 10, weight: 60, port: 389, target: ldap1.home.}
+    - {priority: 10, weight: 40, port: 389, target: ldap2.home}
+    - {priority: 20, weight: 0, port: 636, target: ldap3.home.}
+    ldap1.home: 192.168.1.41
+matchBy: client
+recursion: false
+`)
+	m := ask(t, c, "10.0.0.1", "_ldap._tcp.home", dns.TypeSRV)
+	want := []string{"10 60 389 ldap1.home.", "10 40 389 ldap2.home.", "20 0 636 ldap3.home."}
+	if got := answerValues(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("SRV answer = %q, want %q", got, want)
+	}
+	if m := ask(t, c, "10.0.0.1", "_ldap._tcp.home", dns.TypeA); len(m.Answer) != 0 {
+		t.Errorf("A query for an SRV name answered %v", m.Answer)
+	}
+}
+
+func TestMixedCaseQuery(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+    Files.Home: nas.home
+    "*.wild.home": 192.168.1.9
+matchBy: client
+recursion: false
+`)
+	dnsCache.flush()
+	tests := []struct {
+		name  string
+		owner []string
+	}{
+		{"NAS.Home.", []string{"NAS.Home."}},
+		{"nAs.hOmE.", []string{"nAs.hOmE."}},
+		{"FILES.HOME.", []string{"FILES.HOME.", "nas.home."}},
+		{"X.WILD.home.", []string{"X.WILD.home."}},
+	}
+	for _, tt := range tests {
+		m := ask(t, c, "10.0.0.1", tt.name, dns.TypeA)
+		owners := []string{}
+		for _, rr := range m.Answer {
+			owners = append(owners, rr.Header().Name)
+		}
+		if !reflect.DeepEqual(owners, tt.owner) {
+			t.Errorf("%s answered for %v, want %v", tt.name, owners, tt.owner)
+		}
+	}
+	// A different spelling is answered from the cache in its own case.
+	if m := ask(t, c, "10.0.0.1", "Nas.Home.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].Header().Name != "Nas.Home." {
+		t.Errorf("cached answer = %v, want owner Nas.Home.", m.Answer)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// runQueryCommand implements "query <name> [type]": it sends one query, by
+// default to the first listen endpoint of the config, and prints the reply
+// the way dig does. It returns the exit status.
+func runQueryCommand(args []string, defaultConfigPath string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath, "Config file to take the default server address from")
+	server := fs.String("server", "", "Server address as host or host:port (default: the first listen endpoint of the config)")
+	useTCP := fs.Bool("tcp", false, "Query over TCP even when the server listens on UDP")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for the reply")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query [flags] <name> [type]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	// Flags may come after the name and type too, as with dig.
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		fs.Usage()
+		return 2
+	}
+	qtype := dns.TypeA
+	if len(positional) == 2 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(positional[1])]; !ok {
+			fmt.Fprintf(os.Stderr, "Unknown record type %q\n", positional[1])
+			return 2
+		}
+	}
+
+	endpoint := queryEndpoint(*configPath)
+	addr := endpoint.addr()
+	if *server != "" {
+		addr = *server
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, strconv.Itoa(endpoint.Port))
+		}
+	}
+	proto := "udp"
+	if *useTCP || endpoint.Protocol == "tcp" {
+		proto = "tcp"
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(positional[0]), qtype)
+	m.SetEdns0(defaultEDNSUDPSize, false)
+	client := &dns.Client{Net: proto, Timeout: *timeout}
+	reply, rtt, err := client.Exchange(m, addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query to %s failed: %v\n", addr, err)
+		return 1
+	}
+	fmt.Print(reply.String())
+	fmt.Printf("\n;; Query time: %v\n;; SERVER: %s (%s)\n", rtt.Round(time.Microsecond), addr, proto)
+	return 0
+}
+
+// queryEndpoint is the first listen endpoint of the config at configPath,
+// with a loopback address in place of a wildcard one. A config that cannot
+// be read leaves 127.0.0.1:53.
+func queryEndpoint(configPath string) RawListen {
+	rawConfig := RawConfig{}
+	if dat, err := readConfigData(configPath); err == nil {
+		yaml.Unmarshal(dat, &rawConfig)
+	}
+	endpoint := listenEndpoints(rawConfig)[0]
+	if ip := net.ParseIP(endpoint.Address); ip == nil || ip.IsUnspecified() {
+		endpoint.Address = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			endpoint.Address = "::1"
+		}
+	}
+	return endpoint
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryCommand(t *testing.T) {
+	stub := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch q := r.Question[0]; q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.168.1.5")})
+		case dns.TypeMX:
+			m.Answer = append(m.Answer, &dns.MX{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60}, Preference: 10, Mx: "mx.home."})
+		}
+		w.WriteMsg(m)
+	})
+	_, port, _ := net.SplitHostPort(stub)
+
+	out, err := runMain(t, "query", "--server", stub, "nas.home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "192.168.1.5") || !strings.Contains(out, ";; SERVER: "+stub+" (udp)") {
+		t.Errorf("query printed:\n%s", out)
+	}
+
+	// The server comes from the config, and flags may follow the name.
+	config := writeTestFile(t, "config.yml", fmt.Sprintf("bindAddress: 0.0.0.0\nport: %s\nprotocol: udp\nnetworks: []\n", port))
+	out, err = runMain(t, "query", "mail.home", "mx", "--config", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "10 mx.home.") || !strings.Contains(out, ";; SERVER: 127.0.0.1:"+port+" (udp)") {
+		t.Errorf("query printed:\n%s", out)
+	}
+}
+
+func TestQueryCommandFails(t *testing.T) {
+	closed := strconv.Itoa(freePort(t, "127.0.0.1"))
+	tests := []struct {
+		name   string
+		args   []string
+		status string
+	}{
+		{"no name", []string{"query"}, "exit status 2"},
+		{"unknown type", []string{"query", "nas.home", "BOGUS"}, "exit status 2"},
+		{"no server", []string{"query", "--server", "127.0.0.1:" + closed, "--timeout", "200ms", "nas.home"}, "exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runMain(t, tt.args...)
+			if err == nil {
+				t.Fatalf("%v succeeded:\n%s", tt.args, out)
+			}
+			if !strings.HasPrefix(err.Error(), tt.status+":") {
+				t.Errorf("%v failed with %v, want %s", tt.args, err, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const defaultRateLimitClients = 10000
+
+type RawRateLimit struct {
+	QPS        float64 `yaml:"qps,omitempty"`
+	Burst      int     `yaml:"burst,omitempty"`
+	Action     string  `yaml:"action,omitempty"`
+	MaxClients int     `yaml:"maxClients,omitempty"`
+}
+
+// RateLimiter keeps a token bucket per client address. Only the most
+// recently seen maxClients addresses are tracked; older ones start over
+// with a full bucket when they come back.
+type RateLimiter struct {
+	mu         sync.Mutex
+	raw        RawRateLimit
+	limit      rate.Limit
+	burst      int
+	maxClients int
+	drop       bool
+	clients    map[string]*list.Element
+	order      *list.List
+}
+
+type clientBucket struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func NewRateLimiter(raw RawRateLimit) *RateLimiter {
+	burst := raw.Burst
+	if burst <= 0 {
+		burst = int(raw.QPS)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	maxClients := raw.MaxClients
+	if maxClients <= 0 {
+		maxClients = defaultRateLimitClients
+	}
+	return &RateLimiter{
+		raw:        raw,
+		limit:      rate.Limit(raw.QPS),
+		burst:      burst,
+		maxClients: maxClients,
+		drop:       raw.Action == "drop",
+		clients:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func (l *RateLimiter) allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.clients[client]; ok {
+		l.order.MoveToFront(elem)
+		return elem.Value.(*clientBucket).limiter.Allow()
+	}
+	bucket := &clientBucket{key: client, limiter: rate.NewLimiter(l.limit, l.burst)}
+	l.clients[client] = l.order.PushFront(bucket)
+	for l.order.Len() > l.maxClients {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientBucket).key)
+	}
+	return bucket.limiter.Allow()
+}
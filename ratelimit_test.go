@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimitPerClient(t *testing.T) {
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 10.0.0.5
+matchBy: client
+rateLimit:
+  qps: 0.001
+  burst: 3
+`))
+	for i := 1; i <= 3; i++ {
+		if m := query(t, "10.0.0.1", "nas.home.", dns.TypeA); m.Rcode != dns.RcodeSuccess {
+			t.Fatalf("query %d within the burst got %s", i, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if m := query(t, "10.0.0.1", "nas.home.", dns.TypeA); m.Rcode != dns.RcodeRefused {
+		t.Errorf("query past the burst got %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+	if m := query(t, "10.0.0.2", "nas.home.", dns.TypeA); m.Rcode != dns.RcodeSuccess {
+		t.Errorf("another client got %s, want NOERROR", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestRateLimiterForgetsOldestClient(t *testing.T) {
+	limiter := NewRateLimiter(RawRateLimit{QPS: 0.001, Burst: 1, MaxClients: 2})
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if !limiter.allow(client) {
+			t.Fatalf("first query from %s was limited", client)
+		}
+	}
+	if limiter.allow("10.0.0.3") {
+		t.Error("10.0.0.3 was allowed past its burst")
+	}
+	if !limiter.allow("10.0.0.1") {
+		t.Error("10.0.0.1 was still limited after being forgotten")
+	}
+}
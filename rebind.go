@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// isPrivate reports whether ip is an address that names on the Internet
+// have no business pointing at: RFC 1918, ULA, loopback, link-local or
+// unspecified.
+func isPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// privateAllowed reports whether name is in one of the privateUpstreamAllow
+// zones, whose upstream answers may contain private addresses.
+func (c Config) privateAllowed(name string) bool {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := range labels {
+		if c.PrivateUpstreamAllow[dns.Fqdn(strings.Join(labels[i:], "."))] {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPrivate drops private addresses from an upstream answer to protect
+// clients against DNS rebinding. The allow list is checked against the owner
+// of each address, so that an allowed name cannot CNAME its way to a private
+// address elsewhere. Addresses from rules never pass through here.
+func filterPrivate(q dns.Question, state *queryState, answers []dns.RR) []dns.RR {
+	if !state.config.BlockPrivateUpstream {
+		return answers
+	}
+	kept := answers[:0:0]
+	for _, rr := range answers {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+		if ip != nil && isPrivate(ip) && !state.config.privateAllowed(rr.Header().Name) {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	if dropped := len(answers) - len(kept); dropped > 0 {
+		log.Printf("[WARN] Dropped %d private address(es) from the upstream answer for %s\n", dropped, q.Name)
+		state.tracef("dropped %d private address(es) from the upstream answer", dropped)
+	}
+	return kept
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// stubRecords answers each name with the records given for it in zone file
+// syntax, which may include a CNAME and the records of its target.
+func stubRecords(t *testing.T, records map[string][]string) dns.HandlerFunc {
+	t.Helper()
+	parsed := map[string][]dns.RR{}
+	for name, lines := range records {
+		for _, line := range lines {
+			rr, err := dns.NewRR(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed[name] = append(parsed[name], rr)
+		}
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = parsed[strings.ToLower(r.Question[0].Name)]
+		w.WriteMsg(m)
+	}
+}
+
+func TestBlockPrivateUpstream(t *testing.T) {
+	upstream := startStub(t, stubRecords(t, map[string][]string{
+		"evil.example.":        {"evil.example. 60 IN A 192.168.1.1", "evil.example. 60 IN A 203.0.113.1"},
+		"loopback.example.":    {"loopback.example. 60 IN A 127.0.0.1"},
+		"v6.example.":          {"v6.example. 60 IN AAAA fd00::1"},
+		"nas.corp.internal.":   {"nas.corp.internal. 60 IN A 10.0.0.5"},
+		"alias.corp.internal.": {"alias.corp.internal. 60 IN CNAME target.example.", "target.example. 60 IN A 10.0.0.6"},
+		"www.example.":         {"www.example. 60 IN CNAME db.corp.internal.", "db.corp.internal. 60 IN A 10.0.0.7"},
+	}))
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+upstream: [`+upstream+`]
+blockPrivateUpstream: true
+privateUpstreamAllow: [corp.internal]
+`)
+	useConfig(t, c)
+	captureLog(t)
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"evil.example.", dns.TypeA, []string{"203.0.113.1"}},
+		{"loopback.example.", dns.TypeA, []string{}},
+		{"v6.example.", dns.TypeAAAA, []string{}},
+		{"nas.corp.internal.", dns.TypeA, []string{"10.0.0.5"}},
+		// The address belongs to target.example., which is not allowed.
+		{"alias.corp.internal.", dns.TypeA, []string{"target.example."}},
+		// The address belongs to an allowed name, whoever points at it.
+		{"www.example.", dns.TypeA, []string{"db.corp.internal.", "10.0.0.7"}},
+		{"nas.home.", dns.TypeA, []string{"192.168.1.5"}},
+	}
+	for _, tt := range tests {
+		if got := answerValues(ask(t, c, "10.0.0.1", tt.name, tt.qtype)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
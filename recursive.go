@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxReferrals      = 16
+	maxRecursionDepth = 8
+)
+
+var defaultRootServers = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+// recursiveResolver walks the delegation chain from the root servers down
+// to the authoritative servers of a name. It remembers the delegations it
+// learns so that later names in the same zone skip the walk from the top.
+// Nameservers are only reached over IPv4.
+type recursiveResolver struct {
+	client *dns.Client
+	roots  []string
+
+	mu    sync.Mutex
+	zones map[string]delegation
+}
+
+func newRecursiveResolver(roots []string, timeout time.Duration) *recursiveResolver {
+	if len(roots) == 0 {
+		roots = defaultRootServers
+	}
+	if timeout == 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	addrs := make([]string, len(roots))
+	for i, root := range roots {
+		addrs[i] = withDefaultPort(root, "53")
+	}
+	return &recursiveResolver{
+		client: &dns.Client{Net: "udp", Timeout: timeout},
+		roots:  addrs,
+		zones:  map[string]delegation{},
+	}
+}
+
+func (r *recursiveResolver) String() string {
+	return "recursive"
+}
+
+func (r *recursiveResolver) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	resp, err := r.resolve(ctx, dns.Fqdn(q.Name), q.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.SetRcode(req, resp.Rcode)
+	resp.RecursionAvailable = true
+	return resp, nil
+}
+
+// closest returns the deepest known zone above name and its servers.
+func (r *recursiveResolver) closest(name string) (string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		if d, ok := r.zones[zone]; ok {
+			if now.Before(d.expires) {
+				return zone, d.servers
+			}
+			delete(r.zones, zone)
+		}
+	}
+	return ".", r.roots
+}
+
+func (r *recursiveResolver) remember(zone string, servers []string, ttl uint32) {
+	r.mu.Lock()
+	r.zones[zone] = delegation{servers: servers, expires: expiry(ttl)}
+	r.mu.Unlock()
+}
+
+func (r *recursiveResolver) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, fmt.Errorf("Recursion for %s exceeds %d levels", name, maxRecursionDepth)
+	}
+	zone, servers := r.closest(name)
+	for i := 0; i < maxReferrals; i++ {
+		resp, err := r.query(ctx, servers, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return resp, nil
+		}
+		if len(resp.Answer) > 0 {
+			return r.followCNAME(ctx, resp, name, qtype, depth)
+		}
+		child, nsNames, ttl := referral(resp, zone, name)
+		if child == "" {
+			// NODATA: the name exists but has no records of this type.
+			return resp, nil
+		}
+		addrs := glue(resp, nsNames)
+		for _, ns := range nsNames {
+			if len(addrs) > 0 {
+				break
+			}
+			nsResp, err := r.resolve(ctx, ns, dns.TypeA, depth+1)
+			if err != nil {
+				continue
+			}
+			for _, rr := range nsResp.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					addrs = append(addrs, withDefaultPort(a.A.String(), "53"))
+				}
+			}
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("No address for the nameservers of %s", child)
+		}
+		r.remember(child, addrs, ttl)
+		zone, servers = child, addrs
+	}
+	return nil, fmt.Errorf("Too many referrals resolving %s", name)
+}
+
+// followCNAME returns resp as is when it answers the question, and chases
+// the last CNAME target otherwise.
+func (r *recursiveResolver) followCNAME(ctx context.Context, resp *dns.Msg, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if qtype == dns.TypeCNAME || hasType(resp.Answer, qtype) {
+		return resp, nil
+	}
+	target := ""
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target = cname.Target
+		}
+	}
+	if target == "" || strings.EqualFold(target, name) {
+		return resp, nil
+	}
+	next, err := r.resolve(ctx, target, qtype, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	next.Answer = append(resp.Answer, next.Answer...)
+	return next, nil
+}
+
+// referral finds a delegation to a zone below zone that contains name in
+// the authority section of resp.
+func referral(resp *dns.Msg, zone, name string) (string, []string, uint32) {
+	child := ""
+	nsNames := []string{}
+	var ttl uint32
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == strings.ToLower(zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child == "" {
+			child, ttl = owner, ns.Hdr.Ttl
+		}
+		if owner == child {
+			nsNames = append(nsNames, ns.Ns)
+			if ns.Hdr.Ttl < ttl {
+				ttl = ns.Hdr.Ttl
+			}
+		}
+	}
+	return child, nsNames, ttl
+}
+
+func glue(resp *dns.Msg, nsNames []string) []string {
+	addrs := []string{}
+	for _, rr := range resp.Extra {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		for _, ns := range nsNames {
+			if strings.EqualFold(a.Hdr.Name, ns) {
+				addrs = append(addrs, withDefaultPort(a.A.String(), "53"))
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// query asks each server in turn without recursion, repeating over TCP when
+// a UDP reply comes back truncated.
+func (r *recursiveResolver) query(ctx context.Context, servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(1232, false)
+	var lastErr error
+	for _, server := range servers {
+		resp, _, err := r.client.ExchangeContext(ctx, req, server)
+		if err == nil && resp.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: r.client.Timeout}
+			resp, _, err = tcp.ExchangeContext(ctx, req, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s answered %s for %s", server, dns.RcodeToString[resp.Rcode], name)
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("No nameserver to ask for %s", name)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeNameserver answers from records, given in zone file syntax, the way an
+// authoritative server without recursion does: records owned by the name,
+// else the NS records of the closest delegation below it with their glue,
+// else NXDOMAIN.
+func fakeNameserver(t *testing.T, records ...string) dns.HandlerFunc {
+	rrs := []dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Header().Name, q.Name) && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if len(m.Answer) == 0 {
+			for _, rr := range rrs {
+				if ns, ok := rr.(*dns.NS); ok && dns.IsSubDomain(ns.Hdr.Name, q.Name) {
+					m.Authoritative = false
+					m.Ns = append(m.Ns, ns)
+					for _, glue := range rrs {
+						if a, ok := glue.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, ns.Ns) {
+							m.Extra = append(m.Extra, a)
+						}
+					}
+				}
+			}
+		}
+		if len(m.Answer) == 0 && len(m.Ns) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	root := startStubAt(t, "127.0.10.1:53", fakeNameserver(t,
+		"test. 3600 IN NS ns.tld.",
+		"ns.tld. 3600 IN A 127.0.10.2",
+	))
+	startStubAt(t, "127.0.10.2:53", fakeNameserver(t,
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 127.0.10.3",
+		// No glue: the resolver has to look the nameserver up itself.
+		"other.test. 3600 IN NS ns.example.test.",
+	))
+	startStubAt(t, "127.0.10.3:53", fakeNameserver(t,
+		"www.example.test. 300 IN A 10.9.9.9",
+		"alias.example.test. 300 IN CNAME www.other.test.",
+		"www.other.test. 300 IN A 10.8.8.8",
+		"ns.example.test. 300 IN A 127.0.10.3",
+	))
+	resolver := newRecursiveResolver([]string{root}, 0)
+
+	tests := []struct {
+		name  string
+		rcode int
+		want  []string
+	}{
+		{"www.example.test.", dns.RcodeSuccess, []string{"10.9.9.9"}},
+		{"www.other.test.", dns.RcodeSuccess, []string{"10.8.8.8"}},
+		{"alias.example.test.", dns.RcodeSuccess, []string{"www.other.test.", "10.8.8.8"}},
+		{"missing.example.test.", dns.RcodeNameError, []string{}},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeA)
+		resp, err := resolver.Exchange(context.Background(), req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.Rcode != tt.rcode || !reflect.DeepEqual(answerValues(resp), tt.want) {
+			t.Errorf("%s = %s %v, want %s %v", tt.name, dns.RcodeToString[resp.Rcode], answerValues(resp), dns.RcodeToString[tt.rcode], tt.want)
+		}
+	}
+	if zone, _ := resolver.closest("new.example.test."); zone != "example.test." {
+		t.Errorf("closest known zone of new.example.test. = %s, want the remembered example.test.", zone)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// RegexRule answers for every name its pattern matches. Names are matched in
+// lower case with their trailing dot, as in ^db-\d+\.internal\.$.
+type RegexRule struct {
+	Pattern *regexp.Regexp
+	Rule    Rule
+}
+
+// buildRegexRules compiles the regexRules of a network. They are tried in
+// the sort order of their patterns, so that the first of several matching
+// patterns wins the same way on every load.
+func buildRegexRules(raw map[string]RawRule, ttl uint32) ([]RegexRule, error) {
+	patterns := make([]string, 0, len(raw))
+	for pattern := range raw {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	var regexRules []RegexRule
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %v", pattern, err)
+		}
+		rule, err := buildRule(raw[pattern], ttl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule for %q: %v", pattern, err)
+		}
+		regexRules = append(regexRules, RegexRule{Pattern: re, Rule: rule})
+	}
+	return regexRules, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRegexRules(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    db-7.internal: 192.168.2.70
+  regexRules:
+    ^db-\d+\.internal\.$: 192.168.2.1
+    ^db-\w.*$: 192.168.2.2
+matchBy: client
+recursion: false
+`)
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"db-12.internal", []string{"192.168.2.1"}},
+		// Names are matched in lower case.
+		{"DB-3.Internal", []string{"192.168.2.1"}},
+		// The exact rule comes before any pattern.
+		{"db-7.internal", []string{"192.168.2.70"}},
+		// ^db-\w.*$ sorts after the first pattern and only catches the rest.
+		{"db-x.internal", []string{"192.168.2.2"}},
+		{"web.internal", nil},
+		{"db-12.internal.example", []string{"192.168.2.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := ask(t, c, "10.0.0.1", tt.name, dns.TypeA)
+			got := answerValues(m)
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("answer = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidRegexRule(t *testing.T) {
+	path := writeTestFile(t, "config.yml", `
+networks:
+- cidr: 10.0.0.0/8
+  regexRules:
+    ^db-(\d+\.internal\.$: 192.168.2.1
+matchBy: client
+`)
+	if _, _, err := loadConfig(path, true, loadCheck); err == nil {
+		t.Error("loaded a config with an invalid pattern")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clock is the time source schedules are checked against.
+var clock = time.Now
+
+// RawSchedule limits a rule to a daily window between two clock times in
+// the configured timezone. A window whose end is before its start runs past
+// midnight, and days name the days on which the window starts.
+type RawSchedule struct {
+	From string   `yaml:"from"`
+	To   string   `yaml:"to"`
+	Days []string `yaml:"days,omitempty"`
+}
+
+type Schedule struct {
+	from, to int // minutes after midnight
+	days     [7]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseSchedule(raw *RawSchedule) (*Schedule, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	from, err := parseClock(raw.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseClock(raw.To)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{from: from, to: to}
+	for _, day := range raw.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("Invalid day %q, expected one of sun, mon, tue, wed, thu, fri or sat", day)
+		}
+		s.days[weekday] = true
+	}
+	if len(raw.Days) == 0 {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	}
+	return s, nil
+}
+
+// active reports whether the rule applies at now. A nil schedule always
+// does. Equal from and to make the window last the whole day.
+func (s *Schedule) active(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case s.from < s.to:
+		return s.days[today] && minute >= s.from && minute < s.to
+	case s.from > s.to:
+		return s.days[today] && minute >= s.from || s.days[yesterday] && minute < s.to
+	}
+	return s.days[today]
+}
+
+// untilChange returns how long the rule keeps its current state, so that
+// answers depending on it are not cached past the next switch.
+func (s *Schedule) untilChange(now time.Time) time.Duration {
+	current := s.active(now)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for day := 0; day <= 8; day++ {
+		date := midnight.AddDate(0, 0, day)
+		boundaries := []int{s.from, s.to}
+		if s.to < s.from {
+			boundaries = []int{s.to, s.from}
+		}
+		for _, minute := range boundaries {
+			t := date.Add(time.Duration(minute) * time.Minute)
+			if t.After(now) && s.active(t) != current {
+				return t.Sub(now)
+			}
+		}
+	}
+	return 0
+}
+
+func (s *Schedule) String() string {
+	days := []string{}
+	for _, name := range []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} {
+		if s.days[weekdays[name]] {
+			days = append(days, name)
+		}
+	}
+	window := fmt.Sprintf("%02d:%02d-%02d:%02d", s.from/60, s.from%60, s.to/60, s.to%60)
+	if len(days) == 7 {
+		return window
+	}
+	return window + " " + strings.Join(days, ",")
+}
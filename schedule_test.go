@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setClock fixes the time schedules are checked against for the rest of the
+// test.
+func setClock(t *testing.T, now time.Time) {
+	t.Helper()
+	previous := clock
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = previous })
+}
+
+func TestScheduledRule(t *testing.T) {
+	seoul, err := time.LoadLocation("Asia/Seoul")
+	if err != nil {
+		t.Skip(err)
+	}
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    portal.home:
+      ip: 192.168.1.99
+      ttl: 86400
+      schedule:
+        from: "23:00"
+        to: "05:00"
+        days: [sat, sun]
+    "*.home": 192.168.1.1
+matchBy: client
+recursion: false
+timezone: Asia/Seoul
+`)
+	// 2024-06-01 was a Saturday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.June, day, hour, minute, 0, 0, seoul)
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+		// The TTL is capped at the time until the rule switches.
+		ttl uint32
+	}{
+		{"saturday night", at(1, 23, 30), "192.168.1.99", 5*3600 + 30*60},
+		{"window runs past midnight", at(2, 4, 59), "192.168.1.99", 60},
+		{"window ends", at(2, 5, 0), "192.168.1.1", defaultTTL},
+		{"sunday night into monday", at(3, 0, 30), "192.168.1.99", 4*3600 + 30*60},
+		{"monday night", at(3, 23, 30), "192.168.1.1", defaultTTL},
+		{"friday noon", at(7, 12, 0), "192.168.1.1", defaultTTL},
+		// The clock is in UTC; the window is in the configured timezone.
+		{"saturday night in UTC", at(1, 23, 30).UTC(), "192.168.1.99", 5*3600 + 30*60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClock(t, tt.now)
+			dnsCache.flush()
+			m := ask(t, c, "10.0.0.1", "portal.home", dns.TypeA)
+			if got := answerValues(m); len(got) != 1 || got[0] != tt.want {
+				t.Fatalf("answer = %v, want %s", got, tt.want)
+			}
+			if ttl := m.Answer[0].Header().Ttl; ttl != tt.ttl {
+				t.Errorf("TTL = %d, want %d", ttl, tt.ttl)
+			}
+		})
+	}
+}
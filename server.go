@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RawListen is one address the server listens on. An empty address means
+// all interfaces.
+type RawListen struct {
+	Address  string `yaml:"address,omitempty"`
+	Port     int    `yaml:"port"`
+	Protocol string `yaml:"protocol"`
+}
+
+// UnmarshalYAML also accepts "address:port", served over both protocols.
+func (l *RawListen) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		*l, err = parseListen(short)
+		return err
+	}
+	type plain RawListen
+	return unmarshal((*plain)(l))
+}
+
+func parseListen(short string) (RawListen, error) {
+	host, port, err := net.SplitHostPort(short)
+	if err != nil {
+		return RawListen{}, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return RawListen{}, fmt.Errorf("Invalid port in %q", short)
+	}
+	return RawListen{Address: host, Port: portNum}, nil
+}
+
+func (l RawListen) addr() string {
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+// listenEndpoints returns the listen list, or the single endpoint given by
+// bindAddress, port and protocol. Endpoints without a port or protocol take
+// the top-level ones, which default to 53 and both.
+func listenEndpoints(rawConfig RawConfig) []RawListen {
+	port, proto := 53, "both"
+	if rawConfig.Port != 0 {
+		port = rawConfig.Port
+	}
+	if rawConfig.Proto != "" {
+		proto = rawConfig.Proto
+	}
+	endpoints := rawConfig.Listen
+	if len(endpoints) == 0 {
+		endpoints = []RawListen{{Address: rawConfig.BindAddress}}
+	}
+	out := make([]RawListen, len(endpoints))
+	for i, endpoint := range endpoints {
+		if endpoint.Port == 0 {
+			endpoint.Port = port
+		}
+		if endpoint.Protocol == "" {
+			endpoint.Protocol = proto
+		}
+		out[i] = endpoint
+	}
+	return out
+}
+
+func newServers(addr, proto string) []*dns.Server {
+	if proto == "both" {
+		return []*dns.Server{
+			{Addr: addr, Net: "udp"},
+			{Addr: addr, Net: "tcp"},
+		}
+	}
+	return []*dns.Server{{Addr: addr, Net: proto}}
+}
+
+func shutdownServers(ctx context.Context, servers []*dns.Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *dns.Server) {
+			defer wg.Done()
+			if err := server.ShutdownContext(ctx); err != nil {
+				log.Printf("Failed to shut down %s listener: %v\n", server.Net, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// limitTCP applies tcpMaxConnections and tcpIdleTimeout to the TCP servers.
+// Their listeners are opened here so that they can be wrapped.
+func limitTCP(servers []*dns.Server, maxConns int, idleTimeout time.Duration) error {
+	for _, server := range servers {
+		if server.Net != "tcp" {
+			continue
+		}
+		if idleTimeout > 0 {
+			server.IdleTimeout = func() time.Duration { return idleTimeout }
+		}
+		if maxConns <= 0 {
+			continue
+		}
+		if server.Listener == nil {
+			l, err := net.Listen("tcp", server.Addr)
+			if err != nil {
+				return err
+			}
+			server.Listener = l
+		}
+		server.Listener = &limitListener{Listener: server.Listener, slots: make(chan struct{}, maxConns)}
+	}
+	return nil
+}
+
+// limitListener closes connections beyond the number of slots right after
+// accepting them.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+		default:
+			tcpConnectionsRejected.Inc()
+			conn.Close()
+		}
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// queryQueueTimeout is the longest a query waits for a slot of a full
+// queryLimiter before it is dropped; the client has retried by then.
+const queryQueueTimeout = 2 * time.Second
+
+// queryLimiter bounds the queries handled at once to maxConcurrentQueries.
+// Up to queueSize more wait for a slot; the rest are dropped right away, so
+// the goroutines miekg/dns starts per packet end instead of piling up.
+type queryLimiter struct {
+	slots     chan struct{}
+	waiting   int64
+	queueSize int64
+}
+
+func newQueryLimiter(maxConcurrent, queueSize int) *queryLimiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &queryLimiter{slots: make(chan struct{}, maxConcurrent), queueSize: int64(queueSize)}
+}
+
+// sameSize reports whether l already has the given limits, so that a reload
+// can keep it along with the queries holding its slots.
+func (l *queryLimiter) sameSize(maxConcurrent, queueSize int) bool {
+	return l != nil && cap(l.slots) == maxConcurrent && l.queueSize == int64(queueSize)
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it, and
+// reports false when the query should be dropped.
+func (l *queryLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt64(&l.waiting, 1) > l.queueSize {
+		atomic.AddInt64(&l.waiting, -1)
+		queriesDropped.Inc()
+		return false
+	}
+	defer atomic.AddInt64(&l.waiting, -1)
+	timer := time.NewTimer(queryQueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		queriesDropped.Inc()
+		return false
+	}
+}
+
+func (l *queryLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// queueSize defaults to maxConcurrentQueries.
+func (rawConfig RawConfig) queueSize() int {
+	if rawConfig.QueueSize == nil {
+		return rawConfig.MaxConcurrent
+	}
+	return *rawConfig.QueueSize
+}
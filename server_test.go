@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// tcpQuery sends a query over conn and reports whether an answer came back.
+func tcpQuery(conn *dns.Conn) bool {
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.WriteMsg(r); err != nil {
+		return false
+	}
+	_, err := conn.ReadMsg()
+	return err == nil
+}
+
+func TestUDPAndTCPAnswerAlike(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(`networks:
+- cidr: 127.0.0.0/8
+  rules:
+    nas.home: [192.168.1.5, 192.168.1.6]
+matchBy: client
+port: %d
+`, port))
+	startMain(t, "--config", path)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	udp := answerValues(exchangeUntilAnswered(t, "udp", addr, "nas.home."))
+	tcp := answerValues(exchangeUntilAnswered(t, "tcp", addr, "nas.home."))
+	if len(udp) != 2 || !reflect.DeepEqual(udp, tcp) {
+		t.Errorf("UDP answered %v and TCP %v", udp, tcp)
+	}
+}
+
+func TestOversizedUDPAnswerIsTruncated(t *testing.T) {
+	addrs := []string{}
+	for i := 1; i <= 60; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i))
+	}
+	port := freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", fmt.Sprintf(`networks:
+- cidr: 127.0.0.0/8
+  rules:
+    many.home: [%s]
+matchBy: client
+port: %d
+`, strings.Join(addrs, ", "), port))
+	startMain(t, "--config", path)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	udp := exchangeUntilAnswered(t, "udp", addr, "many.home.")
+	if !udp.Truncated || len(udp.Answer) >= len(addrs) {
+		t.Errorf("UDP reply has TC %v and %d answers, want it truncated", udp.Truncated, len(udp.Answer))
+	}
+	tcp := exchangeUntilAnswered(t, "tcp", addr, "many.home.")
+	if tcp.Truncated || !reflect.DeepEqual(answerValues(tcp), addrs) {
+		t.Errorf("TCP reply has TC %v and answers %v, want all %d", tcp.Truncated, answerValues(tcp), len(addrs))
+	}
+}
+
+func TestTCPMaxConnections(t *testing.T) {
+	servers := newServers("127.0.0.1:0", "tcp")
+	if err := limitTCP(servers, 2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	server := servers[0]
+	started := make(chan struct{})
+	server.Handler = stubAnswering("192.168.1.5")
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+	addr := server.Listener.Addr().String()
+
+	dial := func() *dns.Conn {
+		t.Helper()
+		conn, err := dns.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	first, second := dial(), dial()
+	defer second.Close()
+	if !tcpQuery(first) || !tcpQuery(second) {
+		t.Fatal("connections within the limit not answered")
+	}
+	extra := dial()
+	if tcpQuery(extra) {
+		t.Error("connection beyond the limit answered")
+	}
+	extra.Close()
+
+	// Closing a connection frees its slot.
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		again := dial()
+		ok := tcpQuery(again)
+		again.Close()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot of a closed connection not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	servers := newServers("127.0.0.1:0", "both")
+	if err := limitTCP(servers, 0, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if servers[0].IdleTimeout != nil {
+		t.Error("idle timeout set on the UDP server")
+	}
+	if servers[1].IdleTimeout == nil || servers[1].IdleTimeout() != 50*time.Millisecond {
+		t.Error("idle timeout not set on the TCP server")
+	}
+	if servers[1].Listener != nil {
+		t.Error("TCP listener opened without tcpMaxConnections")
+	}
+}
+
+const listenTestRules = `
+networks:
+- cidr: 127.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+recursion: false
+`
+
+func TestBindAddress(t *testing.T) {
+	if conn, err := net.ListenPacket("udp", "127.0.0.2:0"); err != nil {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	} else {
+		conn.Close()
+	}
+	port := freePort(t, "127.0.0.2")
+	path := writeTestFile(t, "config.yml", listenTestRules+fmt.Sprintf("bindAddress: 127.0.0.2\nport: %d\n", port))
+	startMain(t, "--config", path)
+
+	for _, proto := range []string{"udp", "tcp"} {
+		m := exchangeUntilAnswered(t, proto, fmt.Sprintf("127.0.0.2:%d", port), "nas.home.")
+		if len(m.Answer) != 1 {
+			t.Errorf("%s answer = %v", proto, m.Answer)
+		}
+	}
+	// The port is free on the other loopback addresses.
+	for _, proto := range []string{"udp", "tcp"} {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		var err error
+		if proto == "udp" {
+			var conn net.PacketConn
+			if conn, err = net.ListenPacket(proto, addr); err == nil {
+				conn.Close()
+			}
+		} else {
+			var l net.Listener
+			if l, err = net.Listen(proto, addr); err == nil {
+				l.Close()
+			}
+		}
+		if err != nil {
+			t.Errorf("server also bound %s over %s: %v", addr, proto, err)
+		}
+	}
+}
+
+func TestListenOnTwoPorts(t *testing.T) {
+	udpPort, tcpPort := freePort(t, "127.0.0.1"), freePort(t, "127.0.0.1")
+	path := writeTestFile(t, "config.yml", listenTestRules+fmt.Sprintf(`listen:
+- 127.0.0.1:%d
+- {address: 127.0.0.1, port: %d, protocol: tcp}
+`, udpPort, tcpPort))
+	startMain(t, "--config", path)
+
+	for _, endpoint := range []struct {
+		proto string
+		port  int
+	}{{"udp", udpPort}, {"tcp", udpPort}, {"tcp", tcpPort}} {
+		m := exchangeUntilAnswered(t, endpoint.proto, fmt.Sprintf("127.0.0.1:%d", endpoint.port), "nas.home.")
+		if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+			t.Errorf("%s port %d answered %v", endpoint.proto, endpoint.port, got)
+		}
+	}
+	// The second endpoint only listens over TCP.
+	client := &dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	if _, _, err := client.Exchange(r, fmt.Sprintf("127.0.0.1:%d", tcpPort)); err == nil {
+		t.Errorf("UDP query answered on the TCP-only port %d", tcpPort)
+	}
+}
+
+func TestQueryLimiterSaturated(t *testing.T) {
+	limiter := newQueryLimiter(2, 1)
+	for i := 0; i < 2; i++ {
+		if !limiter.acquire() {
+			t.Fatalf("slot %d refused while free", i+1)
+		}
+	}
+	// The third query waits in the queue for a slot.
+	queued := make(chan bool)
+	go func() { queued <- limiter.acquire() }()
+	for atomic.LoadInt64(&limiter.waiting) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// The queue is full, so the fourth is dropped without waiting.
+	dropped := testutil.ToFloat64(queriesDropped)
+	start := time.Now()
+	if limiter.acquire() {
+		t.Fatal("query beyond the queue got a slot")
+	}
+	if elapsed := time.Since(start); elapsed > queryQueueTimeout/2 {
+		t.Errorf("dropping took %v, want no wait", elapsed)
+	}
+	if got := testutil.ToFloat64(queriesDropped) - dropped; got != 1 {
+		t.Errorf("dropped queries grew by %v, want 1", got)
+	}
+
+	limiter.release()
+	select {
+	case ok := <-queued:
+		if !ok {
+			t.Fatal("queued query was dropped after a slot freed")
+		}
+	case <-time.After(queryQueueTimeout):
+		t.Fatal("queued query did not get the freed slot")
+	}
+
+	// With every slot still taken, a queued query gives up after the
+	// queue timeout.
+	start = time.Now()
+	if limiter.acquire() {
+		t.Fatal("query got a slot while all were taken")
+	}
+	if elapsed := time.Since(start); elapsed < queryQueueTimeout {
+		t.Errorf("queued query gave up after %v, want %v", elapsed, queryQueueTimeout)
+	}
+}
+
+func TestSaturatedPoolDropsQueries(t *testing.T) {
+	c := loadTestConfig(t, listenTestRules+"maxConcurrentQueries: 1\nqueueSize: 0\n")
+	useConfig(t, c)
+	if !c.QueryPool.acquire() {
+		t.Fatal("free slot refused")
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	if w := handle(t, "127.0.0.1", r); w.packed != nil {
+		t.Error("answered a query while the pool was saturated")
+	}
+	c.QueryPool.release()
+	if m := handle(t, "127.0.0.1", r).reply(t); m == nil || len(m.Answer) != 1 {
+		t.Errorf("reply = %v once a slot freed, want one answer", m)
+	}
+}
+
+func TestReloadKeepsQueryPool(t *testing.T) {
+	path := writeTestFile(t, "config.yml", listenTestRules+"maxConcurrentQueries: 2\n")
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+
+	reloaded, _, err := loadConfig(path, true, loadReload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.QueryPool != c.QueryPool {
+		t.Error("reload with the same limits replaced the pool")
+	}
+	if err := os.WriteFile(path, []byte(listenTestRules+"maxConcurrentQueries: 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _, err = loadConfig(path, true, loadReload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.QueryPool == c.QueryPool || cap(reloaded.QueryPool.slots) != 4 {
+		t.Errorf("reload to 4 slots kept a pool of %d", cap(reloaded.QueryPool.slots))
+	}
+}
+
+func TestQueueSizeDefault(t *testing.T) {
+	zero := 0
+	for _, tt := range []struct {
+		rawConfig RawConfig
+		want      int
+	}{
+		{RawConfig{MaxConcurrent: 64}, 64},
+		{RawConfig{MaxConcurrent: 64, QueueSize: &zero}, 0},
+	} {
+		if got := tt.rawConfig.queueSize(); got != tt.want {
+			t.Errorf("queueSize of %+v = %d, want %d", tt.rawConfig, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RawSOA makes an authoritative network answer SOA and NS queries for the
+// zone apex. Without a serial, the time of loading is used; the serial goes
+// up by one on every reload either way.
+type RawSOA struct {
+	Zone    string `yaml:"zone"`
+	MName   string `yaml:"mname"`
+	RName   string `yaml:"rname"`
+	Serial  uint32 `yaml:"serial,omitempty"`
+	Refresh uint32 `yaml:"refresh,omitempty"`
+	Retry   uint32 `yaml:"retry,omitempty"`
+	Expire  uint32 `yaml:"expire,omitempty"`
+	Minimum uint32 `yaml:"minimum,omitempty"`
+}
+
+// Zone is the apex of an authoritative network.
+type Zone struct {
+	Name string
+	SOA  dns.SOA
+	NS   []string
+}
+
+func buildZone(raw *RawSOA, ns []string, ttl uint32) *Zone {
+	if raw == nil {
+		return nil
+	}
+	name := dns.Fqdn(strings.ToLower(raw.Zone))
+	defaults := func(value, fallback uint32) uint32 {
+		if value == 0 {
+			return fallback
+		}
+		return value
+	}
+	soa := dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      dns.Fqdn(raw.MName),
+		Mbox:    dns.Fqdn(raw.RName),
+		Serial:  defaults(raw.Serial, uint32(time.Now().Unix())),
+		Refresh: defaults(raw.Refresh, 3600),
+		Retry:   defaults(raw.Retry, 600),
+		Expire:  defaults(raw.Expire, 604800),
+		Minttl:  defaults(raw.Minimum, defaultNegativeTTL),
+	}
+	zone := &Zone{Name: name, SOA: soa}
+	for _, server := range ns {
+		zone.NS = append(zone.NS, dns.Fqdn(server))
+	}
+	return zone
+}
+
+// records returns the SOA or NS records of the zone, owned by name.
+func (zone *Zone) records(name string, qtype uint16, generation uint32) []dns.RR {
+	if qtype == dns.TypeSOA {
+		soa := zone.SOA
+		soa.Hdr.Name = name
+		soa.Serial += generation
+		return []dns.RR{&soa}
+	}
+	rrs := []dns.RR{}
+	for _, server := range zone.NS {
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zone.SOA.Hdr.Ttl}
+		rrs = append(rrs, &dns.NS{Hdr: hdr, Ns: server})
+	}
+	return rrs
+}
+
+// negative returns the SOA for the authority section of a negative answer,
+// with the TTL lowered to the minimum as RFC 2308 asks.
+func (zone *Zone) negative(generation uint32) []dns.RR {
+	rrs := zone.records(zone.Name, dns.TypeSOA, generation)
+	soa := rrs[0].(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return rrs
+}
+
+// zoneOf returns the zone containing name of the most specific network
+// containing ip that has one.
+func zoneOf(config Config, ip net.IP, name string) *Zone {
+	name = strings.ToLower(name)
+	for _, network := range matchNetworks(config, ip) {
+		if zone := network.Zone; zone != nil && dns.IsSubDomain(zone.Name, name) {
+			return zone
+		}
+	}
+	return nil
+}
+
+// apexAnswer answers SOA and NS queries for the apex of the zone of the
+// most specific network containing ip that has one.
+func apexAnswer(config Config, ip net.IP, q dns.Question) ([]dns.RR, string, bool) {
+	for _, network := range matchNetworks(config, ip) {
+		if network.Zone != nil && strings.EqualFold(network.Zone.Name, q.Name) {
+			return network.Zone.records(q.Name, q.Qtype, config.Generation), network.Name, true
+		}
+	}
+	return nil, "", false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const soaTestConfig = `
+networks:
+- cidr: 10.0.0.0/8
+  authoritative: true
+  soa:
+    zone: lab.home.
+    mname: ns1.lab.home.
+    rname: hostmaster.lab.home.
+    serial: 2024010100
+    minimum: 60
+  ns: [ns1.lab.home., ns2.lab.home.]
+  rules:
+    nas.lab.home: 192.168.1.5
+    nas.other.home: 192.168.1.6
+matchBy: client
+defaultTtl: 300
+`
+
+func TestZoneApex(t *testing.T) {
+	c := loadTestConfig(t, soaTestConfig)
+	c.Generation = 2
+	useConfig(t, c)
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		return handle(t, "10.0.0.1", r).reply(t)
+	}
+
+	m := query("lab.home.", dns.TypeSOA)
+	if got, want := answerValues(m), []string{"ns1.lab.home. hostmaster.lab.home. 2024010102 3600 600 604800 60"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SOA = %v, want %v with the serial raised by the generation", got, want)
+	}
+	m = query("LAB.home.", dns.TypeNS)
+	if got, want := answerValues(m), []string{"ns1.lab.home.", "ns2.lab.home."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NS = %v, want %v", got, want)
+	}
+	if len(m.Answer) > 0 && m.Answer[0].Header().Name != "LAB.home." {
+		t.Errorf("NS owner = %s, want the spelling of the query", m.Answer[0].Header().Name)
+	}
+}
+
+func TestNegativeAnswerAuthority(t *testing.T) {
+	useConfig(t, loadTestConfig(t, soaTestConfig))
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		soa   bool
+	}{
+		// NODATA: the name exists without records of the type.
+		{"nas.lab.home.", dns.TypeAAAA, dns.RcodeSuccess, true},
+		{"lab.home.", dns.TypeA, dns.RcodeSuccess, true},
+		{"missing.lab.home.", dns.TypeA, dns.RcodeNameError, true},
+		// Outside the zone there is no SOA to point at.
+		{"missing.other.home.", dns.TypeA, dns.RcodeNameError, false},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qtype)
+		m := handle(t, "10.0.0.1", r).reply(t)
+		if m.Rcode != tt.rcode || len(m.Answer) != 0 {
+			t.Errorf("%s %s = %s %v, want %s without answers", tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[m.Rcode], m.Answer, dns.RcodeToString[tt.rcode])
+			continue
+		}
+		if !tt.soa {
+			if len(m.Ns) != 0 {
+				t.Errorf("%s: authority %v, want none", tt.name, m.Ns)
+			}
+			continue
+		}
+		if len(m.Ns) != 1 {
+			t.Errorf("%s: authority %v, want the SOA", tt.name, m.Ns)
+			continue
+		}
+		soa, ok := m.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != "lab.home." || soa.Hdr.Ttl != 60 {
+			t.Errorf("%s: authority %v, want the SOA of lab.home. with the minimum TTL", tt.name, m.Ns[0])
+		}
+	}
+}
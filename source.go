@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RuleSource keeps networks and their rules outside the config file. The
+// networks are read once per (re)load; rules are looked up per query.
+type RuleSource interface {
+	Networks(defaultTTL uint32) ([]Network, error)
+	Lookup(networkID int64, name string) (Rule, bool, error)
+	Close() error
+}
+
+func openRuleSource(backend, dsn string) (RuleSource, error) {
+	switch backend {
+	case "sqlite":
+		return openSQLiteSource(dsn)
+	}
+	return nil, fmt.Errorf("Unknown backend %q", backend)
+}
+
+// lookupSource asks the backend for name, then for the closest "*."
+// wildcard, the same way lookup does for rules from the config file.
+func (network Network) lookupSource(name string) (Rule, bool) {
+	candidates := []string{name}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		candidates = append(candidates, "*."+dns.Fqdn(strings.Join(labels[i:], ".")))
+	}
+	for _, candidate := range candidates {
+		rule, ok, err := network.source.Lookup(network.sourceID, candidate)
+		if err != nil {
+			log.Printf("[WARN] Rule lookup for %s in network %s failed: %v\n", candidate, network.Name, err)
+			return Rule{}, false
+		}
+		if ok {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+const (
+	sourceCacheTTL        = 30 * time.Second
+	sourceCacheMaxEntries = 10000
+)
+
+type sourceCacheKey struct {
+	networkID int64
+	name      string
+}
+
+type sourceCacheEntry struct {
+	rule    Rule
+	found   bool
+	expires time.Time
+}
+
+// sourceCache remembers backend lookups, misses included, for
+// sourceCacheTTL so that a busy name costs one query per interval.
+type sourceCache struct {
+	mu      sync.Mutex
+	entries map[sourceCacheKey]sourceCacheEntry
+}
+
+func newSourceCache() *sourceCache {
+	return &sourceCache{entries: map[sourceCacheKey]sourceCacheEntry{}}
+}
+
+func (c *sourceCache) get(key sourceCacheKey) (Rule, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return Rule{}, false, false
+	}
+	return entry.rule, entry.found, true
+}
+
+func (c *sourceCache) set(key sourceCacheKey, rule Rule, found bool) {
+	c.mu.Lock()
+	if len(c.entries) >= sourceCacheMaxEntries {
+		c.entries = map[sourceCacheKey]sourceCacheEntry{}
+	}
+	c.entries[key] = sourceCacheEntry{rule: rule, found: found, expires: time.Now().Add(sourceCacheTTL)}
+	c.mu.Unlock()
+}
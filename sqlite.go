@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order; the number of applied entries is
+// kept in PRAGMA user_version. Only ever append to this list.
+var sqliteMigrations = []string{
+	`CREATE TABLE networks (
+		id INTEGER PRIMARY KEY,
+		cidr TEXT NOT NULL,
+		authoritative INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE rules (
+		network_id INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL CHECK (type IN ('ip', 'cname', 'txt', 'mx')),
+		value TEXT NOT NULL,
+		ttl INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX rules_by_name ON rules (network_id, name);`,
+}
+
+// sqliteSource reads networks from the networks table, where cidr may list
+// several ranges separated by commas, and rules from the rules table with
+// one row per address, CNAME target, TXT string or MX record.
+type sqliteSource struct {
+	db         *sql.DB
+	defaultTTL uint32
+	cache      *sourceCache
+}
+
+func openSQLiteSource(dsn string) (*sqliteSource, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// An in-memory database only lives as long as its connection.
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to migrate %s: %v", dsn, err)
+	}
+	return &sqliteSource{db: db, cache: newSourceCache()}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSource) Networks(defaultTTL uint32) ([]Network, error) {
+	s.defaultTTL = defaultTTL
+	rows, err := s.db.Query("SELECT id, cidr, authoritative FROM networks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	networks := []Network{}
+	for rows.Next() {
+		var id int64
+		var cidrs string
+		var authoritative bool
+		if err := rows.Scan(&id, &cidrs, &authoritative); err != nil {
+			return nil, err
+		}
+		ranger := cidranger.NewPCTrieRanger()
+		names := []string{}
+		for _, cidrStr := range strings.Split(cidrs, ",") {
+			cidrStr = strings.TrimSpace(cidrStr)
+			_, cidr, err := net.ParseCIDR(cidrStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR %q in network %d: %v", cidrStr, id, err)
+			}
+			ranger.Insert(cidranger.NewBasicRangerEntry(*cidr))
+			names = append(names, cidrStr)
+		}
+		networks = append(networks, Network{
+			Name:          strings.Join(names, ","),
+			Ranger:        ranger,
+			Authoritative: authoritative,
+			source:        s,
+			sourceID:      id,
+		})
+	}
+	return networks, rows.Err()
+}
+
+func (s *sqliteSource) Lookup(networkID int64, name string) (Rule, bool, error) {
+	key := sourceCacheKey{networkID, strings.ToLower(name)}
+	if rule, found, ok := s.cache.get(key); ok {
+		return rule, found, nil
+	}
+	rule, found, err := s.query(networkID, key.name)
+	if err != nil {
+		return Rule{}, false, err
+	}
+	s.cache.set(key, rule, found)
+	return rule, found, nil
+}
+
+func (s *sqliteSource) query(networkID int64, name string) (Rule, bool, error) {
+	// Names are stored either with or without the trailing dot.
+	rows, err := s.db.Query(
+		"SELECT type, value, ttl FROM rules WHERE network_id = ? AND lower(name) IN (?, ?)",
+		networkID, name, strings.TrimSuffix(name, "."))
+	if err != nil {
+		return Rule{}, false, err
+	}
+	defer rows.Close()
+	raw := RawRule{}
+	found := false
+	for rows.Next() {
+		var kind, value string
+		var ttl uint32
+		if err := rows.Scan(&kind, &value, &ttl); err != nil {
+			return Rule{}, false, err
+		}
+		found = true
+		switch kind {
+		case "ip":
+			raw.IP = append(raw.IP, RawAddress{IP: value})
+		case "cname":
+			raw.CNAME = value
+		case "txt":
+			raw.TXT = append(raw.TXT, value)
+		case "mx":
+			raw.MX = append(raw.MX, value)
+		}
+		if ttl != 0 && (raw.TTL == 0 || ttl < raw.TTL) {
+			raw.TTL = ttl
+		}
+	}
+	if err := rows.Err(); err != nil || !found {
+		return Rule{}, false, err
+	}
+	if problems := validateRule(raw); len(problems) > 0 {
+		return Rule{}, false, fmt.Errorf("Rule for %s %s", dns.Fqdn(name), strings.Join(problems, ", "))
+	}
+	rule, err := buildRule(raw, s.defaultTTL)
+	return rule, err == nil, err
+}
+
+func (s *sqliteSource) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSQLiteSourceResolves(t *testing.T) {
+	source, err := openSQLiteSource(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	for _, stmt := range []string{
+		`INSERT INTO networks (id, cidr) VALUES (1, '10.0.0.0/8, 192.168.0.0/16')`,
+		`INSERT INTO rules (network_id, name, type, value) VALUES (1, 'www.db.test', 'ip', '10.5.5.5')`,
+		`INSERT INTO rules (network_id, name, type, value) VALUES (1, 'www.db.test', 'ip', '10.5.5.6')`,
+		`INSERT INTO rules (network_id, name, type, value, ttl) VALUES (1, 'Mail.DB.test.', 'mx', '10 mx.db.test', 120)`,
+		`INSERT INTO rules (network_id, name, type, value) VALUES (1, '*.apps.db.test', 'cname', 'www.db.test')`,
+	} {
+		if _, err := source.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	networks, err := source.Networks(300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 1 || networks[0].Name != "10.0.0.0/8,192.168.0.0/16" {
+		t.Fatalf("networks = %+v", networks)
+	}
+	c := loadTestConfig(t, "matchBy: client\n")
+	c.Networks = networks
+
+	tests := []struct {
+		client, name string
+		qtype        uint16
+		rcode        int
+		want         []string
+	}{
+		{"10.1.2.3", "www.db.test", dns.TypeA, dns.RcodeSuccess, []string{"10.5.5.5", "10.5.5.6"}},
+		{"192.168.1.1", "WWW.db.test", dns.TypeA, dns.RcodeSuccess, []string{"10.5.5.5", "10.5.5.6"}},
+		{"10.1.2.3", "mail.db.test", dns.TypeMX, dns.RcodeSuccess, []string{"10 mx.db.test."}},
+		{"10.1.2.3", "x.apps.db.test", dns.TypeA, dns.RcodeSuccess, []string{"www.db.test.", "10.5.5.5", "10.5.5.6"}},
+	}
+	for _, tt := range tests {
+		m := ask(t, c, tt.client, tt.name, tt.qtype)
+		if m.Rcode != tt.rcode || !reflect.DeepEqual(answerValues(m), tt.want) {
+			t.Errorf("%s %s from %s = %s %v, want %s %v", tt.name, dns.TypeToString[tt.qtype], tt.client, dns.RcodeToString[m.Rcode], answerValues(m), dns.RcodeToString[tt.rcode], tt.want)
+		}
+	}
+	if m := ask(t, c, "10.1.2.3", "mail.db.test", dns.TypeMX); m.Answer[0].Header().Ttl != 120 {
+		t.Errorf("TTL of the MX rule = %d, want 120", m.Answer[0].Header().Ttl)
+	}
+}
+
+func TestSQLiteBackendOnlyOpenedWhenServing(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "rules.db")
+	path := writeTestFile(t, "config.yml", "matchBy: client\nbackend: sqlite\ndsn: "+dsn+"\n")
+	if _, _, err := loadConfig(path, true, loadCheck); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dsn); !os.IsNotExist(err) {
+		t.Fatalf("checking the config created %s", dsn)
+	}
+	c, _, err := loadConfig(path, true, loadServe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RuleSource == nil {
+		t.Fatal("serving config has no rule source")
+	}
+	defer c.RuleSource.Close()
+	if _, err := os.Stat(dsn); err != nil {
+		t.Fatalf("serving did not create the database: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var processStart = time.Now()
+
+// serverStats is the /stats view of the Prometheus counters, for setups
+// that do not scrape /metrics.
+type serverStats struct {
+	UptimeSeconds          int64             `json:"uptimeSeconds"`
+	Queries                uint64            `json:"queries"`
+	QueriesByType          map[string]uint64 `json:"queriesByType"`
+	CacheEntries           int               `json:"cacheEntries"`
+	CacheHits              uint64            `json:"cacheHits"`
+	CacheMisses            uint64            `json:"cacheMisses"`
+	CacheHitRatio          float64           `json:"cacheHitRatio"`
+	RuleMatches            map[string]uint64 `json:"ruleMatches"`
+	UpstreamErrors         map[string]uint64 `json:"upstreamErrors"`
+	TCPConnectionsRejected uint64            `json:"tcpConnectionsRejected"`
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	stats := serverStats{
+		UptimeSeconds:  int64(time.Since(processStart).Seconds()),
+		QueriesByType:  counterValues(byName["dns_queries_total"], "qtype"),
+		CacheEntries:   dnsCache.size(),
+		RuleMatches:    counterValues(byName["dns_rule_matches_total"], "network"),
+		UpstreamErrors: counterValues(byName["dns_upstream_errors_total"], "upstream"),
+	}
+	for _, n := range stats.QueriesByType {
+		stats.Queries += n
+	}
+	lookups := counterValues(byName["dns_cache_lookups_total"], "result")
+	stats.CacheHits, stats.CacheMisses = lookups["hit"], lookups["miss"]
+	if total := stats.CacheHits + stats.CacheMisses; total > 0 {
+		stats.CacheHitRatio = float64(stats.CacheHits) / float64(total)
+	}
+	stats.TCPConnectionsRejected = counterValues(byName["dns_tcp_connections_rejected_total"], "")[""]
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// counterValues returns the counters of family by the value of label. An
+// unlabelled counter is found under "".
+func counterValues(family *dto.MetricFamily, label string) map[string]uint64 {
+	values := map[string]uint64{}
+	if family == nil {
+		return values
+	}
+	for _, metric := range family.GetMetric() {
+		key := ""
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == label {
+				key = pair.GetValue()
+			}
+		}
+		values[key] += uint64(metric.GetCounter().GetValue())
+	}
+	return values
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func getStats(t *testing.T, handler http.Handler) serverStats {
+	t.Helper()
+	rec := adminRequest(t, handler, http.MethodGet, "/stats", "secret", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /stats: HTTP %d: %s", rec.Code, rec.Body)
+	}
+	var stats serverStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestStats(t *testing.T) {
+	upstream := startStub(t, stubAnswering("10.30.30.30"))
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    a.test: 10.1.1.1
+    b.test: 10.1.1.2
+matchBy: client
+upstream:
+- `+upstream+`
+`)
+	useConfig(t, c)
+	handler := newAdminServer(RawAdmin{Token: "secret"}, "", false).Handler
+
+	// The counters are shared by every test, so only their growth counts.
+	before := getStats(t, handler)
+	ask(t, c, "10.0.0.1", "a.test", dns.TypeA)
+	ask(t, c, "10.0.0.1", "b.test", dns.TypeA)
+	ask(t, c, "10.0.0.1", "forwarded.example", dns.TypeA)
+	ask(t, c, "10.0.0.1", "forwarded.example", dns.TypeA)
+	ask(t, c, "10.0.0.1", "forwarded.example", dns.TypeAAAA)
+	after := getStats(t, handler)
+
+	if got := after.Queries - before.Queries; got != 5 {
+		t.Errorf("queries grew by %d, want 5", got)
+	}
+	if got := after.QueriesByType["A"] - before.QueriesByType["A"]; got != 4 {
+		t.Errorf("A queries grew by %d, want 4", got)
+	}
+	if got := after.QueriesByType["AAAA"] - before.QueriesByType["AAAA"]; got != 1 {
+		t.Errorf("AAAA queries grew by %d, want 1", got)
+	}
+	if got := after.RuleMatches["10.0.0.0/8"] - before.RuleMatches["10.0.0.0/8"]; got != 2 {
+		t.Errorf("rule matches grew by %d, want 2", got)
+	}
+	if got := after.CacheHits - before.CacheHits; got != 1 {
+		t.Errorf("cache hits grew by %d, want 1", got)
+	}
+	// Rule answers are looked up in the cache first as well.
+	if got := after.CacheMisses - before.CacheMisses; got != 4 {
+		t.Errorf("cache misses grew by %d, want 4", got)
+	}
+	if after.CacheEntries != dnsCache.size() {
+		t.Errorf("cacheEntries = %d, want %d", after.CacheEntries, dnsCache.size())
+	}
+	if after.CacheHitRatio <= 0 || after.CacheHitRatio >= 1 {
+		t.Errorf("cacheHitRatio = %v, want between 0 and 1", after.CacheHitRatio)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodPost, "/stats", "secret", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /stats: got HTTP %d, want 405", rec.Code)
+	}
+}
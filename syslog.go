@@ -0,0 +1,34 @@
+package main
+
+import "strings"
+
+// RawSyslog configures logTarget: syslog. Without addr the log goes to the
+// local syslog daemon; network is udp, tcp or unix for a remote one.
+type RawSyslog struct {
+	Network  string `yaml:"network,omitempty"`
+	Addr     string `yaml:"addr,omitempty"`
+	Facility string `yaml:"facility,omitempty"`
+	Tag      string `yaml:"tag,omitempty"`
+}
+
+// syslogFacilities maps facility names to their codes (RFC 5424 6.2.1).
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+func (raw RawSyslog) facility() int {
+	if raw.Facility == "" {
+		return syslogFacilities["daemon"]
+	}
+	return syslogFacilities[strings.ToLower(raw.Facility)]
+}
+
+func (raw RawSyslog) tag() string {
+	if raw.Tag == "" {
+		return "dynamic-name-server"
+	}
+	return raw.Tag
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import (
+	"io"
+	"log"
+)
+
+// openSyslog is only supported on Unix; elsewhere the log stays on stderr.
+func openSyslog(raw RawSyslog) io.Closer {
+	log.Println("[WARN] logTarget syslog is not supported on this platform, logging to stderr")
+	return nil
+}
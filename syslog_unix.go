@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/syslog"
+)
+
+// openSyslog redirects the standard logger to syslog, which stamps the time
+// itself. Lines with [WARN] are sent with warning severity, the rest as
+// info. Like logFile, it is only read at startup.
+func openSyslog(raw RawSyslog) io.Closer {
+	writer, err := syslog.Dial(raw.Network, raw.Addr, syslog.Priority(raw.facility()<<3)|syslog.LOG_INFO, raw.tag())
+	if err != nil {
+		log.Printf("[WARN] Cannot connect to syslog, logging to stderr: %v\n", err)
+		return nil
+	}
+	log.SetFlags(0)
+	log.SetOutput(syslogWriter{writer})
+	return writer
+}
+
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+func (w syslogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(p, "\n"))
+	var err error
+	if bytes.Contains(p, []byte("[WARN]")) {
+		err = w.Warning(msg)
+	} else {
+		err = w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
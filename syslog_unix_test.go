@@ -0,0 +1,70 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restoreLog puts the standard logger back as it was when the test ends.
+func restoreLog(t *testing.T) {
+	output, flags := log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+}
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	restoreLog(t)
+	writer := openSyslog(RawSyslog{Network: "udp", Addr: conn.LocalAddr().String(), Facility: "local3", Tag: "dns-test"})
+	if writer == nil {
+		t.Fatal("openSyslog did not connect")
+	}
+	defer writer.Close()
+
+	log.Printf("Listening on 127.0.0.1:53\n")
+	log.Printf("[WARN] Upstream 10.0.0.53:53 failed\n")
+	// local3 is facility 19, so info is <158> and warning is <156>.
+	for _, want := range []struct{ priority, message string }{
+		{"<158>", "Listening on 127.0.0.1:53"},
+		{"<156>", "[WARN] Upstream 10.0.0.53:53 failed"},
+	} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := string(buf[:n])
+		if !strings.HasPrefix(line, want.priority) {
+			t.Errorf("line %q does not start with %s", line, want.priority)
+		}
+		if !strings.Contains(line, " dns-test[") || !strings.HasSuffix(strings.TrimRight(line, "\n"), "]: "+want.message) {
+			t.Errorf("line %q lacks the tag and message %q", line, want.message)
+		}
+	}
+}
+
+func TestSyslogUnreachable(t *testing.T) {
+	buf := captureLog(t)
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	if writer := openSyslog(RawSyslog{Network: "unixgram", Addr: missing}); writer != nil {
+		writer.Close()
+		t.Fatal("openSyslog connected to a socket that does not exist")
+	}
+	if !strings.Contains(buf.String(), "[WARN] Cannot connect to syslog") {
+		t.Errorf("log = %q, want a warning", buf)
+	}
+}
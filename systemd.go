@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// sdListenFdsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const sdListenFdsStart = 3
+
+// inheritedSockets returns the sockets passed by systemd socket activation
+// as described in sd_listen_fds(3). Both are nil when LISTEN_PID does not
+// name this process.
+func inheritedSockets(getenv func(string) string, pid int) ([]net.PacketConn, []net.Listener, error) {
+	listenPid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || listenPid != pid {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil, fmt.Errorf("Invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	packetConns := []net.PacketConn{}
+	listeners := []net.Listener{}
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		if listener, err := net.FileListener(file); err == nil {
+			listeners = append(listeners, listener)
+		} else if conn, err := net.FilePacketConn(file); err == nil {
+			packetConns = append(packetConns, conn)
+		} else {
+			file.Close()
+			return nil, nil, fmt.Errorf("Inherited file descriptor %d is not a socket: %v", fd, err)
+		}
+		file.Close()
+	}
+	return packetConns, listeners, nil
+}
+
+// activatedServers wraps the inherited sockets, or returns nil when the
+// process was not socket-activated. The environment is cleared so that
+// child processes do not mistake the sockets for their own.
+func activatedServers() ([]*dns.Server, error) {
+	packetConns, listeners, err := inheritedSockets(os.Getenv, os.Getpid())
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || packetConns == nil {
+		return nil, err
+	}
+	servers := []*dns.Server{}
+	for _, conn := range packetConns {
+		servers = append(servers, &dns.Server{PacketConn: conn, Net: "udp"})
+	}
+	for _, listener := range listeners {
+		servers = append(servers, &dns.Server{Listener: listener, Net: "tcp"})
+	}
+	return servers, nil
+}
+
+// sdNotify sends state to the service manager. It does nothing when the
+// service was not started with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("[WARN] Failed to notify systemd: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("[WARN] Failed to notify systemd: %v\n", err)
+	}
+}
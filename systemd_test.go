@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestInheritedSocketsEnvironment(t *testing.T) {
+	pid := os.Getpid()
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "not activated", env: map[string]string{}},
+		{name: "other process", env: map[string]string{"LISTEN_PID": strconv.Itoa(pid + 1), "LISTEN_FDS": "2"}},
+		{name: "invalid pid", env: map[string]string{"LISTEN_PID": "self", "LISTEN_FDS": "2"}},
+		{name: "missing count", env: map[string]string{"LISTEN_PID": strconv.Itoa(pid)}, wantErr: true},
+		{name: "zero count", env: map[string]string{"LISTEN_PID": strconv.Itoa(pid), "LISTEN_FDS": "0"}, wantErr: true},
+		{name: "invalid count", env: map[string]string{"LISTEN_PID": strconv.Itoa(pid), "LISTEN_FDS": "two"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			packetConns, listeners, err := inheritedSockets(getenv, pid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if packetConns != nil || listeners != nil {
+				t.Errorf("got %d packet conns and %d listeners, want none", len(packetConns), len(listeners))
+			}
+		})
+	}
+}
+
+// TestInheritedSockets passes a UDP and a TCP socket to a child process at
+// file descriptors 3 and 4, the way systemd does.
+func TestInheritedSockets(t *testing.T) {
+	if os.Getenv("INHERITED_SOCKETS_CHILD") == "1" {
+		// LISTEN_PID cannot be known before the child starts; systemd sets
+		// it between fork and exec.
+		getenv := func(key string) string {
+			if key == "LISTEN_PID" {
+				return strconv.Itoa(os.Getpid())
+			}
+			return os.Getenv(key)
+		}
+		packetConns, listeners, err := inheritedSockets(getenv, os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packetConns) != 1 || len(listeners) != 1 {
+			t.Fatalf("got %d packet conns and %d listeners, want one each", len(packetConns), len(listeners))
+		}
+		if got, want := packetConns[0].LocalAddr().String(), os.Getenv("INHERITED_UDP"); got != want {
+			t.Errorf("UDP socket at %s, want %s", got, want)
+		}
+		if got, want := listeners[0].Addr().String(), os.Getenv("INHERITED_TCP"); got != want {
+			t.Errorf("TCP socket at %s, want %s", got, want)
+		}
+		return
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("no socket activation on Windows")
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udpFile, err := udp.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpFile.Close()
+	tcpFile, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpFile.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestInheritedSockets$", "-test.v")
+	cmd.ExtraFiles = []*os.File{udpFile, tcpFile}
+	cmd.Env = append(os.Environ(), "INHERITED_SOCKETS_CHILD=1", "LISTEN_FDS=2",
+		"INHERITED_UDP="+udp.LocalAddr().String(), "INHERITED_TCP="+tcp.Addr().String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RawTracing exports an OpenTelemetry span per request, with a child span
+// per upstream exchange, over OTLP/HTTP. Tracing is off without an endpoint.
+type RawTracing struct {
+	Endpoint    string   `yaml:"endpoint,omitempty"`
+	Insecure    bool     `yaml:"insecure,omitempty"`
+	ServiceName string   `yaml:"serviceName,omitempty"`
+	SampleRatio *float64 `yaml:"sampleRatio,omitempty"`
+}
+
+// tracer records into the provider startTracing installs, and does nothing
+// until then.
+var tracer = otel.Tracer("dynamic-name-server")
+
+// startTracing installs the OTLP exporter and returns the function that
+// flushes and stops it.
+func startTracing(raw RawTracing) (func(context.Context) error, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(raw.Endpoint)}
+	if raw.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	serviceName := raw.ServiceName
+	if serviceName == "" {
+		serviceName = "dynamic-name-server"
+	}
+	ratio := 1.0
+	if raw.SampleRatio != nil {
+		ratio = *raw.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName), semconv.ServiceVersion(version))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("[WARN] Tracing: %v\n", err)
+	}))
+	log.Printf("Exporting traces to %s\n", raw.Endpoint)
+	return provider.Shutdown, nil
+}
+
+func startRequestSpan() (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "dns.request", trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// endRequestSpan notes the outcome of the request in span and ends it. The
+// attributes are only built for spans that are recorded.
+func endRequestSpan(span trace.Span, entry *QueryLog, m *dns.Msg) {
+	if !span.IsRecording() {
+		return
+	}
+	client := entry.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	span.SetAttributes(
+		attribute.String("client.address", client),
+		attribute.String("dns.question.name", entry.Name),
+		attribute.String("dns.question.type", entry.Qtype),
+		attribute.String("dns.network", entry.Network),
+		attribute.String("dns.source", entry.Source),
+		attribute.String("dns.rcode", dns.RcodeToString[m.Rcode]),
+	)
+	if m.Rcode == dns.RcodeServerFailure {
+		span.SetStatus(codes.Error, "SERVFAIL")
+	}
+	span.End()
+}
+
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// startUpstreamSpan opens the span of one exchange with upstream.
+func startUpstreamSpan(ctx context.Context, upstream Upstream, req *dns.Msg) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "dns.upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("dns.upstream", upstream.String()),
+		attribute.String("dns.question.name", req.Question[0].Name),
+		attribute.String("dns.question.type", qtypeLabel(req.Question[0].Qtype)),
+	))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttribute returns the value of key on span, or "" without one.
+func spanAttribute(span tracetest.SpanStub, key string) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == attribute.Key(key) {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	// The global tracer keeps delegating to the first provider installed,
+	// so this one is shut down rather than replaced afterwards.
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	upstream := startStub(t, stubAnswering("10.30.30.30"))
+	useConfig(t, loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+upstream:
+- `+upstream+`
+`))
+
+	r := new(dns.Msg)
+	r.SetQuestion("nas.home.", dns.TypeA)
+	handle(t, "10.0.0.1", r)
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "dns.request" {
+		t.Fatalf("rule match exported %d spans, want one dns.request", len(spans))
+	}
+	for key, want := range map[string]string{
+		"client.address":    "10.0.0.1",
+		"dns.question.name": "nas.home.",
+		"dns.question.type": "A",
+		"dns.source":        "rule",
+		"dns.rcode":         "NOERROR",
+	} {
+		if got := spanAttribute(spans[0], key); got != want {
+			t.Errorf("rule match %s = %q, want %q", key, got, want)
+		}
+	}
+
+	exporter.Reset()
+	r.SetQuestion("forwarded.example.", dns.TypeA)
+	handle(t, "10.0.0.1", r)
+	spans = exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("upstream miss exported %d spans, want 2", len(spans))
+	}
+	// The child ends, and is exported, first.
+	child, request := spans[0], spans[1]
+	if child.Name != "dns.upstream" || request.Name != "dns.request" {
+		t.Fatalf("spans = %s, %s, want dns.upstream, dns.request", child.Name, request.Name)
+	}
+	if child.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Error("upstream span is not a child of the request span")
+	}
+	if got := spanAttribute(child, "dns.upstream"); got != upstream {
+		t.Errorf("dns.upstream = %q, want %q", got, upstream)
+	}
+	if got := spanAttribute(request, "dns.source"); got != "upstream" {
+		t.Errorf("upstream miss dns.source = %q, want upstream", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RawTSIGKey is a shared secret clients sign queries with (RFC 8945). The
+// secret is base64, as printed by tsig-keygen.
+type RawTSIGKey struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm,omitempty"`
+	Secret    string `yaml:"secret"`
+}
+
+type tsigKey struct {
+	algorithm string
+	secret    []byte
+}
+
+var tsigHashes = map[string]func() hash.Hash{
+	dns.HmacSHA1:   sha1.New,
+	dns.HmacSHA224: sha256.New224,
+	dns.HmacSHA256: sha256.New,
+	dns.HmacSHA384: sha512.New384,
+	dns.HmacSHA512: sha512.New,
+}
+
+func buildTSIGKeys(raw []RawTSIGKey) (map[string]tsigKey, error) {
+	keys := map[string]tsigKey{}
+	for _, key := range raw {
+		algorithm := dns.HmacSHA256
+		if key.Algorithm != "" {
+			algorithm = dns.CanonicalName(key.Algorithm)
+		}
+		if _, ok := tsigHashes[algorithm]; !ok {
+			return nil, fmt.Errorf("Unsupported algorithm %q for TSIG key %s", key.Algorithm, key.Name)
+		}
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid secret for TSIG key %s: %v", key.Name, err)
+		}
+		keys[dns.CanonicalName(key.Name)] = tsigKey{algorithm: algorithm, secret: secret}
+	}
+	return keys, nil
+}
+
+// tsigProvider signs and verifies with the keys of the current config, so
+// that a reload changes them without restarting the listeners.
+type tsigProvider struct{}
+
+func (tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, ok := currentConfig().TSIGKeys[strings.ToLower(t.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != key.algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+	h := hmac.New(tsigHashes[key.algorithm], key.secret)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (p tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// requiresTSIG reports whether a network containing ip only answers signed
+// queries.
+func requiresTSIG(config Config, ip net.IP) bool {
+	for _, network := range matchNetworks(config, ip) {
+		if network.RequireTSIG {
+			return true
+		}
+	}
+	return false
+}
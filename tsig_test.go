@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	tsigTestKey    = "ops-key."
+	tsigTestSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0IQ=="
+	tsigTestConfig = `
+networks:
+- cidr: 10.98.0.0/16
+  requireTsig: true
+  rules:
+    ops.lab.home: 10.98.0.10
+matchBy: client
+recursion: false
+tsigKeys:
+- name: ops-key
+  secret: ` + tsigTestSecret + `
+`
+)
+
+// handleSigned signs r with secret under tsigTestKey, checks the signature
+// the way dns.Server does and runs the result through handleDNSRequest.
+func handleSigned(t *testing.T, client string, r *dns.Msg, secret string) *recordingWriter {
+	t.Helper()
+	r.SetTsig(tsigTestKey, dns.HmacSHA256, 300, time.Now().Unix())
+	packed, _, err := dns.TsigGenerate(r, secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := new(dns.Msg)
+	if err := received.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	w := &recordingWriter{
+		remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 40000},
+		tsig:   dns.TsigVerifyWithProvider(packed, tsigProvider{}, "", false),
+	}
+	handleDNSRequest(w, received)
+	return w
+}
+
+func TestTSIG(t *testing.T) {
+	useConfig(t, loadTestConfig(t, tsigTestConfig))
+	captureLog(t)
+	query := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("ops.lab.home.", dns.TypeA)
+		return r
+	}
+
+	m := handleSigned(t, "10.98.0.1", query(), tsigTestSecret).reply(t)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("signed with the right key = %s %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if tsig := m.IsTsig(); tsig == nil || tsig.Hdr.Name != tsigTestKey {
+		t.Errorf("reply signed with %v, want %s", tsig, tsigTestKey)
+	}
+
+	wrong := "d3Jvbmctc2VjcmV0LXdyb25nLXNlY3JldC13cm9uZyE="
+	if m := handleSigned(t, "10.98.0.1", query(), wrong).reply(t); m.Rcode != dns.RcodeNotAuth || len(m.Answer) != 0 {
+		t.Errorf("signed with the wrong key = %s %v, want NOTAUTH", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if m := handle(t, "10.98.0.1", query()).reply(t); m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+		t.Errorf("unsigned = %s %v, want REFUSED", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
+
+func TestTSIGKeys(t *testing.T) {
+	tests := []struct {
+		key     RawTSIGKey
+		wantErr bool
+	}{
+		{RawTSIGKey{Name: "a", Secret: tsigTestSecret}, false},
+		{RawTSIGKey{Name: "a", Algorithm: "hmac-sha512", Secret: tsigTestSecret}, false},
+		{RawTSIGKey{Name: "a", Algorithm: "hmac-md5", Secret: tsigTestSecret}, true},
+		{RawTSIGKey{Name: "a", Secret: "not base64!"}, true},
+	}
+	for _, tt := range tests {
+		keys, err := buildTSIGKeys([]RawTSIGKey{tt.key})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v, want error %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			if _, ok := keys["a."]; !ok {
+				t.Errorf("%+v: keys = %v, want a.", tt.key, keys)
+			}
+		}
+	}
+}
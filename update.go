@@ -0,0 +1,285 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// handleUpdate applies an RFC 2136 dynamic update to the rules of the
+// network the client matches, which must have allowUpdate. Updates must be
+// signed with one of tsigKeys and are kept in memory only: they are lost on
+// reload and restart.
+func handleUpdate(r *dns.Msg, config Config, clientIP net.IP, entry *QueryLog) int {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := strings.ToLower(r.Question[0].Name)
+	if entry.TSIGKey == "" {
+		log.Printf("[WARN] Refused unsigned update of %s from %s\n", zone, entry.Client)
+		return dns.RcodeRefused
+	}
+	for _, rr := range append(append([]dns.RR{}, r.Answer...), r.Ns...) {
+		if !dns.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+			return dns.RcodeNotZone
+		}
+	}
+	rcode := dns.RcodeRefused
+	var networkName string
+	configChangeMu.Lock()
+	defer configChangeMu.Unlock()
+	updateConfig(func(c *Config) {
+		idx := -1
+		for _, network := range matchNetworks(*c, clientIP) {
+			if network.AllowUpdate && network.source == nil && !network.fromEtcd {
+				idx = c.networkIndex(network.Name)
+				break
+			}
+		}
+		if idx < 0 {
+			return
+		}
+		rules := make(map[string]Rule, len(c.Networks[idx].Rules))
+		for k, v := range c.Networks[idx].Rules {
+			rules[k] = v
+		}
+		if rcode = checkPrerequisites(rules, r.Answer); rcode != dns.RcodeSuccess {
+			return
+		}
+		if rcode = applyUpdates(rules, r.Ns, c.DefaultTTL); rcode != dns.RcodeSuccess {
+			return
+		}
+		networks := append([]Network(nil), c.Networks...)
+		networks[idx].Rules = rules
+		networks[idx].index()
+		networkName = networks[idx].Name
+		c.Networks = networks
+	})
+	if rcode == dns.RcodeSuccess {
+		dnsCache.invalidate()
+		log.Printf("Applied update of %s from %s to network %s\n", zone, entry.Client, networkName)
+	}
+	return rcode
+}
+
+// acceptMsg lets updates through, which the default accept function of
+// miekg/dns rejects for the many records their sections may hold. Other
+// messages get the default checks.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) == 0 && int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (c Config) networkIndex(name string) int {
+	for i, network := range c.Networks {
+		if network.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasRecords reports whether the rule for name has records of rrtype, or
+// of any type for dns.TypeANY.
+func hasRecords(rules map[string]Rule, name string, rrtype uint16) bool {
+	rule, ok := rules[name]
+	if !ok {
+		return false
+	}
+	if rrtype == dns.TypeANY {
+		return rule.CNAME != "" || len(rule.records) > 0
+	}
+	if rrtype == dns.TypeCNAME {
+		return rule.CNAME != ""
+	}
+	return len(rule.records[rrtype]) > 0
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 3.2). The
+// value-dependent form compares records without their TTL.
+func checkPrerequisites(rules map[string]Rule, prereqs []dns.RR) int {
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		switch hdr.Class {
+		case dns.ClassANY:
+			if !hasRecords(rules, name, hdr.Rrtype) {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hasRecords(rules, name, hdr.Rrtype) {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if !hasRecord(rules[name], rr) {
+				return dns.RcodeNXRrset
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func hasRecord(rule Rule, rr dns.RR) bool {
+	if cname, ok := rr.(*dns.CNAME); ok {
+		return strings.EqualFold(rule.CNAME, cname.Target)
+	}
+	for _, template := range rule.records[rr.Header().Rrtype] {
+		record := dns.Copy(template)
+		record.Header().Name = rr.Header().Name
+		record.Header().Ttl = rr.Header().Ttl
+		if dns.IsDuplicate(record, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUpdates adds and deletes records (RFC 2136 3.4.2). Only A, AAAA,
+// CNAME, TXT and MX records can be added.
+func applyUpdates(rules map[string]Rule, updates []dns.RR, defaultTTL uint32) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		rule := rules[name]
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !addRecord(&rule, rr) {
+				return dns.RcodeNotImplemented
+			}
+			if hdr.Ttl != 0 {
+				rule.TTL = hdr.Ttl
+			} else if rule.TTL == 0 {
+				rule.TTL = defaultTTL
+			}
+		case dns.ClassANY:
+			if hdr.Rrtype == dns.TypeANY {
+				delete(rules, name)
+				continue
+			}
+			removeRecords(&rule, rr, false)
+		case dns.ClassNONE:
+			removeRecords(&rule, rr, true)
+		default:
+			return dns.RcodeFormatError
+		}
+		if err := rule.compile(); err != nil {
+			return dns.RcodeServerFailure
+		}
+		if rule.CNAME == "" && len(rule.records) == 0 {
+			delete(rules, name)
+		} else {
+			rules[name] = rule
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// addRecord adds rr to rule. A CNAME and other records cannot share a name,
+// so adding one of them to a name holding the other is ignored. Slices are
+// grown into new arrays, as the live config still shares them.
+func addRecord(rule *Rule, rr dns.RR) bool {
+	if _, ok := rr.(*dns.CNAME); !ok && rule.CNAME != "" {
+		return true
+	}
+	switch v := rr.(type) {
+	case *dns.A, *dns.AAAA:
+		ip := ipOf(rr).String()
+		for _, existing := range rule.IPs {
+			if existing == ip {
+				return true
+			}
+		}
+		rule.IPs = append(rule.IPs[:len(rule.IPs):len(rule.IPs)], ip)
+		if rule.Weights != nil {
+			rule.Weights = append(rule.Weights[:len(rule.Weights):len(rule.Weights)], 0)
+		}
+	case *dns.CNAME:
+		if len(rule.records) == 0 {
+			rule.CNAME = strings.ToLower(v.Target)
+		}
+	case *dns.TXT:
+		rule.TXT = append(rule.TXT[:len(rule.TXT):len(rule.TXT)], strings.Join(v.Txt, ""))
+	case *dns.MX:
+		rule.MX = append(rule.MX[:len(rule.MX):len(rule.MX)], MXRecord{Preference: v.Preference, Host: v.Mx})
+	default:
+		return false
+	}
+	return true
+}
+
+// removeRecords deletes the records of rr's type from rule, or only the one
+// equal to rr when exact is set.
+func removeRecords(rule *Rule, rr dns.RR, exact bool) {
+	rrtype := rr.Header().Rrtype
+	match := func(candidate dns.RR) bool {
+		if !exact {
+			return true
+		}
+		candidate.Header().Class = dns.ClassINET
+		candidate.Header().Ttl = 0
+		expected := dns.Copy(rr)
+		expected.Header().Class = dns.ClassINET
+		expected.Header().Ttl = 0
+		return dns.IsDuplicate(candidate, expected)
+	}
+	switch rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, weights := []string{}, []int(nil)
+		for i, value := range rule.IPs {
+			ip := net.ParseIP(value)
+			if recordType(ip) == rrtype && match(addressRecord(rr.Header().Name, ip, 0)) {
+				continue
+			}
+			ips = append(ips, value)
+			if rule.Weights != nil {
+				weights = append(weights, rule.Weights[i])
+			}
+		}
+		rule.IPs, rule.Weights = ips, weights
+	case dns.TypeCNAME:
+		if !exact || strings.EqualFold(rule.CNAME, rr.(*dns.CNAME).Target) {
+			rule.CNAME = ""
+		}
+	case dns.TypeTXT:
+		txt := []string{}
+		for _, value := range rule.TXT {
+			if !match(&dns.TXT{Hdr: dns.RR_Header{Name: rr.Header().Name, Rrtype: dns.TypeTXT}, Txt: []string{value}}) {
+				txt = append(txt, value)
+			}
+		}
+		rule.TXT = txt
+	case dns.TypeMX:
+		mxs := []MXRecord{}
+		for _, mx := range rule.MX {
+			if !match(&dns.MX{Hdr: dns.RR_Header{Name: rr.Header().Name, Rrtype: dns.TypeMX}, Preference: mx.Preference, Mx: mx.Host}) {
+				mxs = append(mxs, mx)
+			}
+		}
+		rule.MX = mxs
+	}
+}
+
+func ipOf(rr dns.RR) net.IP {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A
+	case *dns.AAAA:
+		return v.AAAA
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const updateTestConfig = `
+networks:
+- cidr: 10.98.0.0/16
+  authoritative: true
+  allowUpdate: true
+  rules:
+    ops.lab.home: 10.98.0.10
+- cidr: 10.99.0.0/16
+  rules: {}
+matchBy: client
+recursion: false
+tsigKeys:
+- name: ops-key
+  secret: ` + tsigTestSecret + `
+`
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	useConfig(t, loadTestConfig(t, updateTestConfig))
+	captureLog(t)
+	update := func(build func(m *dns.Msg)) int {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetUpdate("lab.home.")
+		build(m)
+		return handleSigned(t, "10.98.0.1", m, tsigTestSecret).reply(t).Rcode
+	}
+	resolve := func(name string) (int, []string) {
+		t.Helper()
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		m := handle(t, "10.98.0.1", r).reply(t)
+		return m.Rcode, answerValues(m)
+	}
+	expect := func(step, name string, rcode int, want []string) {
+		t.Helper()
+		if gotRcode, got := resolve(name); gotRcode != rcode || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %s = %s %v, want %s %v", step, name, dns.RcodeToString[gotRcode], got, dns.RcodeToString[rcode], want)
+		}
+	}
+
+	rcode := update(func(m *dns.Msg) {
+		m.Insert([]dns.RR{mustRR(t, "dhcp1.lab.home. 120 IN A 10.98.1.1"), mustRR(t, "dhcp1.lab.home. 120 IN A 10.98.1.2")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("insert: %s", dns.RcodeToString[rcode])
+	}
+	expect("insert", "dhcp1.lab.home.", dns.RcodeSuccess, []string{"10.98.1.1", "10.98.1.2"})
+
+	rcode = update(func(m *dns.Msg) {
+		m.Remove([]dns.RR{mustRR(t, "dhcp1.lab.home. 0 IN A 10.98.1.1")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("remove: %s", dns.RcodeToString[rcode])
+	}
+	expect("remove one address", "dhcp1.lab.home.", dns.RcodeSuccess, []string{"10.98.1.2"})
+
+	// The name exists now, so a prerequisite that it does not fails and
+	// nothing is applied.
+	rcode = update(func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{mustRR(t, "dhcp1.lab.home. 0 IN A 0.0.0.0")})
+		m.RemoveName([]dns.RR{mustRR(t, "dhcp1.lab.home. 0 IN A 0.0.0.0")})
+	})
+	if rcode != dns.RcodeYXDomain {
+		t.Errorf("update with a failing prerequisite: %s, want YXDOMAIN", dns.RcodeToString[rcode])
+	}
+	expect("failed prerequisite", "dhcp1.lab.home.", dns.RcodeSuccess, []string{"10.98.1.2"})
+
+	rcode = update(func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{mustRR(t, "dhcp1.lab.home. 0 IN A 0.0.0.0")})
+	})
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("remove name: %s", dns.RcodeToString[rcode])
+	}
+	expect("remove name", "dhcp1.lab.home.", dns.RcodeNameError, []string{})
+	expect("remove name", "ops.lab.home.", dns.RcodeSuccess, []string{"10.98.0.10"})
+}
+
+func TestDynamicUpdateRejects(t *testing.T) {
+	useConfig(t, loadTestConfig(t, updateTestConfig))
+	captureLog(t)
+	insert := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetUpdate("lab.home.")
+		m.Insert([]dns.RR{mustRR(t, name+" 120 IN A 10.98.1.1")})
+		return m
+	}
+	wrong := "d3Jvbmctc2VjcmV0LXdyb25nLXNlY3JldC13cm9uZyE="
+	tests := []struct {
+		name string
+		w    func() *recordingWriter
+		want int
+	}{
+		{"unsigned", func() *recordingWriter { return handle(t, "10.98.0.1", insert("a.lab.home.")) }, dns.RcodeRefused},
+		{"wrong key", func() *recordingWriter { return handleSigned(t, "10.98.0.1", insert("a.lab.home."), wrong) }, dns.RcodeNotAuth},
+		{"outside the zone", func() *recordingWriter { return handleSigned(t, "10.98.0.1", insert("a.other.home."), tsigTestSecret) }, dns.RcodeNotZone},
+		{"network without allowUpdate", func() *recordingWriter { return handleSigned(t, "10.99.0.1", insert("a.lab.home."), tsigTestSecret) }, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		if m := tt.w().reply(t); m.Rcode != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.want])
+		}
+	}
+	if _, ok := currentConfig().Networks[0].Rules["a.lab.home."]; ok {
+		t.Error("rejected update was applied")
+	}
+}
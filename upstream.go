@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultUpstreamTimeout = 5 * time.Second
+
+type RawUpstream struct {
+	Addr               string        `yaml:"addr"`
+	ServerName         string        `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify,omitempty"`
+	Timeout            time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (u *RawUpstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		u.Addr = short
+		return nil
+	}
+	type plain RawUpstream
+	return unmarshal((*plain)(u))
+}
+
+type Upstream interface {
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+type plainUpstream struct {
+	client *dns.Client
+	addr   string
+}
+
+// Exchange repeats the question over TCP when a UDP reply comes back
+// truncated.
+func (u *plainUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := u.exchangeWith(ctx, u.client, req)
+	if err == nil && resp.Truncated && u.client.Net == "udp" {
+		tcp := &dns.Client{Net: "tcp", Timeout: u.client.Timeout}
+		return u.exchangeWith(ctx, tcp, req)
+	}
+	return resp, err
+}
+
+// exchangeWith dials the connection itself so that it can close it when ctx
+// is canceled; the client only applies the deadline of ctx and would
+// otherwise keep reading until the timeout, as the losers of a race do.
+func (u *plainUpstream) exchangeWith(ctx context.Context, client *dns.Client, req *dns.Msg) (*dns.Msg, error) {
+	conn, err := client.DialContext(ctx, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	resp, _, err := client.ExchangeWithConnContext(ctx, req, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func (u *plainUpstream) String() string {
+	return u.addr
+}
+
+type dohUpstream struct {
+	client *http.Client
+	url    string
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+	httpResp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Upstream %s returned HTTP %d", u.url, httpResp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+func parseUpstream(raw RawUpstream, defaultTimeout time.Duration) (Upstream, error) {
+	timeout := raw.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if timeout == 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	switch {
+	case raw.Addr == "":
+		return nil, fmt.Errorf("Empty upstream address")
+	case strings.HasPrefix(raw.Addr, "tls://"):
+		addr := withDefaultPort(strings.TrimPrefix(raw.Addr, "tls://"), "853")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName := raw.ServerName
+		if serverName == "" {
+			serverName = host
+		}
+		client := &dns.Client{
+			Net:     "tcp-tls",
+			Timeout: timeout,
+			TLSConfig: &tls.Config{
+				ServerName:         serverName,
+				InsecureSkipVerify: raw.InsecureSkipVerify,
+			},
+		}
+		return &plainUpstream{client: client, addr: addr}, nil
+	case strings.HasPrefix(raw.Addr, "https://"):
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					ServerName:         raw.ServerName,
+					InsecureSkipVerify: raw.InsecureSkipVerify,
+				},
+			},
+		}
+		return &dohUpstream{client: client, url: raw.Addr}, nil
+	}
+	addr := strings.TrimPrefix(raw.Addr, "udp://")
+	return &plainUpstream{client: &dns.Client{Net: "udp", Timeout: timeout}, addr: withDefaultPort(addr, "53")}, nil
+}
+
+// Forwarder sends questions to a group of upstreams according to Strategy
+// and starts over up to Retries more times before giving up.
+//
+//   - failover tries the upstreams in order
+//   - roundrobin starts at the next upstream on every query
+//   - parallel asks all of them at once and takes the first good answer
+type Forwarder struct {
+	Upstreams []Upstream
+	Strategy  string
+	Retries   int
+	next      uint64
+}
+
+func newForwarder(raws []RawUpstream, strategy string, timeout time.Duration, retries int) (*Forwarder, error) {
+	if len(raws) == 0 {
+		return nil, nil
+	}
+	if strategy == "" {
+		strategy = "failover"
+	}
+	f := &Forwarder{Strategy: strategy, Retries: retries}
+	for _, raw := range raws {
+		upstream, err := parseUpstream(raw, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid upstream %q: %v", raw.Addr, err)
+		}
+		f.Upstreams = append(f.Upstreams, upstream)
+	}
+	return f, nil
+}
+
+// systemForwarder reads the nameservers from /etc/resolv.conf so that query
+// types net.LookupIP cannot answer still have somewhere to go.
+func systemForwarder(timeout time.Duration, retries int) *Forwarder {
+	clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	raws := []RawUpstream{}
+	for _, server := range clientConfig.Servers {
+		raws = append(raws, RawUpstream{Addr: net.JoinHostPort(server, clientConfig.Port)})
+	}
+	f, err := newForwarder(raws, "failover", timeout, retries)
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+func (f *Forwarder) exchange(ctx context.Context, upstream Upstream, req *dns.Msg) (*dns.Msg, error) {
+	ctx, span := startUpstreamSpan(ctx, upstream, req)
+	defer span.End()
+	resp, err := upstream.Exchange(ctx, req)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = fmt.Errorf("Upstream %s returned SERVFAIL for %s", upstream, req.Question[0].Name)
+	}
+	if err != nil {
+		failSpan(span, err)
+		// The losers of a parallel race are cancelled, not broken.
+		if ctx.Err() == nil {
+			upstreamErrors.WithLabelValues(upstream.String()).Inc()
+			log.Printf("[WARN] %s: %v\n", upstream, err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (f *Forwarder) forward(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	req.SetEdns0(1232, false)
+	var lastErr error
+	for attempt := 0; attempt <= f.Retries; attempt++ {
+		var resp *dns.Msg
+		var err error
+		if f.Strategy == "parallel" {
+			resp, err = f.race(ctx, req)
+		} else {
+			resp, err = f.sequential(ctx, req)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (f *Forwarder) sequential(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	offset := 0
+	if f.Strategy == "roundrobin" {
+		offset = int(atomic.AddUint64(&f.next, 1) % uint64(len(f.Upstreams)))
+	}
+	var lastErr error
+	for i := range f.Upstreams {
+		upstream := f.Upstreams[(offset+i)%len(f.Upstreams)]
+		resp, err := f.exchange(ctx, upstream, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// race sends req to every upstream at once and returns the first successful
+// reply. The remaining exchanges are cancelled before race returns.
+func (f *Forwarder) race(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(f.Upstreams))
+	for _, upstream := range f.Upstreams {
+		go func(upstream Upstream) {
+			resp, err := f.exchange(ctx, upstream, req.Copy())
+			results <- result{resp, err}
+		}(upstream)
+	}
+	var lastErr error
+	for range f.Upstreams {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		lastErr = r.err
+	}
+	return nil, lastErr
+}
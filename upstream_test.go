@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startStub serves handler over UDP on a free local port until the test
+// ends and returns its address.
+func startStub(t testing.TB, handler dns.HandlerFunc) string {
+	t.Helper()
+	return startStubAt(t, "127.0.0.1:0", handler)
+}
+
+// startStubAt is startStub at a given address. The test is skipped when the
+// address cannot be bound, such as port 53 without privileges.
+func startStubAt(t testing.TB, addr string, handler dns.HandlerFunc) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("cannot listen at %s: %v", addr, err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// stubAnswering answers every A query with ip.
+func stubAnswering(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSignedCert(t, 1)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Net: "tcp-tls", Handler: stubAnswering("10.10.10.10"), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	for _, insecure := range []bool{true, false} {
+		useConfig(t, loadTestConfig(t, fmt.Sprintf(`
+upstream:
+- {addr: "tls://%s", insecureSkipVerify: %v}
+matchBy: client
+`, l.Addr(), insecure)))
+		m := query(t, "10.1.2.3", "example.test.", dns.TypeA)
+		if insecure {
+			if got := answerValues(m); len(got) != 1 || got[0] != "10.10.10.10" {
+				t.Errorf("with insecureSkipVerify answered %v", got)
+			}
+		} else if m.Rcode != dns.RcodeServerFailure {
+			// The certificate is self-signed, so verification fails.
+			t.Errorf("with verification rcode = %d, want SERVFAIL", m.Rcode)
+		}
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	failing := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	answering := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "not a DNS message", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.20.20.20")})
+		packed, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer answering.Close()
+
+	useConfig(t, loadTestConfig(t, fmt.Sprintf(`
+upstream:
+- {addr: "%s/dns-query", insecureSkipVerify: true}
+- {addr: "%s/dns-query", insecureSkipVerify: true}
+matchBy: client
+`, failing.URL, answering.URL)))
+	// The first upstream answers HTTP 503, so the second one is asked.
+	if got := answerValues(query(t, "10.1.2.3", "example.test.", dns.TypeA)); len(got) != 1 || got[0] != "10.20.20.20" {
+		t.Errorf("answered %v", got)
+	}
+}
+
+func TestOtherTypesAreForwarded(t *testing.T) {
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch q.Qtype {
+		case dns.TypeMX:
+			m.Answer = append(m.Answer, &dns.MX{Hdr: hdr, Preference: 10, Mx: "mail.example.test."})
+		case dns.TypeTXT:
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"v=spf1 -all"}})
+		}
+		w.WriteMsg(m)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nmatchBy: client\n"))
+
+	for qtype, want := range map[uint16]string{dns.TypeMX: "10 mail.example.test.", dns.TypeTXT: `"v=spf1 -all"`} {
+		if got := answerValues(query(t, "10.1.2.3", "example.test.", qtype)); len(got) != 1 || got[0] != want {
+			t.Errorf("%s answered %v, want %s", dns.TypeToString[qtype], got, want)
+		}
+	}
+}
+
+func TestUnresponsiveUpstreamTimesOut(t *testing.T) {
+	var asked int32
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nupstreamTimeout: 200ms\nupstreamRetries: 1\nmatchBy: client\n"))
+
+	start := time.Now()
+	m := query(t, "10.0.0.1", "silent.example.", dns.TypeA)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("query took %v with two 200ms attempts", elapsed)
+	}
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if got := atomic.LoadInt32(&asked); got != 2 {
+		t.Errorf("upstream was asked %d times, want 2", got)
+	}
+}
+
+func TestTruncatedUpstreamReplyIsRetriedOverTCP(t *testing.T) {
+	var udpSize uint32
+	full := stubAnswering("10.3.3.3")
+	addr := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if opt := r.IsEdns0(); opt != nil {
+			atomic.StoreUint32(&udpSize, uint32(opt.UDPSize()))
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen at %s over TCP: %v", addr, err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Handler: full, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	useConfig(t, loadTestConfig(t, "upstream: ["+addr+"]\nmatchBy: client\n"))
+
+	m := query(t, "10.0.0.1", "big.example.", dns.TypeA)
+	if got := answerValues(m); len(got) != 1 || got[0] != "10.3.3.3" {
+		t.Errorf("answer = %v, want the one from TCP", got)
+	}
+	if got := atomic.LoadUint32(&udpSize); got != 1232 {
+		t.Errorf("EDNS0 UDP size = %d, want 1232", got)
+	}
+}
+
+func TestParallelUpstreamsTakeFastestAnswer(t *testing.T) {
+	fast := startStub(t, stubAnswering("10.1.1.1"))
+	slowAnswer := stubAnswering("10.2.2.2")
+	slow := startStub(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		slowAnswer(w, r)
+	})
+	useConfig(t, loadTestConfig(t, "upstream: ["+slow+", "+fast+"]\nupstreamStrategy: parallel\nmatchBy: client\n"))
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		got := answerValues(query(t, "10.0.0.1", fmt.Sprintf("race%d.example.", i), dns.TypeA))
+		if len(got) != 1 || got[0] != "10.1.1.1" {
+			t.Errorf("query %d answered %v, want the fast 10.1.1.1", i, got)
+		}
+		if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+			t.Errorf("query %d waited %v for the slow upstream", i, elapsed)
+		}
+	}
+}
+
+func TestForwardZones(t *testing.T) {
+	public := startStub(t, stubAnswering("10.3.3.3"))
+	internal := startStub(t, stubAnswering("10.4.4.4"))
+	useConfig(t, loadTestConfig(t, `
+upstream: [`+public+`]
+forwardZones:
+  corp.example: [`+internal+`]
+matchBy: client
+`))
+	for name, want := range map[string]string{
+		"corp.example.":           "10.4.4.4",
+		"wiki.CORP.example.":      "10.4.4.4",
+		"www.example.":            "10.3.3.3",
+		"notcorp.example.":        "10.3.3.3",
+		"corp.example.elsewhere.": "10.3.3.3",
+	} {
+		if got := answerValues(query(t, "10.0.0.1", name, dns.TypeA)); len(got) != 1 || got[0] != want {
+			t.Errorf("%s answered %v, want %s", name, got, want)
+		}
+	}
+}
+
+func TestNetworkUpstreams(t *testing.T) {
+	office := startStub(t, stubAnswering("10.10.10.10"))
+	lab := startStub(t, stubAnswering("10.20.20.20"))
+	global := startStub(t, stubAnswering("10.30.30.30"))
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  upstream: [`+office+`]
+  rules:
+    local.test: 10.1.1.1
+- cidr: 172.16.0.0/12
+  upstream: [`+lab+`]
+  rules: {}
+- cidr: 192.168.0.0/16
+  rules: {}
+matchBy: client
+upstream: [`+global+`]
+`)
+	useConfig(t, c)
+	tests := []struct {
+		client, name string
+		want         []string
+	}{
+		{"10.0.0.1", "miss.test", []string{"10.10.10.10"}},
+		{"10.0.0.1", "local.test", []string{"10.1.1.1"}},
+		{"172.16.0.1", "miss.test", []string{"10.20.20.20"}},
+		{"192.168.0.1", "miss.test", []string{"10.30.30.30"}},
+	}
+	for _, tt := range tests {
+		if got := answerValues(ask(t, c, tt.client, tt.name, dns.TypeA)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s from %s = %v, want %v", tt.name, tt.client, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// looksLikeIP catches values such as 10.0.0.300 that fail to parse as an
+// address and would otherwise be taken for a CNAME target.
+func looksLikeIP(value string) bool {
+	if strings.Contains(value, ":") {
+		return true
+	}
+	return strings.Trim(strings.TrimSuffix(value, "."), "0123456789.") == ""
+}
+
+func validateRule(rule RawRule) []string {
+	problems := []string{}
+	for _, address := range rule.IP {
+		if net.ParseIP(address.IP) == nil {
+			problems = append(problems, fmt.Sprintf("has invalid IP address %q", address.IP))
+		}
+		if address.Weight < 0 {
+			problems = append(problems, fmt.Sprintf("has negative weight for %s", address.IP))
+		}
+	}
+	if _, err := parseSchedule(rule.Schedule); err != nil {
+		problems = append(problems, fmt.Sprintf("has invalid schedule: %v", err))
+	}
+	if rule.CNAME != "" {
+		if looksLikeIP(rule.CNAME) {
+			problems = append(problems, fmt.Sprintf("has invalid IP address %q", rule.CNAME))
+		} else if _, ok := dns.IsDomainName(rule.CNAME); !ok {
+			problems = append(problems, fmt.Sprintf("has invalid hostname %q", rule.CNAME))
+		}
+	}
+	for _, mx := range rule.MX {
+		if _, err := parseMX(mx); err != nil {
+			problems = append(problems, fmt.Sprintf("has invalid MX record: %v", err))
+		}
+	}
+	for _, srv := range rule.SRV {
+		if _, ok := dns.IsDomainName(srv.Target); !ok || srv.Target == "" {
+			problems = append(problems, fmt.Sprintf("has invalid SRV target %q", srv.Target))
+		}
+	}
+	for _, value := range append(append([]string{}, rule.HTTPS...), rule.SVCB...) {
+		if _, err := parseSVCB(value); err != nil {
+			problems = append(problems, fmt.Sprintf("has invalid HTTPS/SVCB record: %v", err))
+		}
+	}
+	return problems
+}
+
+func (rawConfig RawConfig) validate() error {
+	problems := ValidationError{}
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for idx, network := range rawConfig.Networks {
+		if len(network.CIDR) == 0 {
+			report("network %d: no cidr given", idx)
+		}
+		if network.RequireTSIG && len(rawConfig.TSIGKeys) == 0 {
+			report("network %d: requireTsig needs tsigKeys", idx)
+		}
+		if network.AllowUpdate && len(rawConfig.TSIGKeys) == 0 {
+			report("network %d: allowUpdate needs tsigKeys", idx)
+		}
+		if network.SOA != nil {
+			if !network.Authoritative {
+				report("network %d: soa requires authoritative: true", idx)
+			}
+			fields := []struct{ name, value string }{{"zone", network.SOA.Zone}, {"mname", network.SOA.MName}, {"rname", network.SOA.RName}}
+			for _, field := range fields {
+				if _, ok := dns.IsDomainName(field.value); !ok || field.value == "" {
+					report("network %d: soa %s %q is not a domain name", idx, field.name, field.value)
+				}
+			}
+		}
+		if len(network.NS) > 0 && network.SOA == nil {
+			report("network %d: ns requires soa", idx)
+		}
+		for _, ns := range network.NS {
+			if _, ok := dns.IsDomainName(ns); !ok {
+				report("network %d: invalid ns %q", idx, ns)
+			}
+		}
+		for _, cidrStr := range network.CIDR {
+			if _, _, err := net.ParseCIDR(cidrStr); err != nil {
+				report("network %d: invalid CIDR %q", idx, cidrStr)
+			}
+		}
+		domains := make([]string, 0, len(network.Rules))
+		for domain := range network.Rules {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+		for _, domain := range domains {
+			if _, ok := dns.IsDomainName(domain); !ok {
+				report("network %d: invalid domain name %q", idx, domain)
+			}
+			for _, problem := range validateRule(network.Rules[domain]) {
+				report("network %d: rule %s %s", idx, domain, problem)
+			}
+		}
+		patterns := make([]string, 0, len(network.RegexRules))
+		for pattern := range network.RegexRules {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				report("network %d: invalid regexRules pattern %q: %v", idx, pattern, err)
+			}
+			for _, problem := range validateRule(network.RegexRules[pattern]) {
+				report("network %d: regex rule %s %s", idx, pattern, problem)
+			}
+		}
+		if network.Default != nil {
+			for _, problem := range validateRule(*network.Default) {
+				report("network %d: default rule %s", idx, problem)
+			}
+		}
+		for upstreamIdx, upstream := range network.Upstream {
+			if _, err := parseUpstream(upstream, rawConfig.UpstreamTimeout); err != nil {
+				report("network %d: upstream %d: %v", idx, upstreamIdx, err)
+			}
+		}
+	}
+
+	for _, cidrStr := range rawConfig.AllowedNets {
+		if _, _, err := net.ParseCIDR(cidrStr); err != nil {
+			report("allowedNetworks: invalid CIDR %q", cidrStr)
+		}
+	}
+
+	if rawConfig.BindAddress != "" && net.ParseIP(rawConfig.BindAddress) == nil {
+		report("bindAddress %q is not an IP address", rawConfig.BindAddress)
+	}
+	if rawConfig.Port < 0 || rawConfig.Port > 65535 {
+		report("port %d is out of range 1-65535", rawConfig.Port)
+	}
+	switch rawConfig.Proto {
+	case "", "udp", "tcp", "both":
+	default:
+		report("protocol %q must be udp, tcp or both", rawConfig.Proto)
+	}
+	for idx, endpoint := range rawConfig.Listen {
+		if endpoint.Address != "" && net.ParseIP(endpoint.Address) == nil {
+			report("listen %d: address %q is not an IP address", idx, endpoint.Address)
+		}
+		if endpoint.Port < 0 || endpoint.Port > 65535 {
+			report("listen %d: port %d is out of range 1-65535", idx, endpoint.Port)
+		}
+		switch endpoint.Protocol {
+		case "", "udp", "tcp", "both":
+		default:
+			report("listen %d: protocol %q must be udp, tcp or both", idx, endpoint.Protocol)
+		}
+	}
+	switch rawConfig.AdapterFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		report("adapterFamily %q must be ipv4 or ipv6", rawConfig.AdapterFamily)
+	}
+	switch rawConfig.MatchBy {
+	case "", "server", "client":
+	default:
+		report("matchBy %q must be server or client", rawConfig.MatchBy)
+	}
+	if rawConfig.ECS && rawConfig.MatchBy != "client" {
+		report("ecs requires matchBy: client")
+	}
+	if ratio := rawConfig.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		report("tracing sampleRatio %v must be between 0 and 1", *ratio)
+	}
+	if rawConfig.EDNSUDPSize != 0 && rawConfig.EDNSUDPSize < dns.MinMsgSize {
+		report("ednsUdpSize %d is below the minimum of %d", rawConfig.EDNSUDPSize, dns.MinMsgSize)
+	}
+	switch rawConfig.LogFormat {
+	case "", "text", "json":
+	default:
+		report("logFormat %q must be text or json", rawConfig.LogFormat)
+	}
+	for _, zone := range rawConfig.PrivateAllow {
+		if _, ok := dns.IsDomainName(zone); !ok {
+			report("privateUpstreamAllow: invalid domain name %q", zone)
+		}
+	}
+	switch rawConfig.AnyMode {
+	case "", "hinfo", "refuse", "forward":
+	default:
+		report("anyMode %q must be hinfo, refuse or forward", rawConfig.AnyMode)
+	}
+	switch rawConfig.BlockMode {
+	case "", "nxdomain", "zero":
+	default:
+		report("blockMode %q must be nxdomain or zero", rawConfig.BlockMode)
+	}
+	for _, domain := range rawConfig.Blocklist.Domains {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			report("blocklist: invalid domain name %q", domain)
+		}
+	}
+	if rawConfig.RateLimit.QPS < 0 || rawConfig.RateLimit.Burst < 0 {
+		report("rateLimit qps and burst must not be negative")
+	}
+	switch rawConfig.RateLimit.Action {
+	case "", "refuse", "drop":
+	default:
+		report("rateLimit action %q must be refuse or drop", rawConfig.RateLimit.Action)
+	}
+	switch rawConfig.ResolverMode {
+	case "", "forward":
+	case "recursive":
+		if len(rawConfig.Upstream) > 0 {
+			report("upstream cannot be used with resolverMode: recursive")
+		}
+	default:
+		report("resolverMode %q must be forward or recursive", rawConfig.ResolverMode)
+	}
+	switch rawConfig.UpstreamStrategy {
+	case "", "failover", "roundrobin", "parallel":
+	default:
+		report("upstreamStrategy %q must be failover, roundrobin or parallel", rawConfig.UpstreamStrategy)
+	}
+	if rawConfig.Hosts.Network != "" {
+		if _, _, err := net.ParseCIDR(rawConfig.Hosts.Network); err != nil {
+			report("hosts: invalid network %q", rawConfig.Hosts.Network)
+		}
+	}
+	if rawConfig.Zones.Network != "" {
+		if _, _, err := net.ParseCIDR(rawConfig.Zones.Network); err != nil {
+			report("zones: invalid network %q", rawConfig.Zones.Network)
+		}
+	}
+	if rawConfig.Zones.Origin != "" {
+		if _, ok := dns.IsDomainName(rawConfig.Zones.Origin); !ok {
+			report("zones: invalid origin %q", rawConfig.Zones.Origin)
+		}
+	}
+	if rawConfig.Etcd.DialTimeout < 0 {
+		report("etcd: dialTimeout must not be negative")
+	}
+	switch rawConfig.Backend {
+	case "":
+	case "sqlite":
+		if rawConfig.DSN == "" {
+			report("backend %s requires dsn", rawConfig.Backend)
+		}
+	default:
+		report("backend %q must be sqlite", rawConfig.Backend)
+	}
+	if rawConfig.Admin.Addr != "" && rawConfig.Admin.Token == "" {
+		report("admin: token is required")
+	}
+	if (rawConfig.DoH.CertFile == "") != (rawConfig.DoH.KeyFile == "") {
+		report("doh: certFile and keyFile must be given together")
+	}
+	for idx, key := range rawConfig.TSIGKeys {
+		if _, ok := dns.IsDomainName(key.Name); !ok || key.Name == "" {
+			report("tsigKeys %d: invalid key name %q", idx, key.Name)
+		}
+	}
+	if _, err := buildTSIGKeys(rawConfig.TSIGKeys); err != nil {
+		report("tsigKeys: %v", err)
+	}
+	if (rawConfig.DoT.CertFile == "") != (rawConfig.DoT.KeyFile == "") {
+		report("dot: certFile and keyFile must be given together")
+	}
+	if rawConfig.DoT.Addr != "" && rawConfig.DoT.CertFile == "" {
+		report("dot: certFile and keyFile are required")
+	}
+	switch rawConfig.LogTarget {
+	case "", "stderr":
+	case "syslog":
+		if rawConfig.LogFile.Path != "" {
+			report("logTarget syslog cannot be combined with logFile")
+		}
+	default:
+		report("logTarget %q must be stderr or syslog", rawConfig.LogTarget)
+	}
+	if _, ok := syslogFacilities[strings.ToLower(rawConfig.Syslog.Facility)]; rawConfig.Syslog.Facility != "" && !ok {
+		report("syslog facility %q is unknown", rawConfig.Syslog.Facility)
+	}
+	switch rawConfig.Syslog.Network {
+	case "", "udp", "tcp", "unix", "unixgram":
+	default:
+		report("syslog network %q must be udp, tcp, unix or unixgram", rawConfig.Syslog.Network)
+	}
+	if rawConfig.Syslog.Network != "" && rawConfig.Syslog.Addr == "" {
+		report("syslog network needs an addr")
+	}
+	if rawConfig.LogFile.MaxSize < 0 || rawConfig.LogFile.MaxAge < 0 || rawConfig.LogFile.MaxBackups < 0 {
+		report("logFile: maxSize, maxAge and maxBackups must not be negative")
+	}
+	if rawConfig.Timezone != "" {
+		if _, err := time.LoadLocation(rawConfig.Timezone); err != nil {
+			report("timezone %q is unknown", rawConfig.Timezone)
+		}
+	}
+	if rawConfig.Prefetch < 0 || rawConfig.Prefetch >= 1 {
+		report("prefetchThreshold %v must be at least 0 and below 1", rawConfig.Prefetch)
+	}
+	if rawConfig.MaxConcurrent < 0 {
+		report("maxConcurrentQueries must not be negative")
+	}
+	if rawConfig.QueueSize != nil && *rawConfig.QueueSize < 0 {
+		report("queueSize must not be negative")
+	}
+	if rawConfig.TCPMaxConns < 0 {
+		report("tcpMaxConnections must not be negative")
+	}
+	if rawConfig.TCPIdleTimeout < 0 {
+		report("tcpIdleTimeout must not be negative")
+	}
+	if rawConfig.CacheMaxEntries < 0 {
+		report("cacheMaxEntries must not be negative")
+	}
+	if rawConfig.StaleWindow < 0 {
+		report("staleWindow must not be negative")
+	}
+	if rawConfig.UpstreamTimeout < 0 {
+		report("upstreamTimeout must not be negative")
+	}
+	if rawConfig.UpstreamRetries < 0 {
+		report("upstreamRetries must not be negative")
+	}
+	for idx, upstream := range rawConfig.Upstream {
+		if _, err := parseUpstream(upstream, rawConfig.UpstreamTimeout); err != nil {
+			report("upstream %d: %v", idx, err)
+		}
+	}
+	for zone, upstreams := range rawConfig.ForwardZones {
+		if _, ok := dns.IsDomainName(zone); !ok {
+			report("forwardZones: invalid zone %q", zone)
+		}
+		if len(upstreams) == 0 {
+			report("forwardZones %s: no upstream given", zone)
+		}
+		for idx, upstream := range upstreams {
+			if _, err := parseUpstream(upstream, rawConfig.UpstreamTimeout); err != nil {
+				report("forwardZones %s: upstream %d: %v", zone, idx, err)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidationFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"missing CIDR", "networks:\n- rules: {}\n", "network 0: no cidr given"},
+		{"invalid CIDR", "networks:\n- cidr: 10.0.0.0/33\n", `network 0: invalid CIDR "10.0.0.0/33"`},
+		{"invalid domain", "networks:\n- cidr: 10.0.0.0/8\n  rules:\n    bad..home: 10.0.0.1\n", `network 0: invalid domain name "bad..home"`},
+		{"invalid IP address", "networks:\n- cidr: 10.0.0.0/8\n  rules:\n    bad.home: {ip: [10.0.0.300]}\n", `network 0: rule bad.home has invalid IP address "10.0.0.300"`},
+		{"invalid hostname", "networks:\n- cidr: 10.0.0.0/8\n  rules:\n    bad.home: {cname: bad..home}\n", `network 0: rule bad.home has invalid hostname "bad..home"`},
+		{"invalid MX", "networks:\n- cidr: 10.0.0.0/8\n  rules:\n    bad.home: {mx: [mail.home]}\n", "network 0: rule bad.home has invalid MX record"},
+		{"port out of range", "port: 70000\n", "port 70000 is out of range 1-65535"},
+		{"unknown protocol", "protocol: sctp\n", `protocol "sctp" must be udp, tcp or both`},
+		{"unknown matchBy", "matchBy: everyone\n", `matchBy "everyone" must be server or client`},
+		{"invalid upstream", "upstream: ['']\n", "upstream 0: Empty upstream address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := loadConfig(writeTestFile(t, "config.yml", tt.config), true, loadCheck)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFlag(t *testing.T) {
+	good := writeTestFile(t, "config.yml", "networks:\n- cidr: 10.0.0.0/8\n  rules:\n    nas.home: 10.0.0.5\n")
+	if out, err := runMain(t, "--check", "--config", good); err != nil || !strings.Contains(out, "configuration OK") {
+		t.Errorf("--check of a valid config printed %q, %v", out, err)
+	}
+	// Every problem is reported, not only the first.
+	bad := writeTestFile(t, "config.yml", "networks:\n- cidr: 10.0.0.0/33\nport: 70000\n")
+	_, err := runMain(t, "--check", "--config", bad)
+	if err == nil || !strings.Contains(err.Error(), "10.0.0.0/33") || !strings.Contains(err.Error(), "70000") {
+		t.Errorf("--check of an invalid config returned %v", err)
+	}
+}
+
+func TestRuleValues(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{"invalid IPv4", `{ip: [10.0.0.300]}`, `network 1: rule bad.home has invalid IP address "10.0.0.300"`},
+		{"invalid IPv6", `{ip: ["fd00::5::1"]}`, `network 1: rule bad.home has invalid IP address "fd00::5::1"`},
+		{"invalid IPv4 short form", `10.0.0.300`, `Invalid IP address "10.0.0.300"`},
+		{"invalid hostname", `{cname: "bad..home"}`, `network 1: rule bad.home has invalid hostname "bad..home"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestFile(t, "config.yml", `
+networks:
+- cidr: 10.0.0.0/8
+  rules: {}
+- cidr: 172.16.0.0/12
+  rules:
+    bad.home: `+tt.rule+`
+matchBy: client
+`)
+			_, _, err := loadConfig(path, true, loadCheck)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostnameRuleValue(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+    files.home: NAS.home
+    v6.home: FD00:0:0::5
+matchBy: client
+recursion: false
+`)
+	rules := c.Networks[0].Rules
+	if rule := rules["files.home."]; rule.CNAME != "nas.home." || len(rule.IPs) != 0 {
+		t.Errorf("files.home. = %+v, want a CNAME to nas.home.", rule)
+	}
+	if got := answerValues(ask(t, c, "10.0.0.1", "v6.home", dns.TypeAAAA)); len(got) != 1 || got[0] != "fd00::5" {
+		t.Errorf("v6.home. AAAA = %v, want fd00::5", got)
+	}
+}
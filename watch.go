@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// configWatchInterval is how often watchConfigFile looks at the config file.
+const configWatchInterval = time.Second
+
+// watchConfigFile reloads the config when the file changes while
+// watchConfig is set. A change is only acted on once the size and
+// modification time held still for a whole interval, so an editor that is
+// still writing the file is not caught half-way.
+func watchConfigFile(configPath string, nolog bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	loaded := statConfig(configPath)
+	var pending os.FileInfo
+	for range ticker.C {
+		if !currentConfig().WatchConfig {
+			loaded, pending = statConfig(configPath), nil
+			continue
+		}
+		info := statConfig(configPath)
+		if info == nil || sameFile(info, loaded) {
+			pending = nil
+			continue
+		}
+		if pending == nil || !sameFile(info, pending) {
+			pending = info
+			continue
+		}
+		loaded, pending = info, nil
+		if err := reloadConfig(configPath, nolog); err != nil {
+			log.Printf("Failed to reload %s, keeping previous config: %v\n", configPath, err)
+			continue
+		}
+		log.Printf("Reloaded config from %s after it changed\n", configPath)
+	}
+}
+
+func statConfig(configPath string) os.FileInfo {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const watchTestConfig = `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+watchConfig: true
+`
+
+func TestWatchConfig(t *testing.T) {
+	path := writeTestFile(t, "config.yml", watchTestConfig)
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+	// The watcher outlives the test; it idles once the file is gone.
+	go watchConfigFile(path, true, 10*time.Millisecond)
+	// Let the watcher take its first look before the file changes.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(path, []byte(watchTestConfig+`
+defaultTtl: 120
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for currentConfig().DefaultTTL != 120 {
+		if time.Now().After(deadline) {
+			t.Fatal("config was not reloaded after the file changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := currentConfig().Generation; got != c.Generation+1 {
+		t.Errorf("generation = %d, want %d", got, c.Generation+1)
+	}
+
+	// A broken file keeps the config that is running.
+	if err := os.WriteFile(path, []byte("networks: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	m := ask(t, currentConfig(), "10.0.0.1", "nas.home", dns.TypeA)
+	if got := answerValues(m); len(got) != 1 || got[0] != "192.168.1.5" {
+		t.Errorf("answer = %v after a broken edit, want the previous rule", got)
+	}
+	if currentConfig().DefaultTTL != 120 {
+		t.Error("broken edit replaced the running config")
+	}
+}
+
+func TestWatchConfigOff(t *testing.T) {
+	path := writeTestFile(t, "config.yml", `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+matchBy: client
+`)
+	c, _, err := loadConfig(path, true, loadCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+	go watchConfigFile(path, true, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(path, []byte(watchTestConfig+`
+defaultTtl: 120
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if currentConfig().DefaultTTL == 120 {
+		t.Error("config was reloaded without watchConfig")
+	}
+}
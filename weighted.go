@@ -0,0 +1,32 @@
+package main
+
+import "sync"
+
+// smoothWeighted picks indexes in proportion to their weights with the
+// smooth weighted round-robin used by nginx: heavy entries are spread out
+// instead of being picked several times in a row, and the sequence is the
+// same on every run.
+type smoothWeighted struct {
+	mu      sync.Mutex
+	weights []int
+	current []int
+}
+
+func newSmoothWeighted(weights []int) *smoothWeighted {
+	return &smoothWeighted{weights: weights, current: make([]int, len(weights))}
+}
+
+func (s *smoothWeighted) next() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total, best := 0, 0
+	for i, weight := range s.weights {
+		s.current[i] += weight
+		total += weight
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= total
+	return best
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSmoothWeighted(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    []int
+	}{
+		{[]int{1}, []int{0, 0, 0}},
+		{[]int{1, 1}, []int{0, 1, 0, 1}},
+		{[]int{3, 1}, []int{0, 0, 1, 0, 0, 0, 1, 0}},
+		// Heavy entries are spread out rather than picked in a row.
+		{[]int{5, 1, 1}, []int{0, 0, 1, 0, 2, 0, 0}},
+	}
+	for _, tt := range tests {
+		s := newSmoothWeighted(tt.weights)
+		got := make([]int, len(tt.want))
+		for i := range got {
+			got[i] = s.next()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("weights %v picked %v, want %v", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestWeightedAnswers(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    lb.home:
+    - {ip: 192.168.1.10, weight: 3}
+    - {ip: 192.168.1.11, weight: 1}
+matchBy: client
+recursion: false
+`)
+	dnsCache.flush()
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		// Repeat queries go through the cache, which must not pin one pick.
+		m := ask(t, c, "10.0.0.1", "lb.home", dns.TypeA)
+		if len(m.Answer) != 1 {
+			t.Fatalf("weighted answer = %v, want a single address", m.Answer)
+		}
+		counts[answerValues(m)[0]]++
+	}
+	if want := map[string]int{"192.168.1.10": 300, "192.168.1.11": 100}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("answers = %v, want %v", counts, want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RawZones loads BIND-style zone files into the rules of network, like
+// hosts files. Origin applies to files without an $ORIGIN directive.
+type RawZones struct {
+	Files   StringList `yaml:"files,omitempty"`
+	Network string     `yaml:"network,omitempty"`
+	Origin  string     `yaml:"origin,omitempty"`
+}
+
+// readZoneFile turns the records of a zone file into one raw rule per
+// name. A rule has a single TTL, so it takes the lowest of its records.
+// Types that rules cannot hold, such as SOA and NS, are skipped.
+func readZoneFile(path, origin string, rawRules map[string]RawRule) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, dns.Fqdn(origin), path)
+	skipped := 0
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		rawRule := rawRules[name]
+		switch v := rr.(type) {
+		case *dns.A:
+			rawRule.IP = append(rawRule.IP, RawAddress{IP: v.A.String()})
+		case *dns.AAAA:
+			rawRule.IP = append(rawRule.IP, RawAddress{IP: v.AAAA.String()})
+		case *dns.CNAME:
+			rawRule.CNAME = v.Target
+		case *dns.TXT:
+			rawRule.TXT = append(rawRule.TXT, strings.Join(v.Txt, ""))
+		case *dns.MX:
+			rawRule.MX = append(rawRule.MX, fmt.Sprintf("%d %s", v.Preference, v.Mx))
+		case *dns.SRV:
+			rawRule.SRV = append(rawRule.SRV, RawSRV{Priority: v.Priority, Weight: v.Weight, Port: v.Port, Target: v.Target})
+		case *dns.HTTPS:
+			rawRule.HTTPS = append(rawRule.HTTPS, rdata(v))
+		case *dns.SVCB:
+			rawRule.SVCB = append(rawRule.SVCB, rdata(v))
+		default:
+			skipped++
+			continue
+		}
+		if rawRule.TTL == 0 || rr.Header().Ttl < rawRule.TTL {
+			rawRule.TTL = rr.Header().Ttl
+		}
+		rawRules[name] = rawRule
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		log.Printf("[WARN] Skipped %d record(s) of unsupported types in %s\n", skipped, path)
+	}
+	return nil
+}
+
+// addZones merges the zone files into the network configured with
+// raw.Network, or into a catch-all network when none is given.
+func addZones(c *Config, raw RawZones) error {
+	rawRules := map[string]RawRule{}
+	for _, path := range raw.Files {
+		if err := readZoneFile(path, raw.Origin, rawRules); err != nil {
+			return err
+		}
+	}
+	rules := make(map[string]Rule, len(rawRules))
+	for name, rawRule := range rawRules {
+		if problems := validateRule(rawRule); len(problems) > 0 {
+			return fmt.Errorf("Rule for %s %s", name, strings.Join(problems, ", "))
+		}
+		rule, err := buildRule(rawRule, c.DefaultTTL)
+		if err != nil {
+			return err
+		}
+		rules[name] = rule
+	}
+	return mergeRules(c, "zones", raw.Network, rules)
+}
+
+// dumpZone writes the rules of the network named or configured with
+// network as a zone file that addZones reads back. The SOA and NS records
+// of the network come first and are skipped on import; schedules, weights,
+// regexRules and the default rule have no zone file form and are noted in
+// comments only. Networks of a rule backend are not in the config file and
+// cannot be dumped.
+func dumpZone(c Config, network string, w io.Writer) error {
+	for _, candidate := range c.Networks {
+		if candidate.Name == network || candidate.hasCIDR(network) {
+			return writeZone(candidate, c.Generation, w)
+		}
+	}
+	return fmt.Errorf("No network %s in the config file", network)
+}
+
+func writeZone(network Network, generation uint32, w io.Writer) error {
+	if network.source != nil || network.fromEtcd {
+		return fmt.Errorf("Network %s keeps its rules in a backend, which --dump-zone cannot read", network.Name)
+	}
+	if len(network.Rules) == 0 && network.Zone == nil {
+		return fmt.Errorf("Network %s has no rules or zone apex with a zone file form", network.Name)
+	}
+	names := make([]string, 0, len(network.Rules))
+	for name := range network.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, err := fmt.Fprintf(w, "; rules of network %s\n", network.Name); err != nil {
+		return err
+	}
+	if zone := network.Zone; zone != nil {
+		for _, rr := range append(zone.records(zone.Name, dns.TypeSOA, generation), zone.records(zone.Name, dns.TypeNS, generation)...) {
+			fmt.Fprintln(w, rr)
+		}
+	}
+	if network.Default != nil {
+		fmt.Fprintln(w, "; the default rule for every other name is left out")
+	}
+	for _, regex := range network.RegexRules {
+		fmt.Fprintf(w, "; regexRules pattern %s is left out\n", regex.Pattern)
+	}
+	for _, name := range names {
+		rule := network.Rules[name]
+		if rule.Schedule != nil {
+			fmt.Fprintf(w, "; %s only applies %s\n", name, rule.Schedule)
+		}
+		if rule.Weights != nil {
+			fmt.Fprintf(w, "; %s has address weights %v\n", name, rule.Weights)
+		}
+		if rule.CNAME != "" {
+			fmt.Fprintln(w, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rule.TTL}, Target: rule.CNAME})
+		}
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeMX, dns.TypeSRV, dns.TypeHTTPS, dns.TypeSVCB} {
+			for _, template := range rule.records[rrtype] {
+				rr := dns.Copy(template)
+				rr.Header().Name = name
+				if _, err := fmt.Fprintln(w, rr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
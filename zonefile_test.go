@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN example.home.
+$TTL 600
+@       IN SOA ns1 hostmaster 2024010100 3600 600 86400 300
+        IN NS  ns1
+        IN MX  10 mail
+        IN MX  20 backup.mail
+mail    IN A   192.168.1.25
+        300 IN AAAA fd00::25
+www     IN CNAME mail
+`
+
+func TestZoneFile(t *testing.T) {
+	path := writeTestFile(t, "db.example.home", testZoneFile)
+	captureLog(t)
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules: {}
+matchBy: client
+recursion: false
+zones:
+  files: [`+path+`]
+  network: 10.0.0.0/8
+`)
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"mail.example.home.", dns.TypeA, []string{"192.168.1.25"}},
+		{"mail.example.home.", dns.TypeAAAA, []string{"fd00::25"}},
+		{"example.home.", dns.TypeMX, []string{"10 mail.example.home.", "20 backup.mail.example.home."}},
+		{"www.example.home.", dns.TypeA, []string{"mail.example.home.", "192.168.1.25"}},
+	}
+	for _, tt := range tests {
+		m := ask(t, c, "10.0.0.1", tt.name, tt.qtype)
+		if got := answerValues(m); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s = %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+	// A rule takes the lowest TTL of its records.
+	if rule := c.Networks[0].Rules["mail.example.home."]; rule.TTL != 300 {
+		t.Errorf("TTL of mail.example.home. = %d, want 300", rule.TTL)
+	}
+	// Clients of other networks do not see the zone.
+	if m := ask(t, c, "172.16.0.1", "mail.example.home.", dns.TypeA); len(m.Answer) != 0 {
+		t.Errorf("zone answered for a client outside the network: %v", m.Answer)
+	}
+}
+
+func TestDumpZoneRoundTrip(t *testing.T) {
+	captureLog(t)
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  authoritative: true
+  soa:
+    zone: lab.home.
+    mname: ns1.lab.home.
+    rname: hostmaster.lab.home.
+    serial: 2024010100
+  ns: [ns1.lab.home.]
+  rules:
+    nas.lab.home: 192.168.1.5
+    files.lab.home: nas.lab.home
+    mail.lab.home:
+      ip: [192.168.1.25, fd00::25]
+      ttl: 300
+      txt: [v=spf1 -all]
+      mx: [10 mail.lab.home.]
+    _ldap._tcp.lab.home:
+    - {priority: 10, weight: 60, port: 389, target: nas.lab.home.}
+    web.lab.home:
+      ip: 192.168.1.30
+      https: ["1 . alpn=h2"]
+matchBy: client
+recursion: false
+`)
+	var zone strings.Builder
+	if err := dumpZone(c, "10.0.0.0/8", &zone); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, "db.lab.home", zone.String())
+	imported := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules: {}
+matchBy: client
+recursion: false
+zones:
+  files: [`+path+`]
+  network: 10.0.0.0/8
+`)
+
+	questions := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"nas.lab.home.", dns.TypeA},
+		{"files.lab.home.", dns.TypeA},
+		{"mail.lab.home.", dns.TypeA},
+		{"mail.lab.home.", dns.TypeAAAA},
+		{"mail.lab.home.", dns.TypeTXT},
+		{"mail.lab.home.", dns.TypeMX},
+		{"_ldap._tcp.lab.home.", dns.TypeSRV},
+		{"web.lab.home.", dns.TypeHTTPS},
+	}
+	for _, q := range questions {
+		dnsCache.flush()
+		want := ask(t, c, "10.0.0.1", q.name, q.qtype)
+		dnsCache.flush()
+		got := ask(t, imported, "10.0.0.1", q.name, q.qtype)
+		if len(want.Answer) == 0 || !reflect.DeepEqual(answerStrings(got), answerStrings(want)) {
+			t.Errorf("%s %s after re-import = %v, want %v", q.name, dns.TypeToString[q.qtype], got.Answer, want.Answer)
+		}
+	}
+	if t.Failed() {
+		t.Logf("dumped zone:\n%s", zone.String())
+	}
+}
+
+// answerStrings formats the answer records including owner and TTL.
+func answerStrings(m *dns.Msg) []string {
+	values := []string{}
+	for _, rr := range m.Answer {
+		values = append(values, rr.String())
+	}
+	return values
+}
+
+func TestDumpZoneErrors(t *testing.T) {
+	c := loadTestConfig(t, `
+networks:
+- cidr: 10.0.0.0/8
+  rules:
+    nas.home: 192.168.1.5
+- cidr: 172.16.0.0/12
+  regexRules:
+    "^host[0-9]+\\.home\\.$": 172.16.0.1
+matchBy: client
+`)
+	tests := map[string]string{
+		"192.168.0.0/16": "No network 192.168.0.0/16 in the config file",
+		"172.16.0.0/12":  "Network 172.16.0.0/12 has no rules or zone apex with a zone file form",
+	}
+	for network, want := range tests {
+		var out strings.Builder
+		if err := dumpZone(c, network, &out); err == nil || err.Error() != want {
+			t.Errorf("dump of %s: got %v, want %q", network, err, want)
+		}
+	}
+
+	c.Networks[0].fromEtcd = true
+	var out strings.Builder
+	if err := dumpZone(c, "10.0.0.0/8", &out); err == nil || !strings.Contains(err.Error(), "keeps its rules in a backend") {
+		t.Errorf("dump of a backend network: got %v", err)
+	}
+}